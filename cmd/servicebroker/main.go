@@ -4,10 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/golang/glog"
@@ -109,6 +111,10 @@ func runWithContext(ctx context.Context) error {
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
 	reg.MustRegister(osbMetrics)
+	if err := businessLogic.RegisterMetrics(reg); err != nil {
+		glog.Errorf("[runWithContext] unable to register metrics: %s\n", err)
+		return err
+	}
 
 	glog.V(3).Infoln("[runWithContext] call NewAPISerface")
 
@@ -124,6 +130,15 @@ func runWithContext(ctx context.Context) error {
 
 	businessLogic.RouteActions(s.Router)
 	broker.CrudeOSBIHacks(s.Router, businessLogic)
+	broker.RouteAdminEndpoints(s.Router, businessLogic)
+	broker.RouteHealthEndpoints(s.Router, businessLogic)
+	s.Router.Use(businessLogic.TracingMiddleware)
+	s.Router.Use(businessLogic.RequestLogMiddleware)
+	// auditing before authentication records the calls it rejects too, the
+	// principal authentication finds is handed back to the audit entry.
+	s.Router.Use(businessLogic.AuditMiddleware)
+	s.Router.Use(businessLogic.AuthMiddleware)
+	s.Router.Use(businessLogic.APIVersionMiddleware)
 
 	if options.AuthenticateK8SToken {
 		// get k8s client
@@ -138,10 +153,20 @@ func runWithContext(ctx context.Context) error {
 		// create TokenReviewMiddleware
 		tr := middleware.TokenReviewMiddleware{
 			TokenReview: k8sClient.Authentication().TokenReviews(),
-			Authorizer:  authz,
+			Authorizer:  broker.PrincipalAuthorizer{UserInfoAuthorizer: authz},
 		}
-		// Use TokenReviewMiddleware.
-		s.Router.Use(tr.Middleware)
+		// Use TokenReviewMiddleware, except on the admin endpoints which authenticate on their own
+		// and the probes of the kubelet which have no token.
+		s.Router.Use(func(next http.Handler) http.Handler {
+			reviewed := tr.Middleware(next)
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+					next.ServeHTTP(w, r)
+					return
+				}
+				reviewed.ServeHTTP(w, r)
+			})
+		})
 	}
 
 	glog.Infof("Starting broker!")
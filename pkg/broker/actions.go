@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"strings"
+)
+
+// GetTasks returns the task history of an instance (newest first), including
+// failed tasks so the reason an operation is stuck can be seen without access
+// to the worker logs.
+func (b *BusinessLogic) GetTasks(InstanceID string) ([]Task, error) {
+	logger.V(3).Infof("[b.GetTasks] start: %s\n", InstanceID)
+	if _, err := b.storage.GetInstance(InstanceID); err != nil && err.Error() == "Cannot find resource instance" {
+		return nil, NotFound()
+	} else if err != nil {
+		logger.Errorf("Error finding instance id (during get tasks): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	tasks, err := b.storage.GetTasks(InstanceID)
+	if err != nil {
+		logger.Errorf("Unable to get tasks for %s: %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+	return tasks, nil
+}
+
+// GetWebhookDeliveries returns every attempt at delivering a webhook for an
+// instance (newest first).
+func (b *BusinessLogic) GetWebhookDeliveries(InstanceID string) ([]WebhookDelivery, error) {
+	logger.V(3).Infof("[b.GetWebhookDeliveries] start: %s\n", InstanceID)
+	if _, err := b.storage.GetInstance(InstanceID); err != nil && err.Error() == "Cannot find resource instance" {
+		return nil, NotFound()
+	} else if err != nil {
+		logger.Errorf("Error finding instance id (during get webhook deliveries): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	deliveries, err := b.storage.GetWebhookDeliveries(InstanceID)
+	if err != nil {
+		logger.Errorf("Unable to get webhook deliveries for %s: %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+	return deliveries, nil
+}
+
+// Redelivery is the event a webhook is sent again as, receivers see its id as the
+// delivery id.
+type Redelivery struct {
+	EventId string `json:"event_id"`
+}
+
+// RedeliverWebhook sends a webhook event for an instance again, the event id is
+// the event_id of its deliveries.
+func (b *BusinessLogic) RedeliverWebhook(InstanceID string, EventID string) (*Redelivery, error) {
+	logger.V(3).Infof("[b.RedeliverWebhook] start: %s %s\n", InstanceID, EventID)
+	redeliveryId, err := b.storage.RedeliverWebhook(InstanceID, EventID)
+	if err != nil && err.Error() == "Cannot find webhook" {
+		return nil, NotFound()
+	} else if err != nil && strings.HasPrefix(err.Error(), "Webhook is ") {
+		return nil, ConflictErrorWithMessage(err.Error())
+	} else if err != nil {
+		logger.Errorf("Unable to redeliver webhook %s for %s: %s\n", EventID, InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+	return &Redelivery{EventId: redeliveryId}, nil
+}
+
+func (b *BusinessLogic) ActionGetTasks(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.GetTasks(InstanceID)
+}
+
+func (b *BusinessLogic) ActionGetWebhookDeliveries(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.GetWebhookDeliveries(InstanceID)
+}
+
+func (b *BusinessLogic) ActionRedeliverWebhook(InstanceID string, vars map[string]string, context *broker.RequestContext) (interface{}, error) {
+	return b.RedeliverWebhook(InstanceID, vars["event_id"])
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TaskIntervention is an operator moving a task between statuses by hand, the
+// actor and reason are recorded alongside the task.
+type TaskIntervention struct {
+	Action     string
+	FromStatus string
+	ToStatus   string
+	Actor      string
+	Reason     string
+}
+
+var (
+	// RequeueTaskIntervention revives a failed task with its retries reset.
+	RequeueTaskIntervention = TaskIntervention{Action: "requeue", FromStatus: "failed", ToStatus: "pending"}
+	// CancelTaskIntervention stops a pending task from ever running.
+	CancelTaskIntervention = TaskIntervention{Action: "cancel", FromStatus: "pending", ToStatus: "cancelled"}
+	// FailTaskIntervention gives up on a started task that is stuck.
+	FailTaskIntervention = TaskIntervention{Action: "fail", FromStatus: "started", ToStatus: "failed"}
+)
+
+type adminRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ParseAdminCredentials reads a comma separated list of user:password pairs.
+func ParseAdminCredentials(credentials string) map[string]string {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(credentials, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users
+}
+
+func adminCredentialsFromOptions(o Options) map[string]string {
+	if o.AdminCredentials == "" && os.Getenv("ADMIN_CREDENTIALS") != "" {
+		o.AdminCredentials = os.Getenv("ADMIN_CREDENTIALS")
+	}
+	return ParseAdminCredentials(o.AdminCredentials)
+}
+
+// AuthenticateAdmin returns the name of the operator (the credential set) making
+// the request if the request carries valid admin basic auth credentials.
+func (b *BusinessLogic) AuthenticateAdmin(r *http.Request) (string, bool) {
+	set, ok := b.credentials.Authenticate(r, AdminScope)
+	if !ok {
+		return "", false
+	}
+	return set.Name, true
+}
+
+func writeAdminUnauthorized(w http.ResponseWriter) {
+	writeUnauthorized(w, string(AdminScope))
+}
+
+// authorizeAdmin authenticates an admin request and checks the operator has the
+// permission, writing the error if either fails.
+func (b *BusinessLogic) authorizeAdmin(w http.ResponseWriter, r *http.Request, permission Permission) (string, bool) {
+	actor, ok := b.AuthenticateAdmin(r)
+	if !ok {
+		writeAdminUnauthorized(w)
+		return "", false
+	}
+	if err := b.roles.Authorize(withPrincipal(r, Principal{Kind: "basic", Name: actor}), permission); err != nil {
+		HttpWriteError(w, err)
+		return "", false
+	}
+	return actor, true
+}
+
+func (b *BusinessLogic) InterveneInTask(TaskID string, intervention TaskIntervention, actor string, reason string) error {
+	logger.Infof("[b.InterveneInTask] %s task %s by %s: %s\n", intervention.Action, TaskID, actor, reason)
+	if strings.TrimSpace(reason) == "" {
+		return UnprocessableEntityWithMessage("ReasonRequired", "A reason must be given when changing a task.")
+	}
+	intervention.Actor = actor
+	intervention.Reason = reason
+	task, err := b.storage.InterveneInTask(TaskID, intervention)
+	if err != nil && err.Error() == "Cannot find task" {
+		return NotFound()
+	} else if err != nil && strings.HasPrefix(err.Error(), "Task is ") {
+		return ConflictErrorWithMessage(err.Error())
+	} else if err != nil {
+		logger.Errorf("Unable to %s task %s: %s\n", intervention.Action, TaskID, err.Error())
+		return InternalServerError()
+	}
+	if intervention.ToStatus == "failed" {
+		// the worker will not report a task it no longer owns, whoever asked
+		// for the operation is told it failed here.
+		var policy TaskPolicy
+		if handler, ok := GetTaskHandler(task.Action); ok {
+			policy = handler.Policy()
+		}
+		notifyTaskOutcome(context.Background(), b.storage, task, policy, "failed", task.Result)
+	}
+	return nil
+}
+
+func (b *BusinessLogic) RequeueTask(TaskID string, actor string, reason string) error {
+	return b.InterveneInTask(TaskID, RequeueTaskIntervention, actor, reason)
+}
+
+func (b *BusinessLogic) CancelTask(TaskID string, actor string, reason string) error {
+	return b.InterveneInTask(TaskID, CancelTaskIntervention, actor, reason)
+}
+
+func (b *BusinessLogic) FailTask(TaskID string, actor string, reason string) error {
+	return b.InterveneInTask(TaskID, FailTaskIntervention, actor, reason)
+}
+
+func (b *BusinessLogic) adminTaskHandler(change func(string, string, string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := b.authorizeAdmin(w, r, ManageTasksPermission)
+		if !ok {
+			return
+		}
+		var req adminRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			HttpWriteError(w, UnprocessableEntityWithMessage("InvalidBody", "The request body must be json with a reason."))
+			return
+		}
+		if err := change(mux.Vars(r)["task_id"], actor, req.Reason); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, map[string]string{})
+	}
+}
+
+// RouteAdminEndpoints adds the endpoints on-call operators use to revive or stop
+// tasks, read the audit trail and export usage for billing, these are
+// authenticated with the admin credentials and not the OSB authentication.
+func RouteAdminEndpoints(router *mux.Router, b *BusinessLogic) {
+	router.HandleFunc("/admin/tasks/{task_id}/requeue", b.adminTaskHandler(b.RequeueTask)).Methods("POST")
+	router.HandleFunc("/admin/tasks/{task_id}/cancel", b.adminTaskHandler(b.CancelTask)).Methods("POST")
+	router.HandleFunc("/admin/tasks/{task_id}/fail", b.adminTaskHandler(b.FailTask)).Methods("POST")
+	router.HandleFunc("/admin/audit", b.adminAuditHandler).Methods("GET")
+	router.HandleFunc("/admin/usage", b.adminUsageHandler).Methods("GET")
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// APIVersion is a broker api (X-Broker-API-Version) version. Minor versions are
+// backwards compatible so any 2.x from the minimum on is accepted, responses are
+// rendered for the requested version or the latest this broker knows of if the
+// request is for a newer one.
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+var (
+	MinimumAPIVersion = APIVersion{2, 12}
+	LatestAPIVersion  = APIVersion{2, 15}
+
+	// fetching instances and bindings, binding last operations and asynchronous bindings.
+	apiVersion2_14 = APIVersion{2, 14}
+	// maintenance_info, instance_usable and update_repeatable.
+	apiVersion2_15 = APIVersion{2, 15}
+)
+
+func ParseAPIVersion(version string) (APIVersion, error) {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	if len(parts) != 2 {
+		return APIVersion{}, errors.New("The broker api version must be of the form <major>.<minor>")
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return APIVersion{}, errors.New("The broker api version must be of the form <major>.<minor>")
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return APIVersion{}, errors.New("The broker api version must be of the form <major>.<minor>")
+	}
+	return APIVersion{major, minor}, nil
+}
+
+func (v APIVersion) AtLeast(other APIVersion) bool {
+	return v.Major > other.Major || (v.Major == other.Major && v.Minor >= other.Minor)
+}
+
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// negotiateAPIVersion is the version a response is rendered for.
+func negotiateAPIVersion(version string) (APIVersion, error) {
+	if version == "" {
+		return APIVersion{}, errors.New("The " + osb.APIVersionHeader + " header is required, this broker supports " + MinimumAPIVersion.String() + " to " + LatestAPIVersion.String())
+	}
+	v, err := ParseAPIVersion(version)
+	if err != nil {
+		return APIVersion{}, err
+	}
+	if v.Major != LatestAPIVersion.Major || !v.AtLeast(MinimumAPIVersion) {
+		return APIVersion{}, errors.New("The broker api version " + version + " is not supported, this broker supports " + MinimumAPIVersion.String() + " to " + LatestAPIVersion.String())
+	}
+	if v.AtLeast(LatestAPIVersion) {
+		return LatestAPIVersion, nil
+	}
+	return v, nil
+}
+
+func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
+	_, err := negotiateAPIVersion(version)
+	return err
+}
+
+// requestAPIVersion is the version a (validated) request is rendered for.
+func requestAPIVersion(r *http.Request) APIVersion {
+	if r == nil {
+		return MinimumAPIVersion
+	}
+	v, err := negotiateAPIVersion(r.Header.Get(osb.APIVersionHeader))
+	if err != nil {
+		return MinimumAPIVersion
+	}
+	return v
+}
+
+func contextAPIVersion(c *broker.RequestContext) APIVersion {
+	if c == nil {
+		return MinimumAPIVersion
+	}
+	return requestAPIVersion(c.Request)
+}
+
+func PreconditionFailedWithMessage(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusPreconditionFailed,
+		Description: &description,
+	}
+}
+
+// requireAPIVersion refuses features the version a request is for does not have.
+func requireAPIVersion(r *http.Request, version APIVersion, feature string) error {
+	if !requestAPIVersion(r).AtLeast(version) {
+		return PreconditionFailedWithMessage(feature + " requires broker api version " + version.String() + " or later.")
+	}
+	return nil
+}
+
+// APIVersionMiddleware refuses calls to the OSB api with a broker api version
+// this broker does not support, and tells the caller which version the response
+// was rendered for. Extension actions and the task and webhook history under
+// /v2/ are not part of the OSB api and are not checked.
+func (b *BusinessLogic) APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") || requestScope(r.URL.Path) != OSBScope {
+			next.ServeHTTP(w, r)
+			return
+		}
+		version, err := negotiateAPIVersion(r.Header.Get(osb.APIVersionHeader))
+		if err != nil {
+			HttpWriteError(w, PreconditionFailedWithMessage(err.Error()))
+			return
+		}
+		w.Header().Set(osb.APIVersionHeader, version.String())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+package broker
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIVersionMiddleware(t *testing.T) {
+	Convey("Given a handler behind the api version middleware", t, func() {
+		b := &BusinessLogic{}
+		handler := b.APIVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		call := func(path string, version string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", path, nil)
+			if version != "" {
+				r.Header.Set("X-Broker-API-Version", version)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Supported versions are answered for the version asked for", func() {
+			w := call("/v2/catalog", "2.13")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("X-Broker-API-Version"), ShouldEqual, "2.13")
+		})
+
+		Convey("Newer minor versions are answered for the latest version", func() {
+			w := call("/v2/catalog", "2.17")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("X-Broker-API-Version"), ShouldEqual, LatestAPIVersion.String())
+		})
+
+		Convey("Missing, old, other major and malformed versions are refused", func() {
+			So(call("/v2/catalog", "").Code, ShouldEqual, http.StatusPreconditionFailed)
+			So(call("/v2/catalog", "2.11").Code, ShouldEqual, http.StatusPreconditionFailed)
+			So(call("/v2/catalog", "3.0").Code, ShouldEqual, http.StatusPreconditionFailed)
+			So(call("/v2/catalog", "latest").Code, ShouldEqual, http.StatusPreconditionFailed)
+		})
+
+		Convey("Calls outside of the OSB api are not checked", func() {
+			So(call("/admin/audit", "").Code, ShouldEqual, http.StatusOK)
+			So(call("/v2/service_instances/i1/actions/restart", "").Code, ShouldEqual, http.StatusOK)
+			So(call("/v2/service_instances/i1/tasks", "").Code, ShouldEqual, http.StatusOK)
+			So(call("/v2/service_instances/i1/webhooks", "").Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
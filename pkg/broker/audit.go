@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditEntry is a single call to the OSB api or an extension action, identity
+// is the user the platform says made the call (the username or user_id in
+// the originating identity) and origin is the full originating identity value.
+// Principal is who the broker authenticated (basic:<credential set name> or
+// user:<kubernetes username>) and scope the scope of the credential set, both
+// are empty when the call was not authenticated.
+type AuditEntry struct {
+	Id         string          `json:"id"`
+	Platform   string          `json:"platform"`
+	Identity   string          `json:"identity"`
+	Origin     string          `json:"origin"`
+	Principal  string          `json:"principal"`
+	Scope      string          `json:"scope"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	InstanceId string          `json:"instance_id"`
+	BindingId  string          `json:"binding_id"`
+	Parameters json.RawMessage `json:"parameters"`
+	StatusCode int             `json:"status_code"`
+	LatencyMs  int64           `json:"latency_ms"`
+	Created    time.Time       `json:"created"`
+}
+
+// AuditQuery filters the audit trail, empty fields are not filtered on.
+type AuditQuery struct {
+	InstanceId string
+	Identity   string
+	Limit      int
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// maxAuditBody is how much of a request body is kept, anything longer is
+	// not recorded at all as it would no longer be valid json.
+	maxAuditBody = 64 * 1024
+	redacted     = "[REDACTED]"
+)
+
+// ParseOriginatingIdentity reads the X-Broker-API-Originating-Identity header,
+// "<platform> <base64 encoded json>".
+func ParseOriginatingIdentity(header string) (platform string, identity string, origin string) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return "", "", ""
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return parts[0], "", ""
+	}
+	origin = string(value)
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err == nil {
+		for _, key := range []string{"username", "user_id", "user", "uid"} {
+			if v, ok := fields[key].(string); ok && v != "" {
+				return parts[0], v, origin
+			}
+		}
+	}
+	return parts[0], origin, origin
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "secret", "token", "credential", "private", "key"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactParameters replaces the value of anything that looks like a secret.
+func redactParameters(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if isSecretKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactParameters(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactParameters(item)
+		}
+	}
+	return value
+}
+
+func auditParameters(r *http.Request, body []byte) json.RawMessage {
+	params := map[string]interface{}{}
+	query := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		if isSecretKey(key) {
+			query[key] = redacted
+		} else if key == "webhook" {
+			// only the host, the rest of a webhook url may hold tokens.
+			query[key] = redacted
+			if u, err := url.Parse(values[0]); err == nil {
+				query[key] = u.Host
+			}
+		} else {
+			query[key] = strings.Join(values, ",")
+		}
+	}
+	if len(query) > 0 {
+		params["query"] = query
+	}
+	if len(body) > 0 {
+		var parsed interface{}
+		if err := json.Unmarshal(body, &parsed); err == nil {
+			params["body"] = redactParameters(parsed)
+		}
+	}
+	byteData, err := json.Marshal(params)
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return byteData
+}
+
+// auditActorKey holds the principal the audit middleware is told of by
+// withPrincipal, authentication runs inside of the audit middleware so calls it
+// rejects are recorded as well.
+type auditActorKey struct{}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// AuditMiddleware records every call to the OSB api and extension actions (all
+// of /v2/) in the audit trail, it must be used on the router the routes are on
+// so the instance and binding ids can be read from the route.
+func (b *BusinessLogic) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if len(body) > maxAuditBody {
+				body = nil
+			}
+		}
+		writer := &auditResponseWriter{ResponseWriter: w}
+		actor := &Principal{}
+		r = r.WithContext(context.WithValue(r.Context(), auditActorKey{}, actor))
+		start := time.Now()
+		next.ServeHTTP(writer, r)
+
+		vars := mux.Vars(r)
+		entry := AuditEntry{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			InstanceId: vars[osb.VarKeyInstanceID],
+			BindingId:  vars[osb.VarKeyBindingID],
+			Parameters: auditParameters(r, body),
+			StatusCode: writer.status,
+			LatencyMs:  int64(time.Since(start) / time.Millisecond),
+		}
+		if entry.StatusCode == 0 {
+			entry.StatusCode = http.StatusOK
+		}
+		if actor.Kind != "" {
+			entry.Principal = actor.subjects()[0]
+			entry.Scope = string(actor.Scope)
+		}
+		entry.Platform, entry.Identity, entry.Origin = ParseOriginatingIdentity(r.Header.Get(osb.OriginatingIdentityHeader))
+		if err := b.storage.AddAuditEntry(&entry); err != nil {
+			logger.Errorf("Unable to record audit entry for %s %s by %s: %s\n", entry.Method, entry.Path, entry.Identity, err.Error())
+		}
+	})
+}
+
+// GetAuditEntries returns the audit trail newest first, filtered by instance
+// or identity.
+func (b *BusinessLogic) GetAuditEntries(query AuditQuery) ([]AuditEntry, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditLimit
+	}
+	if query.Limit > maxAuditLimit {
+		query.Limit = maxAuditLimit
+	}
+	entries, err := b.storage.GetAuditEntries(query)
+	if err != nil {
+		logger.Errorf("Unable to get audit entries: %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	return entries, nil
+}
+
+func (b *BusinessLogic) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := b.authorizeAdmin(w, r, ReadAuditPermission); !ok {
+		return
+	}
+	query := AuditQuery{
+		InstanceId: r.URL.Query().Get("instance_id"),
+		Identity:   r.URL.Query().Get("identity"),
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			HttpWriteError(w, UnprocessableEntityWithMessage("InvalidLimit", "The limit must be a number."))
+			return
+		}
+		query.Limit = n
+	}
+	entries, err := b.GetAuditEntries(query)
+	if err != nil {
+		HttpWriteError(w, err)
+		return
+	}
+	HttpWrite(w, 200, entries)
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeAuditStorage struct {
+	Storage
+	entries []AuditEntry
+}
+
+func (s *fakeAuditStorage) AddAuditEntry(entry *AuditEntry) error {
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	Convey("Given originating identity headers", t, func() {
+		platform, identity, origin := ParseOriginatingIdentity("kubernetes " + base64.StdEncoding.EncodeToString([]byte(`{"username":"jane","uid":"1"}`)))
+		So(platform, ShouldEqual, "kubernetes")
+		So(identity, ShouldEqual, "jane")
+		So(origin, ShouldEqual, `{"username":"jane","uid":"1"}`)
+
+		platform, identity, _ = ParseOriginatingIdentity("cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"abc"}`)))
+		So(platform, ShouldEqual, "cloudfoundry")
+		So(identity, ShouldEqual, "abc")
+
+		platform, identity, _ = ParseOriginatingIdentity("")
+		So(platform, ShouldEqual, "")
+		So(identity, ShouldEqual, "")
+	})
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	Convey("Given a router with the audit middleware", t, func() {
+		storage := &fakeAuditStorage{}
+		b := &BusinessLogic{storage: storage}
+		router := mux.NewRouter()
+		router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		}).Methods("PUT")
+		router.HandleFunc("/admin/audit", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+		router.Use(b.AuditMiddleware)
+
+		Convey("An OSB call is recorded with its identity, ids and redacted parameters", func() {
+			body := `{"plan_id":"p1","parameters":{"name":"db","password":"hunter2","nested":{"api_token":"t"}}}`
+			r := httptest.NewRequest("PUT", "/v2/service_instances/i1/service_bindings/b1?webhook=https://example.com/hook?token=x&secret=s", strings.NewReader(body))
+			r.Header.Set("X-Broker-API-Originating-Identity", "kubernetes "+base64.StdEncoding.EncodeToString([]byte(`{"username":"jane"}`)))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			So(len(storage.entries), ShouldEqual, 1)
+			entry := storage.entries[0]
+			So(entry.Identity, ShouldEqual, "jane")
+			So(entry.Method, ShouldEqual, "PUT")
+			So(entry.InstanceId, ShouldEqual, "i1")
+			So(entry.BindingId, ShouldEqual, "b1")
+			So(entry.StatusCode, ShouldEqual, http.StatusCreated)
+			params := string(entry.Parameters)
+			So(params, ShouldContainSubstring, `"name":"db"`)
+			So(params, ShouldContainSubstring, `"webhook":"example.com"`)
+			So(params, ShouldNotContainSubstring, "hunter2")
+			So(params, ShouldNotContainSubstring, `"t"`)
+			So(params, ShouldNotContainSubstring, `"s"`)
+		})
+
+		Convey("Calls outside of the OSB api are not recorded", func() {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/audit", nil))
+			So(len(storage.entries), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestAuditActor(t *testing.T) {
+	Convey("Given a router with the audit middleware before authentication", t, func() {
+		storage := &fakeAuditStorage{}
+		credentials, err := credentialsFromOptions(Options{BrokerCredentials: "platform:osb:akkeris:p1"})
+		So(err, ShouldBeNil)
+		b := &BusinessLogic{storage: storage, credentials: credentials}
+		router := mux.NewRouter()
+		router.HandleFunc("/v2/catalog", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+		router.Use(b.AuditMiddleware)
+		router.Use(b.AuthMiddleware)
+
+		Convey("An authenticated call is recorded with its principal and scope", func() {
+			r := httptest.NewRequest("GET", "/v2/catalog", nil)
+			r.SetBasicAuth("akkeris", "p1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(len(storage.entries), ShouldEqual, 1)
+			So(storage.entries[0].Principal, ShouldEqual, "basic:platform")
+			So(storage.entries[0].Scope, ShouldEqual, "osb")
+		})
+
+		Convey("A rejected call is recorded without a principal", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(len(storage.entries), ShouldEqual, 1)
+			So(storage.entries[0].StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(storage.entries[0].Principal, ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialScope is what a set of basic auth credentials may be used for, the
+// OSB api or the admin endpoints and extension actions.
+type CredentialScope string
+
+const (
+	OSBScope   CredentialScope = "osb"
+	AdminScope CredentialScope = "admin"
+)
+
+// credentialsReloadInterval is how often the credentials file is checked for
+// changes, credentials can be rotated by adding the new set, moving clients
+// over to it and then removing the old set.
+const credentialsReloadInterval = time.Second * 10
+
+// CredentialSet is a named username and password for one scope.
+type CredentialSet struct {
+	Name     string
+	Scope    CredentialScope
+	Username string
+	Password string
+}
+
+// ParseCredentialSets reads comma or newline separated name:scope:username:password
+// entries, blank lines and lines starting with # are ignored.
+func ParseCredentialSets(value string) ([]CredentialSet, error) {
+	sets := make([]CredentialSet, 0)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			parts := strings.SplitN(entry, ":", 4)
+			if len(parts) != 4 || parts[0] == "" || parts[2] == "" || parts[3] == "" {
+				return nil, errors.New("Credential sets must be of the form name:scope:username:password")
+			}
+			scope := CredentialScope(parts[1])
+			if scope != OSBScope && scope != AdminScope {
+				return nil, errors.New("The credential set " + parts[0] + " has an unknown scope " + parts[1] + ", it must be osb or admin")
+			}
+			sets = append(sets, CredentialSet{Name: parts[0], Scope: scope, Username: parts[2], Password: parts[3]})
+		}
+	}
+	return sets, nil
+}
+
+// Credentials are the basic auth credential sets the broker accepts, those from
+// a file are re-read when the file changes.
+type Credentials struct {
+	sync.RWMutex
+	static   []CredentialSet
+	file     string
+	fromFile []CredentialSet
+	modified time.Time
+	checked  time.Time
+	// enforce is whether extension actions, /tasks and /webhooks require admin
+	// credentials, they do once any credential set (broker or admin) is configured.
+	enforce bool
+	// enforceOSB is whether the OSB api requires credentials, it does once any
+	// broker credential set is configured.
+	enforceOSB bool
+}
+
+func credentialsFromOptions(o Options) (*Credentials, error) {
+	if o.BrokerCredentials == "" && os.Getenv("BROKER_CREDENTIALS") != "" {
+		o.BrokerCredentials = os.Getenv("BROKER_CREDENTIALS")
+	}
+	if o.BrokerCredentialsFile == "" && os.Getenv("BROKER_CREDENTIALS_FILE") != "" {
+		o.BrokerCredentialsFile = os.Getenv("BROKER_CREDENTIALS_FILE")
+	}
+	sets, err := ParseCredentialSets(o.BrokerCredentials)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &Credentials{static: sets, file: o.BrokerCredentialsFile, enforceOSB: len(sets) > 0 || o.BrokerCredentialsFile != ""}
+	for user, password := range adminCredentialsFromOptions(o) {
+		credentials.static = append(credentials.static, CredentialSet{Name: user, Scope: AdminScope, Username: user, Password: password})
+	}
+	credentials.enforce = len(credentials.static) > 0 || credentials.file != ""
+	if credentials.file != "" {
+		if err = credentials.load(); err != nil {
+			return nil, err
+		}
+	}
+	if !credentials.enforceOSB {
+		logger.Infof("No broker credentials were specified, the OSB api does not require basic auth.\n")
+	}
+	return credentials, nil
+}
+
+func (c *Credentials) load() error {
+	info, err := os.Stat(c.file)
+	if err != nil {
+		return err
+	}
+	c.checked = time.Now()
+	if info.ModTime().Equal(c.modified) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	sets, err := ParseCredentialSets(string(data))
+	if err != nil {
+		return err
+	}
+	c.fromFile = sets
+	c.modified = info.ModTime()
+	logger.Infof("Loaded %d credential sets from %s\n", len(sets), c.file)
+	return nil
+}
+
+// sets are the current credential sets, a file that cannot be read (or has
+// mistakes in it) leaves the sets last read from it in place.
+func (c *Credentials) sets() []CredentialSet {
+	c.RLock()
+	stale := c.file != "" && time.Since(c.checked) > credentialsReloadInterval
+	c.RUnlock()
+	if stale {
+		c.Lock()
+		if time.Since(c.checked) > credentialsReloadInterval {
+			if err := c.load(); err != nil {
+				c.checked = time.Now()
+				logger.Errorf("Unable to reload credentials from %s: %s\n", c.file, err.Error())
+			}
+		}
+		c.Unlock()
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return append(append([]CredentialSet{}, c.static...), c.fromFile...)
+}
+
+// Authenticate returns the credential set a request's basic auth matches in the scope.
+func (c *Credentials) Authenticate(r *http.Request, scope CredentialScope) (*CredentialSet, bool) {
+	if c == nil {
+		return nil, false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	var match *CredentialSet
+	for _, set := range c.sets() {
+		if set.Scope != scope {
+			continue
+		}
+		// compare every set so the time taken does not say which usernames exist.
+		userMatches := subtle.ConstantTimeCompare([]byte(set.Username), []byte(user)) == 1
+		passwordMatches := subtle.ConstantTimeCompare([]byte(set.Password), []byte(password)) == 1
+		if userMatches && passwordMatches && match == nil {
+			found := set
+			match = &found
+		}
+	}
+	return match, match != nil
+}
+
+// requestScope is the scope needed for a call under /v2/, extension actions and
+// the task and webhook history are not part of the OSB api.
+func requestScope(path string) CredentialScope {
+	if strings.Contains(path, "/actions/") || strings.HasSuffix(path, "/tasks") || strings.HasSuffix(path, "/webhooks") {
+		return AdminScope
+	}
+	return OSBScope
+}
+
+// enforces is whether calls of the scope require credentials, admin calls do
+// even if only ADMIN_CREDENTIALS are configured.
+func (c *Credentials) enforces(scope CredentialScope) bool {
+	if scope == AdminScope {
+		return c.enforce
+	}
+	return c.enforceOSB
+}
+
+func writeUnauthorized(w http.ResponseWriter, realm string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	HttpWriteError(w, Unauthorized())
+}
+
+// AuthMiddleware requires basic auth from a credential set of the right scope on
+// calls to the OSB api and extension actions (all of /v2/) once broker credentials
+// are configured. The admin endpoints authenticate on their own.
+func (b *BusinessLogic) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") || b.credentials == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := requestScope(r.URL.Path)
+		if !b.credentials.enforces(scope) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		set, ok := b.credentials.Authenticate(r, scope)
+		if !ok {
+			writeUnauthorized(w, string(scope))
+			return
+		}
+		next.ServeHTTP(w, withPrincipal(r, Principal{Kind: "basic", Name: set.Name, Scope: set.Scope}))
+	})
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseCredentialSets(t *testing.T) {
+	Convey("Given credential sets", t, func() {
+		sets, err := ParseCredentialSets("platform:osb:akkeris:p1, oncall:admin:ops:p:2\n# old\n\nrotated:osb:akkeris:p3")
+		So(err, ShouldBeNil)
+		So(sets, ShouldResemble, []CredentialSet{
+			{Name: "platform", Scope: OSBScope, Username: "akkeris", Password: "p1"},
+			{Name: "oncall", Scope: AdminScope, Username: "ops", Password: "p:2"},
+			{Name: "rotated", Scope: OSBScope, Username: "akkeris", Password: "p3"},
+		})
+
+		_, err = ParseCredentialSets("platform:everything:akkeris:p1")
+		So(err, ShouldNotBeNil)
+		_, err = ParseCredentialSets("platform:osb:akkeris")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	Convey("Given the broker with credential sets from a file", t, func() {
+		file, err := ioutil.TempFile("", "credentials")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+		ioutil.WriteFile(file.Name(), []byte("platform:osb:akkeris:old\n"), 0600)
+
+		credentials, err := credentialsFromOptions(Options{BrokerCredentialsFile: file.Name(), AdminCredentials: "ops:secret"})
+		So(err, ShouldBeNil)
+		b := &BusinessLogic{credentials: credentials}
+		handler := b.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		call := func(path string, user string, password string) int {
+			r := httptest.NewRequest("GET", path, nil)
+			if user != "" {
+				r.SetBasicAuth(user, password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("OSB calls need osb credentials", func() {
+			So(call("/v2/catalog", "", ""), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/catalog", "akkeris", "wrong"), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/catalog", "ops", "secret"), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/catalog", "akkeris", "old"), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Extension actions need admin credentials", func() {
+			So(call("/v2/service_instances/i1/actions/tasks", "akkeris", "old"), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/service_instances/i1/actions/tasks", "ops", "secret"), ShouldEqual, http.StatusOK)
+			So(call("/v2/service_instances/i1/tasks", "ops", "secret"), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Rotated credentials are picked up without a restart", func() {
+			ioutil.WriteFile(file.Name(), []byte("platform:osb:akkeris:new\n"), 0600)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(file.Name(), later, later)
+			credentials.checked = time.Time{}
+			So(call("/v2/catalog", "akkeris", "new"), ShouldEqual, http.StatusOK)
+			So(call("/v2/catalog", "akkeris", "old"), ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Admin endpoints are left to authenticate on their own", func() {
+			So(call("/admin/audit", "", ""), ShouldEqual, http.StatusOK)
+			name, ok := b.AuthenticateAdmin(func() *http.Request {
+				r := httptest.NewRequest("GET", "/admin/audit", nil)
+				r.SetBasicAuth("ops", "secret")
+				return r
+			}())
+			So(ok, ShouldBeTrue)
+			So(name, ShouldEqual, "ops")
+		})
+	})
+
+	Convey("Given the broker with only admin credentials", t, func() {
+		credentials, err := credentialsFromOptions(Options{AdminCredentials: "ops:secret"})
+		So(err, ShouldBeNil)
+		b := &BusinessLogic{credentials: credentials}
+		handler := b.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		call := func(path string, user string, password string) int {
+			r := httptest.NewRequest("GET", path, nil)
+			if user != "" {
+				r.SetBasicAuth(user, password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("Extension actions, tasks and webhooks still need admin credentials", func() {
+			So(call("/v2/service_instances/i1/actions/tasks", "", ""), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/service_instances/i1/tasks", "", ""), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/service_instances/i1/webhooks", "", ""), ShouldEqual, http.StatusUnauthorized)
+			So(call("/v2/service_instances/i1/tasks", "ops", "secret"), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("The OSB api is left open as no broker credentials are set", func() {
+			So(call("/v2/catalog", "", ""), ShouldEqual, http.StatusOK)
+		})
+	})
+}
@@ -6,11 +6,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
@@ -78,6 +78,31 @@ func HttpWrite(w http.ResponseWriter, status int, obj interface{}) {
 	w.Write(data)
 }
 
+// HttpWriteError writes an error returned from the business logic in the same
+// shape the OSB api uses, anything that is not an osb.HTTPStatusCodeError is
+// reported as an internal server error.
+func HttpWriteError(w http.ResponseWriter, err error) {
+	type e struct {
+		ErrorMessage *string `json:"error,omitempty"`
+		Description  *string `json:"description,omitempty"`
+	}
+	if httpErr, ok := osb.IsHTTPError(err); ok {
+		body := &e{}
+		if httpErr.Description != nil {
+			body.Description = httpErr.Description
+		}
+		if httpErr.ErrorMessage != nil {
+			body.ErrorMessage = httpErr.ErrorMessage
+		}
+		HttpWrite(w, httpErr.StatusCode, body)
+		return
+	}
+	msg := "InternalServerError"
+	description := "Internal Server Error"
+	body := &e{ErrorMessage: &msg, Description: &description}
+	HttpWrite(w, 500, body)
+}
+
 func InternalServerError() error {
 	description := "Internal Server Error"
 	return osb.HTTPStatusCodeError{
@@ -101,6 +126,14 @@ func UnprocessableEntityWithMessage(err string, description string) error {
 	}
 }
 
+func BadRequestWithMessage(err string, description string) error {
+	return osb.HTTPStatusCodeError{
+		ResponseError: errors.New(err),
+		StatusCode:    http.StatusBadRequest,
+		Description:   &description,
+	}
+}
+
 func UnprocessableEntity() error {
 	description := "Unprocessable Entity"
 	return osb.HTTPStatusCodeError{
@@ -109,6 +142,22 @@ func UnprocessableEntity() error {
 	}
 }
 
+func Gone() error {
+	description := "Gone"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusGone,
+		Description: &description,
+	}
+}
+
+func Unauthorized() error {
+	description := "Unauthorized"
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusUnauthorized,
+		Description: &description,
+	}
+}
+
 func NotFound() error {
 	description := "Not Found"
 	return osb.HTTPStatusCodeError{
@@ -118,18 +167,23 @@ func NotFound() error {
 }
 
 type Action struct {
-	name    string
-	path    string
-	method  string
-	handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)
+	name       string
+	path       string
+	method     string
+	permission Permission
+	handler    func(string, map[string]string, *broker.RequestContext) (interface{}, error)
 }
 
 type ActionBase struct {
 	actions []Action
+	roles   *RoleBindings
 	sync.RWMutex
 }
 
 func InitFromOptions(ctx context.Context, o Options) (Storage, string, error) {
+	if err := configureLogging(o); err != nil {
+		return nil, "", err
+	}
 	if o.NamePrefix == "" && os.Getenv("NAME_PREFIX") != "" {
 		o.NamePrefix = os.Getenv("NAME_PREFIX")
 	}
@@ -198,7 +252,7 @@ func (b *ActionBase) ActionSchemaHandler(w http.ResponseWriter, r *http.Request)
 				Method  string
 			}{BaseUrl: baseUrl, Name: action.name, Path: action.path, Method: action.method})
 			if err != nil {
-				glog.Errorf("Cannot generate swagger doc: %s\n", err.Error())
+				logger.Errorf("Cannot generate swagger doc: %s\n", err.Error())
 				w.WriteHeader(500)
 				w.Write([]byte("Cannot generate swagger doc"))
 				return
@@ -218,34 +272,19 @@ func (b *ActionBase) ActionSchemaHandler(w http.ResponseWriter, r *http.Request)
 
 func (b *ActionBase) RouteActions(router *mux.Router) error {
 	for _, action := range b.actions {
-		glog.Infof("Adding route %s /v2/service_instances/{instance_id}/actions/%s\n", action.method, action.path)
+		logger.Infof("Adding route %s /v2/service_instances/{instance_id}/actions/%s\n", action.method, action.path)
 		var act Action = action
 		router.HandleFunc("/v2/service_instances/{instance_id}/actions/"+action.path, func(w http.ResponseWriter, r *http.Request) {
+			if err := b.roles.Authorize(r, act.permission); err != nil {
+				HttpWriteError(w, err)
+				return
+			}
 			vars := mux.Vars(r)
 			c := broker.RequestContext{Request: r, Writer: w}
 			obj, herr := act.handler(vars["instance_id"], vars, &c)
 			if herr != nil {
-				type e struct {
-					ErrorMessage *string `json:"error,omitempty"`
-					Description  *string `json:"description,omitempty"`
-				}
-				if httpErr, ok := osb.IsHTTPError(herr); ok {
-					body := &e{}
-					if httpErr.Description != nil {
-						body.Description = httpErr.Description
-					}
-					if httpErr.ErrorMessage != nil {
-						body.ErrorMessage = httpErr.ErrorMessage
-					}
-					HttpWrite(w, httpErr.StatusCode, body)
-					return
-				} else {
-					msg := "InternalServerError"
-					description := "Internal Server Error"
-					body := &e{ErrorMessage: &msg, Description: &description}
-					HttpWrite(w, 500, body)
-					return
-				}
+				HttpWriteError(w, herr)
+				return
 			}
 			if obj != nil {
 				HttpWrite(w, 200, obj)
@@ -270,47 +309,240 @@ func (b *ActionBase) ConvertActionsToExtensions(serviceId string) []osb.Extensio
 	return extensions
 }
 
-func (b *ActionBase) AddActions(name string, path string, method string, handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)) error {
+// AddActions adds an extension action, callers must have the permission to use it.
+func (b *ActionBase) AddActions(name string, path string, method string, permission Permission, handler func(string, map[string]string, *broker.RequestContext) (interface{}, error)) error {
 	b.Lock()
 	defer b.Unlock()
 	b.actions = append(b.actions, Action{
-		name:    name,
-		path:    path,
-		method:  method,
-		handler: handler,
+		name:       name,
+		path:       path,
+		method:     method,
+		permission: permission,
+		handler:    handler,
 	})
 	return nil
 }
 
-// These are hacks to support more of V2.14 such as get service instance and get service bindings.
+// bufferedWriter holds on to a response written by the osb library so that it
+// can be changed before it is sent.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// withCatalogExtensions adds instances_retrievable to every service and the
+// maintenance_info of every plan in the catalog, the osb client has no fields for
+// them. The maintenance version of a plan is its engine version.
+func withCatalogExtensions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(writer, r)
+		var catalog map[string]interface{}
+		if writer.status != http.StatusOK || json.Unmarshal(writer.body.Bytes(), &catalog) != nil {
+			w.WriteHeader(writer.status)
+			w.Write(writer.body.Bytes())
+			return
+		}
+		version := requestAPIVersion(r)
+		if services, ok := catalog["services"].([]interface{}); ok && version.AtLeast(apiVersion2_14) {
+			for _, service := range services {
+				if s, ok := service.(map[string]interface{}); ok {
+					s["instances_retrievable"] = true
+					plans, _ := s["plans"].([]interface{})
+					if !version.AtLeast(apiVersion2_15) {
+						continue
+					}
+					for _, plan := range plans {
+						if p, ok := plan.(map[string]interface{}); ok {
+							if info := planMaintenanceInfo(p); info != nil {
+								p["maintenance_info"] = info
+							}
+						}
+					}
+				}
+			}
+		}
+		HttpWrite(w, http.StatusOK, catalog)
+	})
+}
+
+func planMaintenanceInfo(plan map[string]interface{}) *MaintenanceInfo {
+	metadata, _ := plan["metadata"].(map[string]interface{})
+	engine, _ := metadata["engine"].(map[string]interface{})
+	version, _ := engine["version"].(string)
+	if version == "" {
+		return nil
+	}
+	return &MaintenanceInfo{Version: version, Description: "MongoDB " + version}
+}
+
+type maintenanceInfoKey struct{}
+
+// withMaintenanceInfo reads the maintenance_info of an update, the osb library
+// drops it, and passes it on in the requests context.
+func withMaintenanceInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && requestAPIVersion(r).AtLeast(apiVersion2_15) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				HttpWriteError(w, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var request struct {
+				MaintenanceInfo *MaintenanceInfo `json:"maintenance_info"`
+			}
+			if json.Unmarshal(body, &request) == nil && request.MaintenanceInfo != nil {
+				r = r.WithContext(context.WithValue(r.Context(), maintenanceInfoKey{}, request.MaintenanceInfo))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceInfoFromRequest is the maintenance_info of an update, if it had one.
+func maintenanceInfoFromRequest(c *broker.RequestContext) *MaintenanceInfo {
+	if c == nil || c.Request == nil {
+		return nil
+	}
+	info, _ := c.Request.Context().Value(maintenanceInfoKey{}).(*MaintenanceInfo)
+	return info
+}
+
+// withAsyncAccepted answers 202 Accepted for binds and unbinds that will finish
+// asynchronously, the osb library always answers 200 or 201.
+func withAsyncAccepted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(writer, r)
+		var response struct {
+			Async bool `json:"async"`
+		}
+		if (writer.status == http.StatusOK || writer.status == http.StatusCreated) && json.Unmarshal(writer.body.Bytes(), &response) == nil && response.Async {
+			writer.status = http.StatusAccepted
+		}
+		w.WriteHeader(writer.status)
+		w.Write(writer.body.Bytes())
+	})
+}
+
+func (b *BusinessLogic) lastOperationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := b.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+		HttpWriteError(w, PreconditionFailedWithMessage(err.Error()))
+		return
+	}
+	resp, err := b.GetLastOperation(mux.Vars(r)["instance_id"], r.URL.Query().Get("operation"))
+	if err != nil {
+		HttpWriteError(w, err)
+		return
+	}
+	if !requestAPIVersion(r).AtLeast(apiVersion2_15) {
+		resp.InstanceUsable = nil
+		resp.UpdateRepeatable = nil
+	}
+	HttpWrite(w, 200, resp)
+}
+
+// These are hacks to support more of V2.14 such as get service instance and get service bindings,
+// along with read-only endpoints that are not part of the OSB spec such as an instances task history.
 func CrudeOSBIHacks(router *mux.Router, b *BusinessLogic) {
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		if path == "/v2/catalog" {
+			route.Handler(withCatalogExtensions(route.GetHandler()))
+		} else if path == "/v2/service_instances/{instance_id}" && len(methods) == 1 && methods[0] == "PATCH" {
+			route.Handler(withMaintenanceInfo(route.GetHandler()))
+		} else if path == "/v2/service_instances/{instance_id}/service_bindings/{binding_id}" && len(methods) == 1 && (methods[0] == "PUT" || methods[0] == "DELETE") {
+			route.Handler(withAsyncAccepted(route.GetHandler()))
+		} else if path == "/v2/service_instances/{instance_id}/last_operation" {
+			// The osb library never reads the operation query parameter and cannot
+			// send instance_usable or update_repeatable.
+			route.HandlerFunc(b.lastOperationHandler)
+		}
+		return nil
+	})
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := requireAPIVersion(r, apiVersion2_14, "Fetching a service instance"); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		vars := mux.Vars(r)
+		resp, err := b.GetInstance(vars["instance_id"])
+		if err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
 	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := requireAPIVersion(r, apiVersion2_14, "Fetching a service binding"); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
 		vars := mux.Vars(r)
 		req := osb.GetBindingRequest{InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
 		c := broker.RequestContext{Request: r, Writer: w}
 		resp, err := b.GetBinding(&req, &c)
 		if err != nil {
-			type e struct {
-				ErrorMessage *string `json:"error,omitempty"`
-				Description  *string `json:"description,omitempty"`
-			}
-			if httpErr, ok := osb.IsHTTPError(err); ok {
-				body := &e{}
-				if httpErr.Description != nil {
-					body.Description = httpErr.Description
-				}
-				if httpErr.ErrorMessage != nil {
-					body.ErrorMessage = httpErr.ErrorMessage
-				}
-				HttpWrite(w, httpErr.StatusCode, body)
-				return
-			} else {
-				msg := "InternalServerError"
-				description := "Internal Server Error"
-				body := &e{ErrorMessage: &msg, Description: &description}
-				HttpWrite(w, 500, body)
-				return
-			}
+			HttpWriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", func(w http.ResponseWriter, r *http.Request) {
+		if err := requireAPIVersion(r, apiVersion2_14, "Polling the last operation of a service binding"); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		vars := mux.Vars(r)
+		req := osb.BindingLastOperationRequest{InstanceID: vars["instance_id"], BindingID: vars["binding_id"]}
+		if operation := r.URL.Query().Get("operation"); operation != "" {
+			key := osb.OperationKey(operation)
+			req.OperationKey = &key
+		}
+		resp, err := b.BindingLastOperation(&req)
+		if err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.roles.Authorize(r, ReadPermission); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		vars := mux.Vars(r)
+		resp, err := b.GetTasks(vars["instance_id"])
+		if err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		HttpWrite(w, 200, resp)
+	}).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.roles.Authorize(r, ReadPermission); err != nil {
+			HttpWriteError(w, err)
+			return
+		}
+		vars := mux.Vars(r)
+		resp, err := b.GetWebhookDeliveries(vars["instance_id"])
+		if err != nil {
+			HttpWriteError(w, err)
+			return
 		}
 		HttpWrite(w, 200, resp)
 	}).Methods("GET")
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCrudeOSBIHacks(t *testing.T) {
+	Convey("Given the routes of the osb library with the hacks applied", t, func() {
+		var body string
+		router := mux.NewRouter()
+		router.HandleFunc("/v2/catalog", func(w http.ResponseWriter, r *http.Request) {
+			HttpWrite(w, http.StatusOK, map[string]interface{}{"services": []interface{}{map[string]interface{}{"id": "s1", "plans": []interface{}{
+				map[string]interface{}{"id": "p1", "metadata": map[string]interface{}{"engine": map[string]interface{}{"version": "4.0.3"}}},
+			}}}})
+		}).Methods("GET")
+		router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(body))
+		}).Methods("PUT")
+		CrudeOSBIHacks(router, &BusinessLogic{})
+		request := func(method string, target string, version string) *http.Request {
+			r := httptest.NewRequest(method, target, nil)
+			r.Header.Set("X-Broker-API-Version", version)
+			return r
+		}
+
+		Convey("The catalog advertises that instances are retrievable and the maintenance info of plans", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request("GET", "/v2/catalog", "2.15"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, `{"services":[{"id":"s1","instances_retrievable":true,"plans":[{"id":"p1","maintenance_info":{"version":"4.0.3","description":"MongoDB 4.0.3"},"metadata":{"engine":{"version":"4.0.3"}}}]}]}`)
+		})
+
+		Convey("The catalog of older broker api versions has neither", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request("GET", "/v2/catalog", "2.13"))
+			So(w.Body.String(), ShouldEqual, `{"services":[{"id":"s1","plans":[{"id":"p1","metadata":{"engine":{"version":"4.0.3"}}}]}]}`)
+		})
+
+		Convey("Fetching an instance needs broker api 2.14", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request("GET", "/v2/service_instances/i1", "2.13"))
+			So(w.Code, ShouldEqual, http.StatusPreconditionFailed)
+		})
+
+		Convey("An asynchronous bind is answered with 202 Accepted", func() {
+			body = `{"async":true,"operation":"t1"}`
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request("PUT", "/v2/service_instances/i1/service_bindings/b1?accepts_incomplete=true", "2.14"))
+			So(w.Code, ShouldEqual, http.StatusAccepted)
+			So(w.Body.String(), ShouldEqual, body)
+		})
+
+		Convey("A synchronous bind keeps its status", func() {
+			body = `{"async":false,"credentials":{}}`
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request("PUT", "/v2/service_instances/i1/service_bindings/b1", "2.14"))
+			So(w.Code, ShouldEqual, http.StatusCreated)
+		})
+	})
+}
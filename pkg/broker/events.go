@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Lifecycle events are written to an outbox table in the same transaction as the
+// change to the resource or task they describe, and then delivered to the event
+// sink as CloudEvents by the background tasks process. Events are delivered at
+// least once and not necessarily in order, consumers should use the event id to
+// drop duplicates and the time to order them.
+const (
+	ProvisionRequestedEvent    = "com.akkeris.mongodb.provision.requested"
+	ProvisionCompletedEvent    = "com.akkeris.mongodb.provision.completed"
+	BindEvent                  = "com.akkeris.mongodb.bind"
+	UnbindEvent                = "com.akkeris.mongodb.unbind"
+	PlanChangeRequestedEvent   = "com.akkeris.mongodb.plan-change.requested"
+	PlanChangeCompletedEvent   = "com.akkeris.mongodb.plan-change.completed"
+	DeprovisionRequestedEvent  = "com.akkeris.mongodb.deprovision.requested"
+	DeprovisionCompletedEvent  = "com.akkeris.mongodb.deprovision.completed"
+	MaintenanceRequestedEvent  = "com.akkeris.mongodb.maintenance.requested"
+	MaintenanceCompletedEvent  = "com.akkeris.mongodb.maintenance.completed"
+	UpdateRequestedEvent       = "com.akkeris.mongodb.update.requested"
+	UpdateCompletedEvent       = "com.akkeris.mongodb.update.completed"
+	TaskFailedEvent            = "com.akkeris.mongodb.task.failed"
+	QuotaWarningEvent          = "com.akkeris.mongodb.quota.warning"
+	QuotaExceededEvent         = "com.akkeris.mongodb.quota.exceeded"
+	QuotaRestoredEvent         = "com.akkeris.mongodb.quota.restored"
+	DefaultEventSource         = "/mongodb-broker"
+	CloudEventsSpecVersion     = "1.0"
+	CloudEventsJSONContentType = "application/cloudevents+json"
+)
+
+// LifecycleEvent is an event waiting in (or delivered from) the outbox, the
+// subject is the instance id and data is a json object.
+type LifecycleEvent struct {
+	Id       string
+	Type     string
+	Subject  string
+	Data     string
+	Attempts int64
+	Created  time.Time
+}
+
+// CloudEvent is the structured (json) form of a CloudEvents 1.0 event.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+func (e LifecycleEvent) CloudEvent(source string) CloudEvent {
+	data := json.RawMessage(e.Data)
+	if !json.Valid(data) {
+		data = json.RawMessage("{}")
+	}
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		Id:              e.Id,
+		Source:          source,
+		Type:            e.Type,
+		Subject:         e.Subject,
+		Time:            e.Created,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// taskRequestedEvent is the event recorded when a task of this action is queued.
+func taskRequestedEvent(action TaskAction) (string, bool) {
+	switch action {
+	case DeleteTask:
+		return DeprovisionRequestedEvent, true
+	case ChangePlansTask, ChangeProvidersTask:
+		return PlanChangeRequestedEvent, true
+	case MaintenanceTask:
+		return MaintenanceRequestedEvent, true
+	case UpdateParametersTask:
+		return UpdateRequestedEvent, true
+	}
+	return "", false
+}
+
+// taskOutcomeEvent is the event recorded when a task of this action reaches a
+// final status, a finished delete records its event when the instance is deleted.
+func taskOutcomeEvent(action TaskAction, status string) (string, bool) {
+	if status == "failed" {
+		return TaskFailedEvent, true
+	}
+	if status != "finished" {
+		return "", false
+	}
+	switch action {
+	case PerformPostProvisionTask:
+		return ProvisionCompletedEvent, true
+	case ChangePlansTask, ChangeProvidersTask:
+		return PlanChangeCompletedEvent, true
+	case MaintenanceTask:
+		return MaintenanceCompletedEvent, true
+	case UpdateParametersTask:
+		return UpdateCompletedEvent, true
+	case CreateBindingTask:
+		return BindEvent, true
+	case DeleteBindingTask:
+		return UnbindEvent, true
+	}
+	return "", false
+}
+
+// EventSink is where lifecycle events are delivered to.
+type EventSink struct {
+	Url    string
+	Source string
+}
+
+func eventSinkFromOptions(o Options) EventSink {
+	if o.EventSink == "" && os.Getenv("EVENT_SINK_URL") != "" {
+		o.EventSink = os.Getenv("EVENT_SINK_URL")
+	}
+	if o.EventSource == "" && os.Getenv("EVENT_SOURCE") != "" {
+		o.EventSource = os.Getenv("EVENT_SOURCE")
+	}
+	if o.EventSource == "" {
+		o.EventSource = DefaultEventSource
+	}
+	return EventSink{Url: o.EventSink, Source: o.EventSource}
+}
+
+// maxEventsPerDelivery is how many events are taken from the outbox at a time,
+// eventLease is how long they are hidden from other workers while being sent.
+const (
+	maxEventsPerDelivery = 50
+	eventLease           = time.Minute * 5
+)
+
+var eventBackoff = ExponentialBackoff{Initial: time.Second * 10, Max: time.Hour, Jitter: 0.2}
+
+// PostEvent sends a single event to the sink, it is signed the same way as
+// webhooks with the secrets in WEBHOOK_SECRETS (if there are any).
+func (s EventSink) PostEvent(ctx context.Context, event LifecycleEvent) error {
+	byteData, err := json.Marshal(event.CloudEvent(s.Source))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Url, bytes.NewReader(byteData))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if secrets := ParseWebhookSecrets(os.Getenv("WEBHOOK_SECRETS")); len(secrets) > 0 {
+		for name, values := range SignWebhook(secrets, event.Id, time.Now(), byteData) {
+			req.Header[name] = values
+		}
+	}
+	req.Header.Set("content-type", CloudEventsJSONContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("Got invalid http status code from event sink: " + resp.Status)
+	}
+	return nil
+}
+
+// DeliverPendingEvents sends the events that are due from the outbox, events that
+// could not be delivered are tried again later, they are never given up on.
+func (s EventSink) DeliverPendingEvents(ctx context.Context, storage Storage) (int, error) {
+	events, err := storage.PopPendingEvents(maxEventsPerDelivery, eventLease)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, event := range events {
+		if err := s.PostEvent(ctx, event); err != nil {
+			logger.Errorf("Unable to deliver event %s (%s) after %d attempts: %s\n", event.Id, event.Type, event.Attempts, err.Error())
+			if err = storage.RescheduleEvent(event.Id, eventBackoff.Delay(event.Attempts), err.Error()); err != nil {
+				logger.Errorf("Unable to reschedule event %s: %s\n", event.Id, err.Error())
+			}
+			continue
+		}
+		if err := storage.MarkEventDelivered(event.Id); err != nil {
+			logger.Errorf("Unable to mark event %s as delivered: %s\n", event.Id, err.Error())
+			continue
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// eventRetention is how long events are kept in the outbox, delivered or not if
+// there is no sink to deliver them to.
+const eventRetention = time.Hour * 24 * 7
+
+// RunEventPruning removes old events from the outbox every hour until the context
+// is done.
+func RunEventPruning(ctx context.Context, sink EventSink, storage Storage) {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		pruned, err := storage.PruneEvents(eventRetention, sink.Url == "")
+		if err != nil {
+			logger.Errorf("Pruning events failed: %s\n", err.Error())
+		} else if pruned > 0 {
+			logger.Infof("Pruned %d events older than %s from the outbox\n", pruned, eventRetention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunEventDelivery delivers events from the outbox until the context is done.
+func RunEventDelivery(ctx context.Context, sink EventSink, storage Storage) {
+	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for {
+			delivered, err := sink.DeliverPendingEvents(ctx, storage)
+			if err != nil {
+				logger.Errorf("Getting pending events failed: %s\n", err.Error())
+			}
+			if delivered < maxEventsPerDelivery {
+				break
+			}
+		}
+	}
+}
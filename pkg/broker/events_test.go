@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeEventStorage struct {
+	Storage
+	pending     []LifecycleEvent
+	delivered   []string
+	rescheduled []string
+	pruned      []bool
+}
+
+func (s *fakeEventStorage) PopPendingEvents(limit int, lease time.Duration) ([]LifecycleEvent, error) {
+	events := s.pending
+	s.pending = nil
+	return events, nil
+}
+
+func (s *fakeEventStorage) MarkEventDelivered(Id string) error {
+	s.delivered = append(s.delivered, Id)
+	return nil
+}
+
+func (s *fakeEventStorage) RescheduleEvent(Id string, delay time.Duration, lastError string) error {
+	s.rescheduled = append(s.rescheduled, Id)
+	return nil
+}
+
+func (s *fakeEventStorage) PruneEvents(retention time.Duration, undelivered bool) (int64, error) {
+	s.pruned = append(s.pruned, undelivered)
+	return 1, nil
+}
+
+func TestDeliverPendingEvents(t *testing.T) {
+	Convey("Given an event sink and pending events", t, func() {
+		var received []CloudEvent
+		var contentType string
+		status := http.StatusAccepted
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event CloudEvent
+			json.NewDecoder(r.Body).Decode(&event)
+			received = append(received, event)
+			contentType = r.Header.Get("content-type")
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+		sink := EventSink{Url: server.URL, Source: "/test"}
+		storage := &fakeEventStorage{pending: []LifecycleEvent{
+			{Id: "e1", Type: BindEvent, Subject: "i1", Data: `{"binding_id":"b1"}`, Created: time.Now()},
+		}}
+
+		Convey("A delivered event is sent as a structured CloudEvent and marked delivered", func() {
+			delivered, err := sink.DeliverPendingEvents(context.TODO(), storage)
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 1)
+			So(storage.delivered, ShouldResemble, []string{"e1"})
+			So(contentType, ShouldEqual, CloudEventsJSONContentType)
+			So(received[0].SpecVersion, ShouldEqual, "1.0")
+			So(received[0].Id, ShouldEqual, "e1")
+			So(received[0].Source, ShouldEqual, "/test")
+			So(received[0].Subject, ShouldEqual, "i1")
+			So(string(received[0].Data), ShouldEqual, `{"binding_id":"b1"}`)
+		})
+
+		Convey("An event the sink rejects is rescheduled", func() {
+			status = http.StatusInternalServerError
+			delivered, err := sink.DeliverPendingEvents(context.TODO(), storage)
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 0)
+			So(len(storage.delivered), ShouldEqual, 0)
+			So(storage.rescheduled, ShouldResemble, []string{"e1"})
+		})
+	})
+}
+
+func TestTaskEvents(t *testing.T) {
+	Convey("Maintenance and parameter updates are lifecycle events", t, func() {
+		event, _ := taskRequestedEvent(MaintenanceTask)
+		So(event, ShouldEqual, MaintenanceRequestedEvent)
+		event, _ = taskOutcomeEvent(MaintenanceTask, "finished")
+		So(event, ShouldEqual, MaintenanceCompletedEvent)
+		event, _ = taskRequestedEvent(UpdateParametersTask)
+		So(event, ShouldEqual, UpdateRequestedEvent)
+		event, _ = taskOutcomeEvent(UpdateParametersTask, "finished")
+		So(event, ShouldEqual, UpdateCompletedEvent)
+		event, _ = taskOutcomeEvent(UpdateParametersTask, "failed")
+		So(event, ShouldEqual, TaskFailedEvent)
+	})
+}
+
+func TestRunEventPruning(t *testing.T) {
+	Convey("Given an outbox", t, func() {
+		storage := &fakeEventStorage{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Convey("Only delivered events are pruned when there is a sink", func() {
+			RunEventPruning(ctx, EventSink{Url: "http://sink"}, storage)
+			So(storage.pruned, ShouldResemble, []bool{false})
+		})
+
+		Convey("Undelivered events are pruned as well without a sink", func() {
+			RunEventPruning(ctx, EventSink{}, storage)
+			So(storage.pruned, ShouldResemble, []bool{true})
+		})
+	})
+}
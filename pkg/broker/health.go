@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout is how long all the readiness checks together may take, a
+// dependency that has not answered by then is not ready.
+const readinessTimeout = time.Second * 5
+
+// DependencyStatus is the outcome of checking one dependency.
+type DependencyStatus struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// Readiness is whether the broker can serve requests, it is ready once every
+// dependency is.
+type Readiness struct {
+	Ready        bool               `json:"ready"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// ClusterPinger is implemented by providers that can check the cluster a plan
+// is on can be reached.
+type ClusterPinger interface {
+	Ping(*ProviderPlan, time.Duration) error
+}
+
+func checkDependency(name string, check func() error) DependencyStatus {
+	start := time.Now()
+	err := check()
+	status := DependencyStatus{Name: name, Ready: err == nil, Latency: time.Since(start).String()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func checkSchemaVersion(storage Storage) error {
+	version, err := storage.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("The database schema is at version %d, this broker needs %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// clusterChecks are the checks of each master cluster plans are on, plans on the
+// same cluster are only checked once.
+func clusterChecks(namePrefix string, storage Storage) ([]func() DependencyStatus, error) {
+	services, err := storage.GetServices()
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]func() DependencyStatus, 0)
+	seen := make(map[string]bool)
+	for _, service := range services {
+		plans, err := storage.GetPlans(service.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range plans {
+			plan := &plans[i]
+			provider, err := GetProviderByPlan(namePrefix, plan)
+			if err != nil {
+				return nil, err
+			}
+			provider = unwrapProvider(provider)
+			namer, namerOk := provider.(ClusterNamer)
+			pinger, pingerOk := provider.(ClusterPinger)
+			if !namerOk || !pingerOk {
+				continue
+			}
+			cluster := namer.Cluster(plan)
+			if seen[cluster] {
+				continue
+			}
+			seen[cluster] = true
+			checks = append(checks, func() DependencyStatus {
+				return checkDependency("cluster "+cluster, func() error {
+					return pinger.Ping(plan, readinessTimeout)
+				})
+			})
+		}
+	}
+	return checks, nil
+}
+
+// CheckReadiness checks the database, its schema and every master cluster plans
+// are on. The clusters are only checked once the database is known to be ready.
+func CheckReadiness(ctx context.Context, namePrefix string, storage Storage) Readiness {
+	readiness := Readiness{Ready: true, Dependencies: make([]DependencyStatus, 0)}
+	add := func(status DependencyStatus) {
+		readiness.Dependencies = append(readiness.Dependencies, status)
+		readiness.Ready = readiness.Ready && status.Ready
+	}
+	add(checkDependency("postgres", storage.Ping))
+	if !readiness.Ready {
+		return readiness
+	}
+	add(checkDependency("schema", func() error { return checkSchemaVersion(storage) }))
+
+	checks, err := clusterChecks(namePrefix, storage)
+	if err != nil {
+		add(DependencyStatus{Name: "plans", Error: err.Error()})
+		return readiness
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	statuses := make([]DependencyStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() DependencyStatus) {
+			defer wg.Done()
+			statuses[i] = check()
+		}(i, check)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		for _, status := range statuses {
+			add(status)
+		}
+	case <-ctx.Done():
+		add(DependencyStatus{Name: "clusters", Error: "The clusters did not answer within " + readinessTimeout.String(), Latency: readinessTimeout.String()})
+	}
+	return readiness
+}
+
+// ReadinessHandler answers 200 when the broker is ready and 503 when it is not,
+// both with the status of each dependency.
+func ReadinessHandler(namePrefix string, storage Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := CheckReadiness(r.Context(), namePrefix, storage)
+		if !readiness.Ready {
+			logger.Infof("The broker is not ready: %+v\n", readiness.Dependencies)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if readiness.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
+
+// LivenessHandler answers as long as the process can serve requests, it does not
+// check dependencies so an outage of one does not get the broker restarted.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// RouteHealthEndpoints adds /readyz to the API, the broker library already
+// serves /healthz.
+func RouteHealthEndpoints(router *mux.Router, b *BusinessLogic) {
+	router.HandleFunc("/readyz", ReadinessHandler(b.namePrefix, b.storage)).Methods("GET")
+}
+
+// ServeWorkerEndpoints serves /metrics, /healthz and /readyz for the worker until
+// the context is done.
+func ServeWorkerEndpoints(ctx context.Context, addr string, namePrefix string, storage Storage) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := RegisterMetrics(reg, storage); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(reg))
+	mux.HandleFunc("/healthz", LivenessHandler)
+	mux.Handle("/readyz", ReadinessHandler(namePrefix, storage))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Infof("Serving metrics and health checks on %s\n", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
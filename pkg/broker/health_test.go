@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeHealthStorage struct {
+	Storage
+	pingErr       error
+	schemaVersion int
+}
+
+func (s fakeHealthStorage) Ping() error {
+	return s.pingErr
+}
+
+func (s fakeHealthStorage) GetSchemaVersion() (int, error) {
+	return s.schemaVersion, nil
+}
+
+func (s fakeHealthStorage) GetServices() ([]osb.Service, error) {
+	return []osb.Service{}, nil
+}
+
+func readiness(storage Storage) (int, Readiness) {
+	recorder := httptest.NewRecorder()
+	ReadinessHandler("test", storage).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	var readiness Readiness
+	json.NewDecoder(recorder.Body).Decode(&readiness)
+	return recorder.Code, readiness
+}
+
+func TestReadiness(t *testing.T) {
+	Convey("Given the readiness endpoint", t, func() {
+		Convey("It is ready when the database is reachable and its schema is current", func() {
+			code, readiness := readiness(fakeHealthStorage{schemaVersion: SchemaVersion})
+			So(code, ShouldEqual, http.StatusOK)
+			So(readiness.Ready, ShouldBeTrue)
+			So(len(readiness.Dependencies), ShouldEqual, 2)
+			So(readiness.Dependencies[0].Name, ShouldEqual, "postgres")
+			So(readiness.Dependencies[1].Name, ShouldEqual, "schema")
+		})
+
+		Convey("It is not ready when the database cannot be reached", func() {
+			code, readiness := readiness(fakeHealthStorage{pingErr: errors.New("connection refused")})
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+			So(readiness.Ready, ShouldBeFalse)
+			So(readiness.Dependencies, ShouldHaveLength, 1)
+			So(readiness.Dependencies[0].Error, ShouldEqual, "connection refused")
+		})
+
+		Convey("It is not ready when the schema is behind", func() {
+			code, readiness := readiness(fakeHealthStorage{schemaVersion: SchemaVersion - 1})
+			So(code, ShouldEqual, http.StatusServiceUnavailable)
+			So(readiness.Dependencies[1].Ready, ShouldBeFalse)
+		})
+	})
+
+	Convey("Given the liveness endpoint it answers without checking dependencies", t, func() {
+		recorder := httptest.NewRecorder()
+		LivenessHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+	})
+}
@@ -22,6 +22,14 @@ type Instance struct {
 	Engine        string        `json:"engine"`
 	EngineVersion string        `json:"engine_version"`
 	Scheme        string        `json:"scheme"`
+
+	// Parameters are the ones given when the instance was provisioned, these are
+	// the platforms and are never sent in callbacks.
+	Parameters map[string]interface{} `json:"-"`
+
+	// Owner is the organization the instance was provisioned for, it is only set
+	// when provisioning.
+	Owner string `json:"-"`
 }
 
 type Entry struct {
@@ -34,6 +42,18 @@ type Entry struct {
 	Username string
 	Password string
 	Endpoint string
+
+	// Parameters is the json of the provision parameters.
+	Parameters string
+
+	// MaintenanceVersion is the maintenance version of the plan the instance is on.
+	MaintenanceVersion string
+
+	// QuotaState is where the instance is against the storage quota of its plan.
+	QuotaState QuotaState
+
+	// Owner is the organization the instance was provisioned (or claimed) for.
+	Owner string
 }
 
 func (i *Instance) Match(other *Instance) bool {
@@ -0,0 +1,304 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIdHeader is the header of the OSB api that identifies a request, the
+// broker makes one up when the platform does not send it.
+const RequestIdHeader = "X-Broker-API-Request-Identity"
+
+const (
+	TextLogFormat = "text"
+	JSONLogFormat = "json"
+)
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes log lines with fields that tie them to the request, task,
+// instance, plan and cluster they are about. The fields are appended to the
+// message as key=value pairs through glog, or written as a json object per line
+// when the log format is json.
+type Logger struct {
+	fields []logField
+}
+
+// logger has no fields, it is used where there is nothing to correlate with.
+var logger Logger
+
+var logOutput = struct {
+	sync.Mutex
+	json   bool
+	writer io.Writer
+}{writer: os.Stderr}
+
+// configureLogging sets the log format from -log-format or LOG_FORMAT.
+func configureLogging(o Options) error {
+	if o.LogFormat == "" {
+		o.LogFormat = os.Getenv("LOG_FORMAT")
+	}
+	switch strings.ToLower(o.LogFormat) {
+	case "", TextLogFormat:
+		setLogFormat(false, os.Stderr)
+	case JSONLogFormat:
+		setLogFormat(true, os.Stderr)
+	default:
+		return errors.New("The log format " + o.LogFormat + " is not supported, use text or json")
+	}
+	return nil
+}
+
+func setLogFormat(json bool, writer io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.json = json
+	logOutput.writer = writer
+}
+
+// With returns a logger that adds the field to every line, a field that is
+// already set is replaced and empty values are left out.
+func (l Logger) With(key string, value interface{}) Logger {
+	if value == nil || value == "" {
+		return l
+	}
+	fields := make([]logField, 0, len(l.fields)+1)
+	for _, field := range l.fields {
+		if field.key != key {
+			fields = append(fields, field)
+		}
+	}
+	return Logger{fields: append(fields, logField{key: key, value: value})}
+}
+
+// Field is the value of a field set with With.
+func (l Logger) Field(key string) interface{} {
+	for _, field := range l.fields {
+		if field.key == key {
+			return field.value
+		}
+	}
+	return nil
+}
+
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.output("info", fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Infoln(args ...interface{}) {
+	l.output("info", fmt.Sprintln(args...))
+}
+
+func (l Logger) Info(args ...interface{}) {
+	l.output("info", fmt.Sprint(args...))
+}
+
+func (l Logger) Warningf(format string, args ...interface{}) {
+	l.output("warning", fmt.Sprintf(format, args...))
+}
+
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.output("error", fmt.Sprintf(format, args...))
+}
+
+// Verbose logs only if glog's -v is at least its level, as glog.Verbose does.
+type Verbose struct {
+	log     Logger
+	enabled bool
+}
+
+func (l Logger) V(level glog.Level) Verbose {
+	return Verbose{log: l, enabled: bool(glog.V(level))}
+}
+
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v.enabled {
+		v.log.output("info", fmt.Sprintf(format, args...))
+	}
+}
+
+func (v Verbose) Infoln(args ...interface{}) {
+	if v.enabled {
+		v.log.output("info", fmt.Sprintln(args...))
+	}
+}
+
+func (v Verbose) Info(args ...interface{}) {
+	if v.enabled {
+		v.log.output("info", fmt.Sprint(args...))
+	}
+}
+
+// logDepth is how far output is from the caller of Infof and friends.
+const logDepth = 2
+
+// splitScope takes the [b.Provision] style prefix off a message.
+func splitScope(msg string) (string, string) {
+	if strings.HasPrefix(msg, "[") {
+		if end := strings.Index(msg, "]"); end > 0 && !strings.ContainsAny(msg[1:end], " ") {
+			return msg[1:end], strings.TrimSpace(msg[end+1:])
+		}
+	}
+	return "", msg
+}
+
+func (l Logger) output(level string, msg string) {
+	msg = strings.TrimSpace(msg)
+	logOutput.Lock()
+	asJSON, writer := logOutput.json, logOutput.writer
+	logOutput.Unlock()
+	if !asJSON {
+		for _, field := range l.fields {
+			msg += fmt.Sprintf(" %s=%v", field.key, field.value)
+		}
+		switch level {
+		case "error":
+			glog.ErrorDepth(logDepth, msg)
+		case "warning":
+			glog.WarningDepth(logDepth, msg)
+		default:
+			glog.InfoDepth(logDepth, msg)
+		}
+		return
+	}
+	scope, msg := splitScope(msg)
+	line := encodeLogLine(level, scope, msg, l.fields)
+	logOutput.Lock()
+	writer.Write(line)
+	logOutput.Unlock()
+}
+
+// encodeLogLine writes the fields in the order they were added after the time,
+// level, message and caller, a map would sort them.
+func encodeLogLine(level string, scope string, msg string, fields []logField) []byte {
+	var b strings.Builder
+	add := func(key string, value interface{}) {
+		byteKey, _ := json.Marshal(key)
+		byteValue, err := json.Marshal(value)
+		if err != nil {
+			byteValue, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if b.Len() > 0 {
+			b.WriteString(",")
+		}
+		b.Write(byteKey)
+		b.WriteString(":")
+		b.Write(byteValue)
+	}
+	add("time", time.Now().UTC().Format(time.RFC3339Nano))
+	add("level", level)
+	add("msg", msg)
+	if _, file, line, ok := runtime.Caller(logDepth + 1); ok {
+		add("caller", fmt.Sprintf("%s:%d", filepath.Base(file), line))
+	}
+	if scope != "" {
+		add("scope", scope)
+	}
+	for _, field := range fields {
+		add(field.key, field.value)
+	}
+	return []byte("{" + b.String() + "}\n")
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, log Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// LoggerFrom is the logger of the request or task the context belongs to.
+func LoggerFrom(ctx context.Context) Logger {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerKey{}).(Logger); ok {
+			return log
+		}
+	}
+	return logger
+}
+
+func requestLogger(c *broker.RequestContext) Logger {
+	return LoggerFrom(requestContext(c))
+}
+
+// RequestId is the id of the request a logger is for, it is empty outside of
+// requests and the tasks they queued.
+func (l Logger) RequestId() string {
+	id, _ := l.Field("request_id").(string)
+	return id
+}
+
+// instanceLogger adds the instance, its plan and the cluster it is on.
+func instanceLogger(log Logger, instance *Instance) Logger {
+	if instance == nil {
+		return log
+	}
+	return planLogger(log.With("instance_id", instance.Id), instance.Plan)
+}
+
+func planLogger(log Logger, plan *ProviderPlan) Logger {
+	if plan == nil {
+		return log
+	}
+	provider, _ := GetProviderByPlan("", plan)
+	planName, cluster := planLabels(provider, plan)
+	return log.With("plan", planName).With("cluster", cluster)
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return RandomString(32)
+	}
+	return hex.EncodeToString(b)
+}
+
+// RequestLogMiddleware gives every request an id (the one the platform sent in
+// X-Broker-API-Request-Identity or X-Request-Id if it did), returns it in the
+// response and logs the request once it is done. Handlers get a logger with the
+// request id and instance id through the context of the request, tasks they
+// queue carry the request id on to the worker.
+func (b *BusinessLogic) RequestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if id == "" {
+			id = r.Header.Get("X-Request-Id")
+		}
+		if id == "" {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		v := mux.Vars(r)
+		log := logger.With("request_id", id).With("instance_id", v["instance_id"]).With("binding_id", v["binding_id"])
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			log = log.With("trace_id", sc.TraceID().String())
+		}
+
+		start := time.Now()
+		lw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(withLogger(r.Context(), log)))
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		log.With("method", r.Method).With("path", r.URL.Path).With("status", lw.status).With("latency", time.Since(start).String()).Infof("%s %s %d\n", r.Method, r.URL.Path, lw.status)
+	})
+}
@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogging(t *testing.T) {
+	Convey("Given json logging", t, func() {
+		var out bytes.Buffer
+		setLogFormat(true, &out)
+		defer setLogFormat(false, os.Stderr)
+
+		log := logger.With("request_id", "r1").With("task_id", "t1").With("plan", "")
+		log.Errorf("[b.Provision] Unable to provision %s\n", "db")
+
+		var line map[string]interface{}
+		So(json.Unmarshal(out.Bytes(), &line), ShouldBeNil)
+		So(line["level"], ShouldEqual, "error")
+		So(line["msg"], ShouldEqual, "Unable to provision db")
+		So(line["scope"], ShouldEqual, "b.Provision")
+		So(line["caller"], ShouldStartWith, "logging_test.go:")
+		So(line["request_id"], ShouldEqual, "r1")
+		So(line["task_id"], ShouldEqual, "t1")
+		So(line, ShouldNotContainKey, "plan")
+		So(strings.Index(out.String(), "request_id"), ShouldBeLessThan, strings.Index(out.String(), "task_id"))
+
+		Convey("Setting a field again replaces it", func() {
+			So(log.With("request_id", "r2").RequestId(), ShouldEqual, "r2")
+			So(log.RequestId(), ShouldEqual, "r1")
+		})
+	})
+
+	Convey("Given an unknown log format", t, func() {
+		So(configureLogging(Options{LogFormat: "xml"}), ShouldNotBeNil)
+		So(configureLogging(Options{LogFormat: "JSON"}), ShouldBeNil)
+		So(configureLogging(Options{}), ShouldBeNil)
+	})
+}
+
+func TestRequestLogMiddleware(t *testing.T) {
+	Convey("Given a request to an instance", t, func() {
+		var log Logger
+		router := mux.NewRouter()
+		router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+			log = LoggerFrom(r.Context())
+		})
+		b := &BusinessLogic{}
+		router.Use(b.RequestLogMiddleware)
+
+		Convey("The request id of the platform is used", func() {
+			r := httptest.NewRequest("PUT", "/v2/service_instances/i1", nil)
+			r.Header.Set(RequestIdHeader, "r1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Header().Get(RequestIdHeader), ShouldEqual, "r1")
+			So(log.RequestId(), ShouldEqual, "r1")
+			So(log.Field("instance_id"), ShouldEqual, "i1")
+		})
+
+		Convey("One is made up if the platform did not send one", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/i1", nil))
+			So(log.RequestId(), ShouldHaveLength, 32)
+			So(w.Header().Get(RequestIdHeader), ShouldEqual, log.RequestId())
+		})
+	})
+}
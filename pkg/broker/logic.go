@@ -3,36 +3,56 @@ package broker
 import (
 	"context"
 	"encoding/json"
-	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"os"
 	"strings"
 )
 
 type BusinessLogic struct {
 	ActionBase
-	storage    Storage
-	namePrefix string
+	storage     Storage
+	namePrefix  string
+	credentials *Credentials
 }
 
 func NewBusinessLogic(ctx context.Context, o Options) (*BusinessLogic, error) {
-	glog.V(3).Infoln("[b.NewBusinessLogic] start")
+	logger.V(3).Infoln("[b.NewBusinessLogic] start")
 	storage, namePrefix, err := InitFromOptions(ctx, o)
 	if err != nil {
 		return nil, err
 	}
+	if err = initTracing(ctx, o, "mongodb-broker"); err != nil {
+		return nil, err
+	}
 
-	bl := BusinessLogic{
-		storage:    storage,
-		namePrefix: namePrefix,
+	credentials, err := credentialsFromOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := roleBindingsFromOptions(o)
+	if err != nil {
+		return nil, err
 	}
+
+	bl := BusinessLogic{
+		storage:     storage,
+		namePrefix:  namePrefix,
+		credentials: credentials,
+	}
+	bl.roles = roles
+	bl.AddActions("tasks", "tasks", "GET", ReadPermission, bl.ActionGetTasks)
+	bl.AddActions("webhooks", "webhooks", "GET", ReadPermission, bl.ActionGetWebhookDeliveries)
+	bl.AddActions("redeliver-webhook", "webhooks/{event_id}/redeliver", "POST", RedeliverWebhooksPermission, bl.ActionRedeliverWebhook)
 	return &bl, nil
 }
 
 func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogResponse, error) {
-	glog.V(3).Infoln("[b.GetCatalog] start")
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
+	log.V(3).Infoln("[b.GetCatalog] start")
 	response := &broker.CatalogResponse{}
-	services, err := b.storage.GetServices()
+	services, err := storage.GetServices()
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +62,7 @@ func (b *BusinessLogic) GetCatalog(c *broker.RequestContext) (*broker.CatalogRes
 }
 
 func GetInstanceById(namePrefix string, storage Storage, Id string) (*Instance, error) {
-	glog.V(4).Infof("[GetInstanceById]: start Id: %s\n", Id)
+	logger.V(4).Infof("[GetInstanceById]: start Id: %s\n", Id)
 	entry, err := storage.GetInstance(Id)
 	if err != nil {
 		return nil, err
@@ -52,6 +72,7 @@ func GetInstanceById(namePrefix string, storage Storage, Id string) (*Instance,
 	if err != nil {
 		return nil, err
 	}
+	plan = plan.atMaintenanceVersion(entry.MaintenanceVersion)
 
 	provider, err := GetProviderByPlan(namePrefix, plan)
 	if err != nil {
@@ -74,18 +95,23 @@ func GetInstanceById(namePrefix string, storage Storage, Id string) (*Instance,
 		Instance.Endpoint = entry.Endpoint
 	}
 	Instance.Plan = plan
+	if entry.Parameters != "" {
+		if err = json.Unmarshal([]byte(entry.Parameters), &Instance.Parameters); err != nil {
+			logger.Errorf("Unable to unmarshal the parameters of %s: %s\n", Id, err.Error())
+		}
+	}
 
 	return Instance, nil
 }
 
 func (b *BusinessLogic) GetInstanceById(Id string) (*Instance, error) {
-	glog.V(4).Infof("[b.GetInstanceById]: start Id: %s\n", Id)
+	logger.V(4).Infof("[b.GetInstanceById]: start Id: %s\n", Id)
 
 	return GetInstanceById(b.namePrefix, b.storage, Id)
 }
 
 func (b *BusinessLogic) GetUnclaimedInstance(PlanId string, InstanceId string) (*Instance, error) {
-	glog.V(3).Infof("[b.GetUnclaimedInstance] start PlanID: %s, InstanceId: %s\n", PlanId, InstanceId)
+	logger.V(3).Infof("[b.GetUnclaimedInstance] start PlanID: %s, InstanceId: %s\n", PlanId, InstanceId)
 	Entry, err := b.storage.GetUnclaimedInstance(PlanId, InstanceId)
 	if err != nil {
 		return nil, err
@@ -100,15 +126,60 @@ func (b *BusinessLogic) GetUnclaimedInstance(PlanId string, InstanceId string) (
 	return Instance, nil
 }
 
+// This is a hack to support callbacks, hopefully this will become an OSB standard. A
+// callback is only made when both the webhook and secret query parameters are given,
+// key_id optionally names the secret so it can be rotated.
+func webhookFromRequest(c *broker.RequestContext) *WebhookTaskMetadata {
+	if c == nil || c.Request == nil || c.Request.URL == nil {
+		return nil
+	}
+	query := c.Request.URL.Query()
+	if query.Get("webhook") == "" || query.Get("secret") == "" {
+		return nil
+	}
+	return &WebhookTaskMetadata{Url: query.Get("webhook"), Secret: query.Get("secret"), KeyId: query.Get("key_id")}
+}
+
+// addTask queues a task for the request, the task is tagged with the id and span
+// of the request so the worker logs and traces it as part of the request.
+func (b *BusinessLogic) addTask(c *broker.RequestContext, Id string, action TaskAction, metadata string) (string, error) {
+	ctx := requestContext(c)
+	return traceStorage(ctx, b.storage).AddTaskForRequest(taskOrigin(ctx), Id, action, metadata, 0)
+}
+
+// getProvider is the provider of the plan, its calls are logged and traced with
+// the request.
+func (b *BusinessLogic) getProvider(c *broker.RequestContext, plan *ProviderPlan) (Provider, error) {
+	provider, err := GetProviderByPlan(b.namePrefix, plan)
+	if err != nil {
+		return nil, err
+	}
+	return withProviderContext(provider, requestContext(c)), nil
+}
+
+func (b *BusinessLogic) scheduleWebhook(c *broker.RequestContext, InstanceID string, action TaskAction, metadata interface{}) {
+	log := requestLogger(c)
+	byteData, err := json.Marshal(metadata)
+	if err != nil {
+		log.Errorf("Error: failed to marshal webhook task metadata: %s\n", err)
+		return
+	}
+	if _, err = b.addTask(c, InstanceID, action, string(byteData)); err != nil {
+		log.Errorf("Error: Unable to schedule webhook %s! (%s): %s\n", action, InstanceID, err.Error())
+	}
+}
+
 // A piece of advice, never try to make this syncronous by waiting for a to return a response. The problem is
 // that can take up to 10 minutes in my experience (depending on the provider), and aside from the API call timing
 // out the other issue is it can cause the mutex lock to make the entire API unresponsive.
 func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
 	b.Lock()
 	defer b.Unlock()
 	response := broker.ProvisionResponse{}
 
-	glog.V(3).Infoln("[b.Provision] start")
+	log.V(3).Infoln("[b.Provision] start")
 	if !request.AcceptsIncomplete {
 		return nil, UnprocessableEntityWithMessage("AsyncRequired", "The query parameter accepts_incomplete=true MUST be included the request.")
 	}
@@ -117,19 +188,22 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 	}
 
 	// Ensure we are not trying to provision a UUID that has ever been used before.
-	if err := b.storage.ValidateInstanceID(request.InstanceID); err != nil {
+	if err := storage.ValidateInstanceID(request.InstanceID); err != nil {
 		return nil, UnprocessableEntityWithMessage("InstanceInvalid", "The instance ID was either already in-use or invalid.")
 	}
 
-	plan, err := b.storage.GetPlanByID(request.PlanID)
+	plan, err := storage.GetPlanByID(request.PlanID)
 	if err != nil && err.Error() == "Not found" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Unable to provision (GetPlanByID failed): %s\n", err.Error())
+		log.Errorf("Unable to provision (GetPlanByID failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	log = planLogger(log, plan)
 
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
+	// operation is the task that finishes provisioning, if there is one.
+	operation := ""
 
 	if err == nil {
 		if Instance.Plan.ID != request.PlanID {
@@ -141,58 +215,66 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 		// Only check for preprovisioned instance if plan configured to preprovision
 		if plan.preprovision > 0 {
 			Instance, err = b.GetUnclaimedInstance(request.PlanID, request.InstanceID)
+			if err == nil {
+				Instance.Parameters = request.Parameters
+				if err = storage.UpdateInstanceParameters(Instance.Id, request.Parameters); err != nil {
+					log.Errorf("Unable to store the parameters of claimed instance %s: %s\n", Instance.Id, err.Error())
+					err = nil
+				}
+				if err = storage.SetInstanceOwner(Instance.Id, request.OrganizationGUID); err != nil {
+					log.Errorf("Unable to store the owner of claimed instance %s: %s\n", Instance.Id, err.Error())
+					err = nil
+				}
+			}
 		}
 		if err != nil && err.Error() == "Cannot find resource instance" {
 			// Create a new one
-			provider, err := GetProviderByPlan(b.namePrefix, plan)
+			provider, err := b.getProvider(c, plan)
 			if err != nil {
-				glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+				log.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 				return nil, InternalServerError()
 			}
 			Instance, err = provider.Provision(request.InstanceID, plan, request.OrganizationGUID)
 			if err != nil {
-				glog.Errorf("Error provisioning resource: %s\n", err.Error())
+				log.Errorf("Error provisioning resource: %s\n", err.Error())
 				return nil, InternalServerError()
 			}
+			Instance.Parameters = request.Parameters
+			Instance.Owner = request.OrganizationGUID
 
-			if err = b.storage.AddInstance(Instance); err != nil {
-				glog.Errorf("Error inserting record into provisioned table: %s\n", err.Error())
+			if err = storage.AddInstance(Instance); err != nil {
+				log.Errorf("Error inserting record into provisioned table: %s\n", err.Error())
 
 				if err = provider.Deprovision(Instance, false); err != nil {
-					glog.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Resource Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
-					if _, err = b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
-						glog.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
+					log.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Resource Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
+					if _, err = b.addTask(c, Instance.Id, DeleteTask, Instance.Name); err != nil {
+						log.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
 					}
 				}
 				return nil, InternalServerError()
 			}
 			if !IsAvailable(Instance.Status) {
-				if _, err = b.storage.AddTask(Instance.Id, PerformPostProvisionTask, ""); err != nil {
-					glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
+				if operation, err = b.addTask(c, Instance.Id, PerformPostProvisionTask, ""); err != nil {
+					log.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 				}
-				// This is a hack to support callbacks, hopefully this will become an OSB standard.
-				if c != nil && c.Request != nil && c.Request.URL != nil && c.Request.URL.Query().Get("webhook") != "" && c.Request.URL.Query().Get("secret") != "" {
-					// Schedule a callback
-					byteData, err := json.Marshal(WebhookTaskMetadata{Url: c.Request.URL.Query().Get("webhook"), Secret: c.Request.URL.Query().Get("secret")})
-					if err != nil {
-						glog.Errorf("Error: failed to marshal webhook task metadata: %s\n", err)
-					}
-					if _, err = b.storage.AddTask(Instance.Id, NotifyCreateServiceWebhookTask, string(byteData)); err != nil {
-						glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
-					}
+				if hook := webhookFromRequest(c); hook != nil {
+					b.scheduleWebhook(c, Instance.Id, NotifyCreateServiceWebhookTask, hook)
 				}
 			}
 		} else if err != nil {
-			glog.Errorf("Got fatal error from unclaimed instance endpoint: %s\n", err.Error())
+			log.Errorf("Got fatal error from unclaimed instance endpoint: %s\n", err.Error())
 			return nil, InternalServerError()
 		}
 	} else {
-		glog.Errorf("Unable to get instances: %s\n", err.Error())
+		log.Errorf("Unable to get instances: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
 	if request.AcceptsIncomplete && Instance.Ready == false {
-		opkey := osb.OperationKey(request.InstanceID)
+		if operation == "" {
+			operation = request.InstanceID
+		}
+		opkey := osb.OperationKey(operation)
 		response.Async = !Instance.Ready
 		response.OperationKey = &opkey
 	} else if request.AcceptsIncomplete && Instance.Ready == true {
@@ -200,46 +282,60 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *broker.Reque
 	}
 
 	response.ExtensionAPIs = b.ConvertActionsToExtensions(Instance.Id)
+	response.DashboardURL = DashboardURL(Instance.Id)
 
-	glog.V(3).Infoln("[b.Provision] end")
+	log.V(3).Infoln("[b.Provision] end")
 
 	return &response, nil
 }
 
 func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
 	b.Lock()
 	defer b.Unlock()
 
-	glog.V(3).Infoln("[b.Deprovision] start")
+	log.V(3).Infoln("[b.Deprovision] start")
 
 	response := broker.DeprovisionResponse{}
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Error finding instance id (during deprovision) from provisioned table: %s\n", err.Error())
+		log.Errorf("Error finding instance id (during deprovision) from provisioned table: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	log = instanceLogger(log, Instance)
+	if deletionProtected(Instance) {
+		return nil, UnprocessableEntityWithMessage("DeletionProtected", "The instance has deletion_protection set, update it to false before deprovisioning.")
+	}
 
-	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+	provider, err := b.getProvider(c, Instance.Plan)
 	if err != nil {
-		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		log.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
 	if err = provider.Deprovision(Instance, true); err != nil {
-		glog.Errorf("Error failed to deprovision: (Id: %s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
-		if _, err = b.storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
-			glog.Errorf("Error: Unable to schedule delete from provider! (%s): %s\n", Instance.Name, err.Error())
+		log.Errorf("Error failed to deprovision: (Id: %s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
+		byteData, err := json.Marshal(DeleteTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, Name: Instance.Name})
+		if err != nil {
+			log.Errorf("Unable to marshal delete task meta data: %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		if taskId, err := b.addTask(c, Instance.Id, DeleteTask, string(byteData)); err != nil {
+			log.Errorf("Error: Unable to schedule delete from provider! (%s): %s\n", Instance.Name, err.Error())
 			return nil, InternalServerError()
 		} else {
-			glog.Errorf("Successfully scheduled db to be removed.")
+			log.Errorf("Successfully scheduled db to be removed.")
+			opkey := osb.OperationKey(taskId)
 			response.Async = true
+			response.OperationKey = &opkey
 			return &response, nil
 		}
 	}
-	if err = b.storage.DeleteInstance(Instance); err != nil {
-		glog.Errorf("Error removing record from provisioned table: %s\n", err.Error())
+	if err = storage.DeleteInstance(Instance); err != nil {
+		log.Errorf("Error removing record from provisioned table: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 	response.Async = false
@@ -247,19 +343,23 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *broker.R
 }
 
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
-	glog.V(3).Infoln("[b.Update] start")
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
+	log.V(3).Infoln("[b.Update] start")
 	response := broker.UpdateInstanceResponse{}
 	if !request.AcceptsIncomplete {
 		return nil, UnprocessableEntity()
 	}
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Error finding instance id (during deprovision) from provisioned table: %s\n", err.Error())
+		log.Errorf("Error finding instance id (during deprovision) from provisioned table: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
-	if request.PlanID == nil {
+	log = instanceLogger(log, Instance)
+	maintenance := maintenanceInfoFromRequest(c)
+	if request.PlanID == nil && maintenance == nil && len(request.Parameters) == 0 {
 		return nil, UnprocessableEntity()
 	}
 
@@ -267,52 +367,200 @@ func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *broker.Req
 		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "Clients MUST wait until pending requests have completed for the specified resources.")
 	}
 
+	samePlan := request.PlanID == nil || strings.ToLower(*request.PlanID) == strings.ToLower(Instance.Plan.ID)
+	if maintenance != nil && maintenance.Version == Instance.Plan.MaintenanceVersion() && (len(request.Parameters) > 0 || !samePlan) {
+		// platforms send the maintenance_info the instance is already at along with other changes.
+		maintenance = nil
+	}
+
+	if len(request.Parameters) > 0 {
+		if !samePlan || maintenance != nil {
+			return nil, UnprocessableEntityWithMessage("UpdateError", "Parameters cannot be changed along with the plan or maintenance_info.")
+		}
+		return b.updateParameters(Instance, request.Parameters, c)
+	}
+
+	if maintenance != nil && samePlan {
+		return b.performMaintenance(Instance, maintenance, c)
+	}
+
 	if strings.ToLower(*request.PlanID) == strings.ToLower(Instance.Plan.ID) {
 		return nil, UnprocessableEntityWithMessage("UpgradeError", "Cannot upgrade to the same plan.")
 	}
 
-	target_plan, err := b.storage.GetPlanByID(*request.PlanID)
+	target_plan, err := storage.GetPlanByID(*request.PlanID)
 	if err != nil {
-		glog.Errorf("Unable to provision resource (GetPlanByID failed): %s\n", err.Error())
+		log.Errorf("Unable to provision resource (GetPlanByID failed): %s\n", err.Error())
 		return nil, err
 	}
+	if maintenance != nil && maintenance.Version != target_plan.MaintenanceVersion() {
+		return nil, maintenanceInfoConflict()
+	}
 
 	if Instance.Plan.Provider == target_plan.Provider {
-		byteData, err := json.Marshal(ChangePlansTaskMetadata{Plan: *request.PlanID})
+		byteData, err := json.Marshal(ChangePlansTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, Plan: *request.PlanID})
 		if err != nil {
-			glog.Errorf("Unable to marshal change plans task meta data: %s\n", err.Error())
+			log.Errorf("Unable to marshal change plans task meta data: %s\n", err.Error())
 			return nil, err
 		}
-		if _, err = b.storage.AddTask(Instance.Id, ChangePlansTask, string(byteData)); err != nil {
-			glog.Errorf("Error: Unable to schedule upgrade of a plan! (%s): %s\n", Instance.Name, err.Error())
+		taskId, err := b.addTask(c, Instance.Id, ChangePlansTask, string(byteData))
+		if err != nil {
+			log.Errorf("Error: Unable to schedule upgrade of a plan! (%s): %s\n", Instance.Name, err.Error())
 			return nil, err
 		}
+		opkey := osb.OperationKey(taskId)
 		response.Async = true
+		response.OperationKey = &opkey
 		return &response, nil
 	} else {
 		return nil, UnprocessableEntityWithMessage("UpgradeError", "Cannot upgrade or change plans across provider types.")
 	}
 }
 
+// MaintenanceInfo is the OSB (2.15) maintenance_info of a plan or instance, the
+// osb client does not have it.
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+func maintenanceInfoConflict() error {
+	return UnprocessableEntityWithMessage("MaintenanceInfoConflict", "The maintenance_info.version does not match the maintenance_info.version of the plan.")
+}
+
+// performMaintenance moves an instance onto the plans current maintenance version,
+// an instance that is already on it has nothing to do.
+func (b *BusinessLogic) performMaintenance(Instance *Instance, maintenance *MaintenanceInfo, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
+	response := broker.UpdateInstanceResponse{}
+	plan, err := storage.GetPlanByID(Instance.Plan.ID)
+	if err != nil {
+		log.Errorf("Unable to perform maintenance (GetPlanByID failed): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	if maintenance.Version != plan.MaintenanceVersion() {
+		return nil, maintenanceInfoConflict()
+	}
+	if Instance.Plan.MaintenanceVersion() == maintenance.Version {
+		response.Async = false
+		return &response, nil
+	}
+	byteData, err := json.Marshal(MaintenanceTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, Version: maintenance.Version})
+	if err != nil {
+		log.Errorf("Unable to marshal maintenance task meta data: %s\n", err.Error())
+		return nil, err
+	}
+	taskId, err := b.addTask(c, Instance.Id, MaintenanceTask, string(byteData))
+	if err != nil {
+		log.Errorf("Error: Unable to schedule maintenance! (%s): %s\n", Instance.Name, err.Error())
+		return nil, err
+	}
+	opkey := osb.OperationKey(taskId)
+	response.Async = true
+	response.OperationKey = &opkey
+	return &response, nil
+}
+
+// updateParameters validates the parameters of an update against the plans update
+// schema and has a worker apply them. Only the parameters in the update are
+// validated, the ones the instance was provisioned with are kept as they are.
+func (b *BusinessLogic) updateParameters(Instance *Instance, parameters map[string]interface{}, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
+	log := requestLogger(c)
+	response := broker.UpdateInstanceResponse{}
+	if err := ValidateParameters(Instance.Plan.UpdateSchema(), parameters); err != nil {
+		return nil, BadRequestWithMessage("ValidationError", err.Error())
+	}
+	byteData, err := json.Marshal(UpdateParametersTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, Parameters: parameters})
+	if err != nil {
+		log.Errorf("Unable to marshal update parameters task meta data: %s\n", err.Error())
+		return nil, err
+	}
+	taskId, err := b.addTask(c, Instance.Id, UpdateParametersTask, string(byteData))
+	if err != nil {
+		log.Errorf("Error: Unable to schedule update of parameters! (%s): %s\n", Instance.Name, err.Error())
+		return nil, err
+	}
+	opkey := osb.OperationKey(taskId)
+	response.Async = true
+	response.OperationKey = &opkey
+	return &response, nil
+}
+
+// LastOperationResponse adds instance_usable and update_repeatable (OSB 2.15) to
+// a last operation, the osb client does not have them.
+type LastOperationResponse struct {
+	osb.LastOperationResponse
+	InstanceUsable   *bool `json:"instance_usable,omitempty"`
+	UpdateRepeatable *bool `json:"update_repeatable,omitempty"`
+}
+
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	glog.V(3).Infoln("[b.LastOperation] start")
-	response := broker.LastOperationResponse{}
+	operation := ""
+	if request.OperationKey != nil {
+		operation = string(*request.OperationKey)
+	} else if c != nil && c.Request != nil {
+		operation = c.Request.URL.Query().Get("operation")
+	}
+	response, err := b.GetLastOperation(request.InstanceID, operation)
+	if err != nil {
+		return nil, err
+	}
+	return &broker.LastOperationResponse{LastOperationResponse: response.LastOperationResponse}, nil
+}
+
+// GetLastOperation reports on the operation (the task) an operation key was
+// handed out for, without one (or for keys handed out before they were tied to
+// tasks) it reports on the instance as a whole.
+func (b *BusinessLogic) GetLastOperation(InstanceID string, operation string) (*LastOperationResponse, error) {
+	logger.V(3).Infoln("[b.LastOperation] start")
+	if operation != "" {
+		task, err := b.storage.GetTask(InstanceID, operation)
+		if err == nil {
+			return b.taskLastOperation(task)
+		} else if err.Error() != "Cannot find task" {
+			logger.Errorf("Unable to get resource (%s) status, GetTask failed: %s\n", InstanceID, err.Error())
+			return nil, InternalServerError()
+		}
+	}
+
+	response := LastOperationResponse{}
 
-	upgrading, err := b.storage.IsUpgrading(request.InstanceID)
+	deleted, err := b.storage.WasDeleted(InstanceID)
 	if err != nil {
-		glog.Errorf("Unable to get resource (%s) status, IsUpgrading failed: %s\n", request.InstanceID, err.Error())
+		logger.Errorf("Unable to get resource (%s) status, WasDeleted failed: %s\n", InstanceID, err.Error())
 		return nil, InternalServerError()
 	}
+	if deleted {
+		return nil, Gone()
+	}
 
-	restoring, err := b.storage.IsRestoring(request.InstanceID)
+	deleting, err := b.storage.IsDeleting(InstanceID)
 	if err != nil {
-		glog.Errorf("Unable to get resource (%s) status, IsRestoring failed: %s\n", request.InstanceID, err.Error())
+		logger.Errorf("Unable to get resource (%s) status, IsDeleting failed: %s\n", InstanceID, err.Error())
 		return nil, InternalServerError()
 	}
 
-	if upgrading {
+	upgrading, err := b.storage.IsUpgrading(InstanceID)
+	if err != nil {
+		logger.Errorf("Unable to get resource (%s) status, IsUpgrading failed: %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+
+	restoring, err := b.storage.IsRestoring(InstanceID)
+	if err != nil {
+		logger.Errorf("Unable to get resource (%s) status, IsRestoring failed: %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+
+	if deleting {
+		desc := "deprovisioning"
+		response.Description = &desc
+		response.State = osb.StateInProgress
+		return &response, nil
+	} else if upgrading {
 		desc := "upgrading"
-		Instance, err := b.GetInstanceById(request.InstanceID)
+		Instance, err := b.GetInstanceById(InstanceID)
 		if err == nil && !IsAvailable(Instance.Status) {
 			desc = Instance.Status
 		}
@@ -321,7 +569,7 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 		return &response, nil
 	} else if restoring {
 		desc := "restoring"
-		Instance, err := b.GetInstanceById(request.InstanceID)
+		Instance, err := b.GetInstanceById(InstanceID)
 		if err == nil && !IsAvailable(Instance.Status) {
 			desc = Instance.Status
 		}
@@ -330,11 +578,11 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 		return &response, nil
 	}
 
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	Instance, err := b.GetInstanceById(InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Unable to get resource (%s) status: %s\n", request.InstanceID, err.Error())
+		logger.Errorf("Unable to get resource (%s) status: %s\n", InstanceID, err.Error())
 		return nil, InternalServerError()
 	}
 
@@ -353,37 +601,136 @@ func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *brok
 	return &response, nil
 }
 
+// taskLastOperation is the state of the task an operation key was handed out for.
+func (b *BusinessLogic) taskLastOperation(task *Task) (*LastOperationResponse, error) {
+	response := LastOperationResponse{}
+	description := task.Result
+	switch task.Status {
+	case "pending", "started":
+		response.State = osb.StateInProgress
+		if description == "" {
+			description = string(task.Action)
+		}
+	case "finished":
+		if task.Action == DeleteTask {
+			return nil, Gone()
+		}
+		response.State = osb.StateSucceeded
+	default:
+		response.State = osb.StateFailed
+		if task.Action == ChangePlansTask || task.Action == ChangeProvidersTask || task.Action == MaintenanceTask || task.Action == UpdateParametersTask || task.Action == DeleteTask {
+			// A failed plan change leaves the instance on its old plan, a failed delete
+			// leaves it where the provider left it, either way it can be tried again.
+			usable := false
+			if Instance, err := b.GetInstanceById(task.ResourceId); err == nil {
+				usable = IsAvailable(Instance.Status)
+			}
+			repeatable := true
+			response.InstanceUsable = &usable
+			if task.Action != DeleteTask {
+				response.UpdateRepeatable = &repeatable
+			}
+		}
+	}
+	if description != "" {
+		response.Description = &description
+	}
+	return &response, nil
+}
+
+// TagBinding marks the instance with the binding and the app it is for, the
+// app is only known if the platform sent a bind_resource.
+func TagBinding(provider Provider, Instance *Instance, BindingID string, AppGuid string) error {
+	if AppGuid == "" {
+		return nil
+	}
+	if err := provider.Tag(Instance, "Binding", BindingID); err != nil {
+		return err
+	}
+	return provider.Tag(Instance, "App", AppGuid)
+}
+
+func UntagBinding(provider Provider, Instance *Instance) error {
+	if err := provider.Untag(Instance, "Binding"); err != nil {
+		return err
+	}
+	return provider.Untag(Instance, "App")
+}
+
+// acceptsIncomplete is whether a bind or unbind may finish asynchronously, that
+// needs broker api 2.14.
+func acceptsIncomplete(c *broker.RequestContext) bool {
+	return c != nil && c.Request != nil && strings.ToLower(c.Request.URL.Query().Get(osb.AcceptsIncomplete)) == "true" && contextAPIVersion(c).AtLeast(apiVersion2_14)
+}
+
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext) (*broker.BindResponse, error) {
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
 	b.Lock()
 	defer b.Unlock()
 
-	glog.V(3).Infoln("[b.Bind] start")
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	log.V(3).Infoln("[b.Bind] start")
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
+		log.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	log = instanceLogger(log, Instance)
 	if Instance.Ready == false {
 		return nil, UnprocessableEntity()
 	}
 
-	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+	provider, err := b.getProvider(c, Instance.Plan)
 	if err != nil {
-		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		log.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
+	appGuid := ""
 	if request.BindResource != nil && request.BindResource.AppGUID != nil {
-		if err = provider.Tag(Instance, "Binding", request.BindingID); err != nil {
-			glog.Errorf("Error tagging: %s with %s, got %s\n", request.InstanceID, *request.BindResource.AppGUID, err.Error())
+		appGuid = *request.BindResource.AppGUID
+	}
+
+	// Bindings asked for with accepts_incomplete are created by the worker, the
+	// credentials are fetched once the last operation says it has succeeded.
+	if acceptsIncomplete(c) {
+		byteData, err := json.Marshal(BindingTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, BindingId: request.BindingID, AppGuid: appGuid})
+		if err != nil {
+			log.Errorf("Unable to marshal create binding task meta data: %s\n", err.Error())
 			return nil, InternalServerError()
 		}
-		if err = provider.Tag(Instance, "App", *request.BindResource.AppGUID); err != nil {
-			glog.Errorf("Error tagging: %s with %s, got %s\n", request.InstanceID, *request.BindResource.AppGUID, err.Error())
+		taskId, err := b.addTask(c, Instance.Id, CreateBindingTask, string(byteData))
+		if err != nil {
+			log.Errorf("Error: Unable to schedule binding creation! (%s): %s\n", Instance.Name, err.Error())
 			return nil, InternalServerError()
 		}
+		opkey := osb.OperationKey(taskId)
+		return &broker.BindResponse{
+			BindResponse: osb.BindResponse{
+				Async:        true,
+				OperationKey: &opkey,
+			},
+		}, nil
+	}
+
+	if err = TagBinding(provider, Instance, request.BindingID, appGuid); err != nil {
+		log.Errorf("Error tagging: %s with %s, got %s\n", request.InstanceID, appGuid, err.Error())
+		return nil, InternalServerError()
+	}
+
+	bindData := map[string]interface{}{"instance_id": Instance.Id, "binding_id": request.BindingID, "plan_id": Instance.Plan.ID}
+	if appGuid != "" {
+		bindData["app_guid"] = appGuid
+	}
+	if err = storage.AddEvent(BindEvent, Instance.Id, bindData); err != nil {
+		log.Errorf("Unable to record bind event for %s: %s\n", Instance.Id, err.Error())
+		return nil, InternalServerError()
+	}
+
+	if hook := webhookFromRequest(c); hook != nil {
+		b.scheduleWebhook(c, Instance.Id, NotifyCreateBindingWebhookTask, BindingWebhookTaskMetadata{WebhookTaskMetadata: *hook, BindingId: request.BindingID})
 	}
 
 	scheme := Instance.Scheme + "://"
@@ -402,33 +749,56 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *broker.RequestContext)
 }
 
 func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
+	log := requestLogger(c)
+	storage := traceStorage(requestContext(c), b.storage)
 	b.Lock()
 	defer b.Unlock()
 
-	glog.V(3).Infoln("[b.Unbind] start")
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	log.V(3).Infoln("[b.Unbind] start")
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
+		log.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
+	log = instanceLogger(log, Instance)
 	if Instance.Ready == false {
 		return nil, UnprocessableEntity()
 	}
 
-	provider, err := GetProviderByPlan(b.namePrefix, Instance.Plan)
+	provider, err := b.getProvider(c, Instance.Plan)
 	if err != nil {
-		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+		log.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 		return nil, InternalServerError()
 	}
 
-	if err = provider.Untag(Instance, "Binding"); err != nil {
-		glog.Errorf("Error untagging: %s\n", err.Error())
+	if acceptsIncomplete(c) {
+		byteData, err := json.Marshal(BindingTaskMetadata{TaskWebhook: TaskWebhook{Webhook: webhookFromRequest(c)}, BindingId: request.BindingID})
+		if err != nil {
+			log.Errorf("Unable to marshal delete binding task meta data: %s\n", err.Error())
+			return nil, InternalServerError()
+		}
+		taskId, err := b.addTask(c, Instance.Id, DeleteBindingTask, string(byteData))
+		if err != nil {
+			log.Errorf("Error: Unable to schedule binding deletion! (%s): %s\n", Instance.Name, err.Error())
+			return nil, InternalServerError()
+		}
+		opkey := osb.OperationKey(taskId)
+		return &broker.UnbindResponse{
+			UnbindResponse: osb.UnbindResponse{
+				Async:        true,
+				OperationKey: &opkey,
+			},
+		}, nil
+	}
+
+	if err = UntagBinding(provider, Instance); err != nil {
+		log.Errorf("Error untagging: %s\n", err.Error())
 		return nil, InternalServerError()
 	}
-	if err = provider.Untag(Instance, "App"); err != nil {
-		glog.Errorf("Error untagging: got %s\n", err.Error())
+	if err = storage.AddEvent(UnbindEvent, Instance.Id, map[string]interface{}{"instance_id": Instance.Id, "binding_id": request.BindingID, "plan_id": Instance.Plan.ID}); err != nil {
+		log.Errorf("Unable to record unbind event for %s: %s\n", Instance.Id, err.Error())
 		return nil, InternalServerError()
 	}
 
@@ -439,25 +809,26 @@ func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *broker.RequestCont
 	}, nil
 }
 
-func (b *BusinessLogic) ValidateBrokerAPIVersion(version string) error {
-	return nil
-}
-
 func (b *BusinessLogic) GetBinding(request *osb.GetBindingRequest, context *broker.RequestContext) (*osb.GetBindingResponse, error) {
-	glog.V(3).Infoln("[b.GetBinding] start")
-	Instance, err := b.GetInstanceById(request.InstanceID)
+	storage := traceStorage(requestContext(context), b.storage)
+	logger.V(3).Infoln("[b.GetBinding] start")
+	Instance, err := GetInstanceById(b.namePrefix, storage, request.InstanceID)
 	if err == nil && !CanGetBindings(Instance.Status) {
 		return nil, UnprocessableEntityWithMessage("ServiceNotYetAvailable", "The service requested is not yet available.")
 	}
 	if err != nil && err.Error() == "Cannot find resource instance" {
 		return nil, NotFound()
 	} else if err != nil {
-		glog.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
+		logger.Errorf("Error finding instance id (during getbinding): %s\n", err.Error())
 		return nil, err
 	}
-	if err != nil {
-		glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+	// A binding being created asynchronously does not exist until it has finished.
+	task, err := storage.GetBindingTask(request.InstanceID, request.BindingID)
+	if err != nil && err.Error() != "Cannot find binding" {
+		logger.Errorf("Error finding binding task (during getbinding): %s\n", err.Error())
 		return nil, InternalServerError()
+	} else if err == nil && (task.Action == DeleteBindingTask && task.Status == "finished" || task.Action == CreateBindingTask && task.Status != "finished") {
+		return nil, NotFound()
 	}
 
 	scheme := Instance.Scheme + "://"
@@ -471,4 +842,94 @@ func (b *BusinessLogic) GetBinding(request *osb.GetBindingRequest, context *brok
 	}, nil
 }
 
+// BindingLastOperation reports on a binding created or deleted asynchronously,
+// this is the state of the latest binding task for it.
+func (b *BusinessLogic) BindingLastOperation(request *osb.BindingLastOperationRequest) (*osb.LastOperationResponse, error) {
+	logger.V(3).Infoln("[b.BindingLastOperation] start")
+	task, err := b.storage.GetBindingTask(request.InstanceID, request.BindingID)
+	if err != nil && err.Error() == "Cannot find binding" {
+		return nil, NotFound()
+	} else if err != nil {
+		logger.Errorf("Unable to get binding (%s) status: %s\n", request.BindingID, err.Error())
+		return nil, InternalServerError()
+	}
+	if request.OperationKey != nil && string(*request.OperationKey) != "" && string(*request.OperationKey) != task.Id {
+		return nil, NotFound()
+	}
+	response := osb.LastOperationResponse{}
+	description := task.Result
+	switch task.Status {
+	case "pending", "started":
+		response.State = osb.StateInProgress
+		if description == "" {
+			description = string(task.Action)
+		}
+	case "finished":
+		response.State = osb.StateSucceeded
+	default:
+		response.State = osb.StateFailed
+	}
+	if description != "" {
+		response.Description = &description
+	}
+	return &response, nil
+}
+
+// GetInstanceResponse is the body of a fetch service instance (OSB 2.14), the
+// osb client this broker is built on does not have it.
+type GetInstanceResponse struct {
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id"`
+	DashboardURL    *string                `json:"dashboard_url,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+// DashboardURL is the dashboard of an instance if DASHBOARD_URL is set, any
+// {instance_id} in it is replaced with the instance id.
+func DashboardURL(InstanceID string) *string {
+	if os.Getenv("DASHBOARD_URL") == "" {
+		return nil
+	}
+	url := strings.Replace(os.Getenv("DASHBOARD_URL"), "{instance_id}", InstanceID, -1)
+	return &url
+}
+
+func (b *BusinessLogic) GetInstance(InstanceID string) (*GetInstanceResponse, error) {
+	logger.V(3).Infoln("[b.GetInstance] start")
+	upgrading, err := b.storage.IsUpgrading(InstanceID)
+	if err != nil {
+		logger.Errorf("Unable to get resource (%s) status, IsUpgrading failed: %s\n", InstanceID, err.Error())
+		return nil, InternalServerError()
+	}
+	if upgrading {
+		return nil, UnprocessableEntityWithMessage("ConcurrencyError", "The service instance is being updated.")
+	}
+	Instance, err := b.GetInstanceById(InstanceID)
+	if err != nil && err.Error() == "Cannot find resource instance" {
+		return nil, NotFound()
+	} else if err != nil {
+		logger.Errorf("Error finding instance id (during getinstance): %s\n", err.Error())
+		return nil, InternalServerError()
+	}
+	// An instance that is still being provisioned does not exist yet as far as the platform is concerned.
+	if !Instance.Ready && InProgress(Instance.Status) {
+		return nil, NotFound()
+	}
+	parameters := Instance.Parameters
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	response := &GetInstanceResponse{
+		ServiceID:    Instance.Plan.serviceId,
+		PlanID:       Instance.Plan.ID,
+		DashboardURL: DashboardURL(Instance.Id),
+		Parameters:   parameters,
+	}
+	if version := Instance.Plan.MaintenanceVersion(); version != "" {
+		response.MaintenanceInfo = &MaintenanceInfo{Version: version, Description: "MongoDB " + version}
+	}
+	return response, nil
+}
+
 var _ broker.Interface = &BusinessLogic{}
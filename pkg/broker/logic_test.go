@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeOperationStorage struct {
+	Storage
+	task *Task
+}
+
+func (s *fakeOperationStorage) GetTask(resourceId string, taskId string) (*Task, error) {
+	if s.task == nil || s.task.Id != taskId {
+		return nil, errors.New("Cannot find task")
+	}
+	return s.task, nil
+}
+
+func (s *fakeOperationStorage) GetInstance(Id string) (*Entry, error) {
+	return nil, errors.New("Cannot find resource instance")
+}
+
+func TestGetLastOperation(t *testing.T) {
+	Convey("Given an operation key tied to a task", t, func() {
+		storage := &fakeOperationStorage{}
+		b := &BusinessLogic{storage: storage}
+
+		Convey("A pending task is in progress", func() {
+			storage.task = &Task{Id: "t1", ResourceId: "i1", Action: DeleteTask, Status: "pending"}
+			resp, err := b.GetLastOperation("i1", "t1")
+			So(err, ShouldBeNil)
+			So(resp.State, ShouldEqual, osb.StateInProgress)
+		})
+
+		Convey("A finished delete is gone", func() {
+			storage.task = &Task{Id: "t1", ResourceId: "i1", Action: DeleteTask, Status: "finished"}
+			_, err := b.GetLastOperation("i1", "t1")
+			httpErr, ok := osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusGone)
+		})
+
+		Convey("A finished plan change succeeded", func() {
+			storage.task = &Task{Id: "t1", ResourceId: "i1", Action: ChangePlansTask, Status: "finished"}
+			resp, err := b.GetLastOperation("i1", "t1")
+			So(err, ShouldBeNil)
+			So(resp.State, ShouldEqual, osb.StateSucceeded)
+		})
+
+		Convey("A failed plan change says whether the instance is usable and the update repeatable", func() {
+			storage.task = &Task{Id: "t1", ResourceId: "i1", Action: ChangePlansTask, Status: "failed", Result: "no capacity"}
+			resp, err := b.GetLastOperation("i1", "t1")
+			So(err, ShouldBeNil)
+			So(resp.State, ShouldEqual, osb.StateFailed)
+			So(*resp.Description, ShouldEqual, "no capacity")
+			So(*resp.InstanceUsable, ShouldBeFalse)
+			So(*resp.UpdateRepeatable, ShouldBeTrue)
+		})
+	})
+}
+
+type fakeMaintenanceStorage struct {
+	Storage
+	entry    *Entry
+	plan     *ProviderPlan
+	tasks    []TaskAction
+	metadata []string
+}
+
+func (s *fakeMaintenanceStorage) GetInstance(Id string) (*Entry, error) {
+	return s.entry, nil
+}
+
+func (s *fakeMaintenanceStorage) GetPlanByID(planId string) (*ProviderPlan, error) {
+	plan := *s.plan
+	return &plan, nil
+}
+
+func (s *fakeMaintenanceStorage) AddTaskForRequest(origin TaskOrigin, Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
+	s.tasks = append(s.tasks, action)
+	s.metadata = append(s.metadata, metadata)
+	return "t1", nil
+}
+
+func TestUpdateMaintenanceInfo(t *testing.T) {
+	Convey("Given an instance on an older maintenance version of its plan", t, func() {
+		storage := &fakeMaintenanceStorage{
+			entry: &Entry{Id: "i1", Name: "db", PlanId: "p1", Status: "available", MaintenanceVersion: "3.6.3"},
+			plan: &ProviderPlan{ID: "p1", Provider: MongoDBInstance, version: "4.0.3",
+				providerPrivateDetails: `{"master_uri":"mongodb://new:27017","versions":{"3.6.3":{"master_uri":"mongodb://old:27017"}}}`},
+		}
+		b := &BusinessLogic{storage: storage}
+		update := func(version string) (*broker.UpdateInstanceResponse, error) {
+			r := httptest.NewRequest("PATCH", "/v2/service_instances/i1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), maintenanceInfoKey{}, &MaintenanceInfo{Version: version}))
+			return b.Update(&osb.UpdateInstanceRequest{InstanceID: "i1", AcceptsIncomplete: true}, &broker.RequestContext{Request: r})
+		}
+
+		Convey("The instance is on the cluster of its maintenance version", func() {
+			Instance, err := b.GetInstanceById("i1")
+			So(err, ShouldBeNil)
+			So(Instance.Endpoint, ShouldEqual, "old:27017/db?ssl=true")
+			So(Instance.Plan.MaintenanceVersion(), ShouldEqual, "3.6.3")
+		})
+
+		Convey("Asking for the plans maintenance version schedules maintenance", func() {
+			resp, err := update("4.0.3")
+			So(err, ShouldBeNil)
+			So(resp.Async, ShouldBeTrue)
+			So(string(*resp.OperationKey), ShouldEqual, "t1")
+			So(storage.tasks, ShouldResemble, []TaskAction{MaintenanceTask})
+		})
+
+		Convey("Asking for any other version is a conflict", func() {
+			_, err := update("5.0.0")
+			httpErr, ok := osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			So(httpErr.ResponseError.Error(), ShouldEqual, "MaintenanceInfoConflict")
+			So(len(storage.tasks), ShouldEqual, 0)
+		})
+
+		Convey("An instance already on the version has nothing to do", func() {
+			storage.entry.MaintenanceVersion = "4.0.3"
+			resp, err := update("4.0.3")
+			So(err, ShouldBeNil)
+			So(resp.Async, ShouldBeFalse)
+			So(len(storage.tasks), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestUpdateParameters(t *testing.T) {
+	Convey("Given an instance on a plan with an update schema", t, func() {
+		schema, _ := parseUpdateSchema("")
+		storage := &fakeMaintenanceStorage{
+			entry: &Entry{Id: "i1", Name: "db", PlanId: "p1", Status: "available", Parameters: `{"labels":{"team":"data"}}`},
+			plan: &ProviderPlan{ID: "p1", Provider: MongoDBInstance, providerPrivateDetails: `{"master_uri":"mongodb://new:27017"}`,
+				basePlan: osb.Plan{Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{Update: &osb.InputParametersSchema{Parameters: schema}}}}},
+		}
+		b := &BusinessLogic{storage: storage}
+
+		Convey("Valid parameters are applied by a task", func() {
+			resp, err := b.Update(&osb.UpdateInstanceRequest{InstanceID: "i1", AcceptsIncomplete: true, Parameters: map[string]interface{}{"profiler_level": 1}}, nil)
+			So(err, ShouldBeNil)
+			So(resp.Async, ShouldBeTrue)
+			So(storage.tasks, ShouldResemble, []TaskAction{UpdateParametersTask})
+		})
+
+		Convey("Invalid parameters are a bad request", func() {
+			_, err := b.Update(&osb.UpdateInstanceRequest{InstanceID: "i1", AcceptsIncomplete: true, Parameters: map[string]interface{}{"profiler_level": 5}}, nil)
+			httpErr, ok := osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(len(storage.tasks), ShouldEqual, 0)
+		})
+
+		Convey("Parameters the instance was provisioned with are kept", func() {
+			storage.entry.Parameters = `{"region":"us","labels":{"team":"data"}}`
+			_, err := b.Update(&osb.UpdateInstanceRequest{InstanceID: "i1", AcceptsIncomplete: true, Parameters: map[string]interface{}{"profiler_level": 1}}, nil)
+			So(err, ShouldBeNil)
+			So(storage.metadata, ShouldHaveLength, 1)
+			var metadata UpdateParametersTaskMetadata
+			So(json.Unmarshal([]byte(storage.metadata[0]), &metadata), ShouldBeNil)
+			So(metadata.Parameters, ShouldResemble, map[string]interface{}{"profiler_level": float64(1)})
+
+			Instance, err := b.GetInstanceById("i1")
+			So(err, ShouldBeNil)
+			So(mergeParameters(Instance.Parameters, metadata.Parameters), ShouldResemble, map[string]interface{}{"region": "us", "labels": map[string]interface{}{"team": "data"}, "profiler_level": float64(1)})
+		})
+
+		Convey("A protected instance cannot be deprovisioned", func() {
+			storage.entry.Parameters = `{"deletion_protection":true}`
+			_, err := b.Deprovision(&osb.DeprovisionRequest{InstanceID: "i1", AcceptsIncomplete: true}, nil)
+			httpErr, ok := osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+	})
+}
@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"encoding/csv"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// hoursPerMonth is the length of the month plans with a monthly (or per storage
+// unit) cost are prorated over, so every month costs the same.
+const hoursPerMonth = 730
+
+// MeteringPeriod is a stretch of time an instance was on a plan for an owner, a
+// period that has not ended is still running.
+type MeteringPeriod struct {
+	ResourceId         string
+	Plan               string
+	Owner              string
+	CostCents          int64
+	CostUnit           string
+	Started            time.Time
+	Ended              *time.Time
+	AverageStorageSize int64
+	MaxStorageSize     int64
+}
+
+// UsageRecord is the usage and cost of one instance on one plan within a billing
+// period.
+type UsageRecord struct {
+	Owner              string    `json:"owner"`
+	InstanceId         string    `json:"instance_id"`
+	Plan               string    `json:"plan"`
+	From               time.Time `json:"from"`
+	To                 time.Time `json:"to"`
+	Hours              float64   `json:"hours"`
+	AverageStorageSize int64     `json:"average_storage_size"`
+	MaxStorageSize     int64     `json:"max_storage_size"`
+	UnitCostCents      int64     `json:"unit_cost_cents"`
+	CostUnit           string    `json:"cost_unit"`
+	CostCents          int64     `json:"cost_cents"`
+}
+
+// OrganizationUsage is the usage records of one organization within a billing
+// period and their total cost.
+type OrganizationUsage struct {
+	Owner     string        `json:"owner"`
+	CostCents int64         `json:"cost_cents"`
+	Records   []UsageRecord `json:"records"`
+}
+
+type UsageReport struct {
+	From          time.Time           `json:"from"`
+	To            time.Time           `json:"to"`
+	CostCents     int64               `json:"cost_cents"`
+	Organizations []OrganizationUsage `json:"organizations"`
+}
+
+var timeCostUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    time.Hour * 24,
+	"month":  time.Hour * hoursPerMonth,
+	"year":   time.Hour * hoursPerMonth * 12,
+}
+
+var storageCostUnits = map[string]float64{
+	"byte":     1,
+	"megabyte": 1 << 20,
+	"gigabyte": 1 << 30,
+	"terabyte": 1 << 40,
+	"petabyte": 1 << 50,
+}
+
+// meteredCost is what an instance on a plan costs for the time it was metered.
+// Time units are prorated, storage units are charged per unit of average storage
+// per month and cycle, op and unit are charged once per billing period.
+func meteredCost(costCents int64, costUnit string, metered time.Duration, averageStorageSize int64) float64 {
+	if unit, ok := timeCostUnits[costUnit]; ok {
+		return float64(costCents) * float64(metered) / float64(unit)
+	}
+	if unit, ok := storageCostUnits[costUnit]; ok {
+		return float64(costCents) * float64(averageStorageSize) / unit * metered.Hours() / hoursPerMonth
+	}
+	return float64(costCents)
+}
+
+// MeterUsage turns the metering periods that overlap a billing period into usage
+// records grouped by organization.
+func MeterUsage(periods []MeteringPeriod, from time.Time, to time.Time) UsageReport {
+	report := UsageReport{From: from, To: to, Organizations: make([]OrganizationUsage, 0)}
+	byOwner := make(map[string]*OrganizationUsage)
+	for _, period := range periods {
+		start, end := period.Started, to
+		if start.Before(from) {
+			start = from
+		}
+		if period.Ended != nil && period.Ended.Before(end) {
+			end = *period.Ended
+		}
+		if !end.After(start) {
+			continue
+		}
+		metered := end.Sub(start)
+		record := UsageRecord{
+			Owner:              period.Owner,
+			InstanceId:         period.ResourceId,
+			Plan:               period.Plan,
+			From:               start,
+			To:                 end,
+			Hours:              math.Round(metered.Hours()*100) / 100,
+			AverageStorageSize: period.AverageStorageSize,
+			MaxStorageSize:     period.MaxStorageSize,
+			UnitCostCents:      period.CostCents,
+			CostUnit:           period.CostUnit,
+			CostCents:          int64(math.Round(meteredCost(period.CostCents, period.CostUnit, metered, period.AverageStorageSize))),
+		}
+		organization, ok := byOwner[period.Owner]
+		if !ok {
+			organization = &OrganizationUsage{Owner: period.Owner, Records: make([]UsageRecord, 0)}
+			byOwner[period.Owner] = organization
+		}
+		organization.Records = append(organization.Records, record)
+		organization.CostCents += record.CostCents
+		report.CostCents += record.CostCents
+	}
+	for _, organization := range byOwner {
+		report.Organizations = append(report.Organizations, *organization)
+	}
+	sort.Slice(report.Organizations, func(i, j int) bool {
+		return report.Organizations[i].Owner < report.Organizations[j].Owner
+	})
+	return report
+}
+
+// GetUsageReport is the usage of every organization (or just one) within a
+// billing period.
+func (b *BusinessLogic) GetUsageReport(from time.Time, to time.Time, owner string) (*UsageReport, error) {
+	periods, err := b.storage.GetMeteringPeriods(from, to, owner)
+	if err != nil {
+		logger.Errorf("Unable to get metering periods from %s to %s: %s\n", from, to, err.Error())
+		return nil, InternalServerError()
+	}
+	report := MeterUsage(periods, from, to)
+	return &report, nil
+}
+
+func parseBillingTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// billingPeriodFromRequest is the month given as period=YYYY-MM, the range given
+// as from and to (dates or RFC3339 times, to is exclusive) or the current month
+// so far.
+func billingPeriodFromRequest(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	if period := query.Get("period"); period != "" {
+		from, err := time.Parse("2006-01", period)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("The period must be a month of the form YYYY-MM.")
+		}
+		return from, from.AddDate(0, 1, 0), nil
+	}
+	now = now.UTC()
+	from, to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), now
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = parseBillingTime(value); err != nil {
+			return time.Time{}, time.Time{}, errors.New("The from time must be a date (YYYY-MM-DD) or an RFC3339 time.")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = parseBillingTime(value); err != nil {
+			return time.Time{}, time.Time{}, errors.New("The to time must be a date (YYYY-MM-DD) or an RFC3339 time.")
+		}
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, errors.New("The to time must be after the from time.")
+	}
+	return from, to, nil
+}
+
+// writeUsageCSV writes one line per usage record.
+func writeUsageCSV(w http.ResponseWriter, report *UsageReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage-`+report.From.Format("2006-01-02")+`-`+report.To.Format("2006-01-02")+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"owner", "instance_id", "plan", "from", "to", "hours", "average_storage_size", "max_storage_size", "unit_cost_cents", "cost_unit", "cost_cents"})
+	for _, organization := range report.Organizations {
+		for _, record := range organization.Records {
+			out.Write([]string{
+				record.Owner,
+				record.InstanceId,
+				record.Plan,
+				record.From.Format(time.RFC3339),
+				record.To.Format(time.RFC3339),
+				strconv.FormatFloat(record.Hours, 'f', 2, 64),
+				strconv.FormatInt(record.AverageStorageSize, 10),
+				strconv.FormatInt(record.MaxStorageSize, 10),
+				strconv.FormatInt(record.UnitCostCents, 10),
+				record.CostUnit,
+				strconv.FormatInt(record.CostCents, 10),
+			})
+		}
+	}
+	out.Flush()
+}
+
+func (b *BusinessLogic) adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := b.authorizeAdmin(w, r, ReadUsagePermission); !ok {
+		return
+	}
+	from, to, err := billingPeriodFromRequest(r, time.Now())
+	if err != nil {
+		HttpWriteError(w, UnprocessableEntityWithMessage("InvalidPeriod", err.Error()))
+		return
+	}
+	report, err := b.GetUsageReport(from, to, r.URL.Query().Get("owner"))
+	if err != nil {
+		HttpWriteError(w, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv" {
+		writeUsageCSV(w, report)
+		return
+	}
+	HttpWrite(w, 200, report)
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeMeteringStorage struct {
+	Storage
+	periods []MeteringPeriod
+	owner   string
+}
+
+func (s *fakeMeteringStorage) GetMeteringPeriods(from time.Time, to time.Time, owner string) ([]MeteringPeriod, error) {
+	s.owner = owner
+	return s.periods, nil
+}
+
+func TestMeterUsage(t *testing.T) {
+	Convey("Given metering periods in September", t, func() {
+		from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+		changed := time.Date(2026, 9, 16, 0, 0, 0, 0, time.UTC)
+		periods := []MeteringPeriod{
+			// provisioned before september and moved to another plan half way through.
+			{ResourceId: "a", Plan: "shared", Owner: "org-1", CostCents: 2500, CostUnit: "month", Started: time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC), Ended: &changed},
+			{ResourceId: "a", Plan: "dedicated", Owner: "org-1", CostCents: 10, CostUnit: "hour", Started: changed},
+			// charged for the storage it used.
+			{ResourceId: "b", Plan: "metered", Owner: "org-2", CostCents: 100, CostUnit: "gigabyte", Started: from, AverageStorageSize: 2 << 30, MaxStorageSize: 3 << 30},
+			// a flat charge per billing period.
+			{ResourceId: "c", Plan: "flat", Owner: "org-2", CostCents: 500, CostUnit: "cycle", Started: changed},
+		}
+		report := MeterUsage(periods, from, to)
+
+		So(report.Organizations, ShouldHaveLength, 2)
+		org1 := report.Organizations[0]
+		So(org1.Owner, ShouldEqual, "org-1")
+		So(org1.Records, ShouldHaveLength, 2)
+		So(org1.Records[0].From, ShouldEqual, from)
+		So(org1.Records[0].Hours, ShouldEqual, 360)
+		So(org1.Records[0].CostCents, ShouldEqual, 1233)
+		So(org1.Records[1].To, ShouldEqual, to)
+		So(org1.Records[1].CostCents, ShouldEqual, 3600)
+		So(org1.CostCents, ShouldEqual, 4833)
+
+		org2 := report.Organizations[1]
+		So(org2.Records[0].CostCents, ShouldEqual, 197)
+		So(org2.Records[1].CostCents, ShouldEqual, 500)
+		So(report.CostCents, ShouldEqual, 4833+197+500)
+
+		Convey("Periods outside of the billing period are not charged", func() {
+			ended := from
+			report := MeterUsage([]MeteringPeriod{{ResourceId: "d", Owner: "org-3", CostCents: 100, CostUnit: "month", Started: from.AddDate(0, -1, 0), Ended: &ended}}, from, to)
+			So(report.Organizations, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestBillingPeriodFromRequest(t *testing.T) {
+	Convey("Given requests for usage", t, func() {
+		now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+		from, to, err := billingPeriodFromRequest(httptest.NewRequest("GET", "/admin/usage?period=2026-02", nil), now)
+		So(err, ShouldBeNil)
+		So(from, ShouldEqual, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC))
+		So(to, ShouldEqual, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+
+		from, to, err = billingPeriodFromRequest(httptest.NewRequest("GET", "/admin/usage", nil), now)
+		So(err, ShouldBeNil)
+		So(from, ShouldEqual, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+		So(to, ShouldEqual, now)
+
+		from, _, err = billingPeriodFromRequest(httptest.NewRequest("GET", "/admin/usage?from=2026-10-05&to=2026-10-10T00:00:00Z", nil), now)
+		So(err, ShouldBeNil)
+		So(from, ShouldEqual, time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC))
+
+		_, _, err = billingPeriodFromRequest(httptest.NewRequest("GET", "/admin/usage?from=2026-10-10&to=2026-10-05", nil), now)
+		So(err, ShouldNotBeNil)
+		_, _, err = billingPeriodFromRequest(httptest.NewRequest("GET", "/admin/usage?period=september", nil), now)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAdminUsage(t *testing.T) {
+	Convey("Given the usage export", t, func() {
+		storage := &fakeMeteringStorage{periods: []MeteringPeriod{
+			{ResourceId: "a", Plan: "shared", Owner: "org-1", CostCents: 2500, CostUnit: "month", Started: time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC)},
+		}}
+		credentials, _ := credentialsFromOptions(Options{AdminCredentials: "finance:secret,jane:secret"})
+		roles, _ := ParseRoleBindings("basic:finance=billing,basic:jane=viewer")
+		b := &BusinessLogic{storage: storage, credentials: credentials}
+		b.roles = roles
+		call := func(user string, url string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", url, nil)
+			r.SetBasicAuth(user, "secret")
+			w := httptest.NewRecorder()
+			b.adminUsageHandler(w, r)
+			return w
+		}
+
+		Convey("It is json by default", func() {
+			w := call("finance", "/admin/usage?period=2026-09&owner=org-1")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(storage.owner, ShouldEqual, "org-1")
+			var report UsageReport
+			So(json.NewDecoder(w.Body).Decode(&report), ShouldBeNil)
+			So(report.CostCents, ShouldEqual, 2466)
+		})
+
+		Convey("It can be exported as csv", func() {
+			w := call("finance", "/admin/usage?period=2026-09&format=csv")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/csv")
+			body, _ := ioutil.ReadAll(w.Body)
+			lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+			So(lines, ShouldHaveLength, 2)
+			So(lines[0], ShouldStartWith, "owner,instance_id,plan")
+			So(lines[1], ShouldEqual, "org-1,a,shared,2026-09-01T00:00:00Z,2026-10-01T00:00:00Z,720.00,0,0,2500,month,2466")
+		})
+
+		Convey("It needs the read-usage permission", func() {
+			So(call("jane", "/admin/usage").Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
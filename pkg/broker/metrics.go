@@ -0,0 +1,302 @@
+package broker
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	providerCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mongodb_broker",
+		Name:      "provider_call_duration_seconds",
+		Help:      "How long calls to the provider took by method, plan and cluster.",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 1800},
+	}, []string{"method", "plan", "cluster"})
+	providerCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mongodb_broker",
+		Name:      "provider_call_errors_total",
+		Help:      "Calls to the provider that failed by method, plan and cluster.",
+	}, []string{"method", "plan", "cluster"})
+	taskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mongodb_broker",
+		Name:      "task_run_duration_seconds",
+		Help:      "How long task runs took by action and outcome (finished, error or failed).",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"action", "outcome"})
+	taskRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mongodb_broker",
+		Name:      "task_retries_total",
+		Help:      "Task runs that did not succeed and were scheduled to be retried by action.",
+	}, []string{"action"})
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mongodb_broker",
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by event and result (delivered, rejected or error).",
+	}, []string{"event", "result"})
+
+	taskQueueDesc  = prometheus.NewDesc("mongodb_broker_tasks", "Tasks by action and status.", []string{"action", "status"}, nil)
+	poolSizeDesc   = prometheus.NewDesc("mongodb_broker_preprovision_pool_size", "Unclaimed preprovisioned instances by plan and status.", []string{"plan", "status"}, nil)
+	poolTargetDesc = prometheus.NewDesc("mongodb_broker_preprovision_pool_target", "How many instances of a plan are kept preprovisioned.", []string{"plan"}, nil)
+)
+
+// TaskCount is how many tasks of an action have a status.
+type TaskCount struct {
+	Action TaskAction
+	Status string
+	Count  int64
+}
+
+// PreprovisionPool is how many unclaimed instances of a plan have a status, a
+// plan with none has a single pool with no status.
+type PreprovisionPool struct {
+	Plan   string
+	Target int64
+	Status string
+	Count  int64
+}
+
+// storageCollector reads the task queue and preprovision pools from storage each
+// time the metrics are scraped.
+type storageCollector struct {
+	storage Storage
+}
+
+func (c storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- taskQueueDesc
+	ch <- poolSizeDesc
+	ch <- poolTargetDesc
+}
+
+func (c storageCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.storage.CountTasks()
+	if err != nil {
+		logger.Errorf("Unable to count tasks for metrics: %s\n", err.Error())
+	}
+	for _, count := range counts {
+		ch <- prometheus.MustNewConstMetric(taskQueueDesc, prometheus.GaugeValue, float64(count.Count), string(count.Action), count.Status)
+	}
+	pools, err := c.storage.GetPreprovisionPools()
+	if err != nil {
+		logger.Errorf("Unable to get preprovision pools for metrics: %s\n", err.Error())
+	}
+	targets := make(map[string]int64)
+	for _, pool := range pools {
+		targets[pool.Plan] = pool.Target
+		if pool.Status != "" {
+			ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(pool.Count), pool.Plan, pool.Status)
+		}
+	}
+	for plan, target := range targets {
+		ch <- prometheus.MustNewConstMetric(poolTargetDesc, prometheus.GaugeValue, float64(target), plan)
+	}
+}
+
+// RegisterMetrics adds the brokers metrics to a registry.
+func RegisterMetrics(reg prometheus.Registerer, storage Storage) error {
+	for _, collector := range []prometheus.Collector{providerCallDuration, providerCallErrors, taskDuration, taskRetries, webhookDeliveries, usageDataSize, usageStorageSize, usageIndexSize, usageObjects, usageCollections, storageCollector{storage: storage}} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BusinessLogic) RegisterMetrics(reg prometheus.Registerer) error {
+	return RegisterMetrics(reg, b.storage)
+}
+
+func metricsAddrFromOptions(o Options) string {
+	if o.MetricsAddr == "" && os.Getenv("METRICS_ADDR") != "" {
+		o.MetricsAddr = os.Getenv("METRICS_ADDR")
+	}
+	if o.MetricsAddr == "" {
+		o.MetricsAddr = ":9090"
+	}
+	return o.MetricsAddr
+}
+
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// observeTaskRun records how long a task handler ran, an error is retried unless
+// the task failed for good.
+func observeTaskRun(action TaskAction, start time.Time, err error) {
+	outcome := "finished"
+	if _, ok := err.(TaskFailedError); ok {
+		outcome = "failed"
+	} else if err != nil {
+		outcome = "error"
+	}
+	taskDuration.WithLabelValues(string(action), outcome).Observe(time.Since(start).Seconds())
+}
+
+func observeWebhookDelivery(delivery WebhookDelivery) {
+	result := "delivered"
+	if delivery.Error != "" && delivery.StatusCode == 0 {
+		result = "error"
+	} else if delivery.Error != "" {
+		result = "rejected"
+	}
+	webhookDeliveries.WithLabelValues(delivery.Event, result).Inc()
+}
+
+// ClusterNamer is implemented by providers that can say which cluster a plan
+// (at its maintenance version) is on.
+type ClusterNamer interface {
+	Cluster(*ProviderPlan) string
+}
+
+// ContextProvider is implemented by providers that trace the work they do, the
+// context is the one of the call they are making it for.
+type ContextProvider interface {
+	WithContext(context.Context) Provider
+}
+
+// instrumentedProvider records the latency and errors of calls to a provider,
+// logs them and traces each call in a span.
+type instrumentedProvider struct {
+	Provider
+	ctx context.Context
+}
+
+// unwrapProvider is the provider an instrumented one wraps, so the optional
+// interfaces it implements can be found. It traces its work as part of the
+// request or task the instrumented provider is for.
+func unwrapProvider(provider Provider) Provider {
+	if p, ok := provider.(instrumentedProvider); ok {
+		if traced, ok := p.Provider.(ContextProvider); ok && p.ctx != nil {
+			return traced.WithContext(p.ctx)
+		}
+		return p.Provider
+	}
+	return provider
+}
+
+// planLabels are the name of the plan and the cluster it is on (if the provider
+// can say).
+func planLabels(provider Provider, plan *ProviderPlan) (string, string) {
+	planName, cluster := "", ""
+	if plan != nil {
+		planName = plan.basePlan.Name
+		if planName == "" {
+			planName = plan.ID
+		}
+		if namer, ok := unwrapProvider(provider).(ClusterNamer); ok {
+			cluster = namer.Cluster(plan)
+		}
+	}
+	return planName, cluster
+}
+
+// withProviderContext logs the calls to the provider with the logger of the
+// context and traces them as children of its span, e.g., the request or task
+// they are made for.
+func withProviderContext(provider Provider, ctx context.Context) Provider {
+	if p, ok := provider.(instrumentedProvider); ok {
+		p.ctx = ctx
+		return p
+	}
+	return provider
+}
+
+// start begins a call to the provider in a span of its own, the provider it
+// returns traces its work as part of the span if it can. done records the
+// outcome of the call.
+func (p instrumentedProvider) start(method string, plan *ProviderPlan) (Provider, func(error)) {
+	ctx := p.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	planName, cluster := planLabels(p.Provider, plan)
+	ctx, span := tracer().Start(ctx, "Provider."+method, trace.WithAttributes(
+		attribute.String("broker.provider.method", method),
+		attribute.String("broker.plan", planName),
+		attribute.String("broker.cluster", cluster)))
+	provider := p.Provider
+	if traced, ok := provider.(ContextProvider); ok {
+		provider = traced.WithContext(ctx)
+	}
+	start := time.Now()
+	return provider, func(err error) {
+		latency := time.Since(start)
+		providerCallDuration.WithLabelValues(method, planName, cluster).Observe(latency.Seconds())
+		log := LoggerFrom(ctx).With("plan", planName).With("cluster", cluster).With("method", method).With("latency", latency.String())
+		if err != nil {
+			providerCallErrors.WithLabelValues(method, planName, cluster).Inc()
+			log.With("error", err.Error()).Infof("Provider call %s failed\n", method)
+		} else {
+			log.V(1).Infof("Provider call %s succeeded\n", method)
+		}
+		endSpan(span, err)
+	}
+}
+
+func (p instrumentedProvider) GetInstance(name string, plan *ProviderPlan) (*Instance, error) {
+	provider, done := p.start("GetInstance", plan)
+	instance, err := provider.GetInstance(name, plan)
+	done(err)
+	return instance, err
+}
+
+func (p instrumentedProvider) Provision(Id string, plan *ProviderPlan, Owner string) (*Instance, error) {
+	provider, done := p.start("Provision", plan)
+	instance, err := provider.Provision(Id, plan, Owner)
+	done(err)
+	return instance, err
+}
+
+func (p instrumentedProvider) Deprovision(instance *Instance, takeSnapshot bool) error {
+	provider, done := p.start("Deprovision", instance.Plan)
+	err := provider.Deprovision(instance, takeSnapshot)
+	done(err)
+	return err
+}
+
+func (p instrumentedProvider) Modify(instance *Instance, plan *ProviderPlan) (*Instance, error) {
+	provider, done := p.start("Modify", plan)
+	newInstance, err := provider.Modify(instance, plan)
+	done(err)
+	return newInstance, err
+}
+
+func (p instrumentedProvider) Maintain(instance *Instance, plan *ProviderPlan) (*Instance, error) {
+	provider, done := p.start("Maintain", plan)
+	newInstance, err := provider.Maintain(instance, plan)
+	done(err)
+	return newInstance, err
+}
+
+func (p instrumentedProvider) UpdateParameters(instance *Instance, parameters map[string]interface{}) error {
+	provider, done := p.start("UpdateParameters", instance.Plan)
+	err := provider.UpdateParameters(instance, parameters)
+	done(err)
+	return err
+}
+
+func (p instrumentedProvider) Tag(instance *Instance, Name string, Value string) error {
+	provider, done := p.start("Tag", instance.Plan)
+	err := provider.Tag(instance, Name, Value)
+	done(err)
+	return err
+}
+
+func (p instrumentedProvider) Untag(instance *Instance, Name string) error {
+	provider, done := p.start("Untag", instance.Plan)
+	err := provider.Untag(instance, Name)
+	done(err)
+	return err
+}
+
+func (p instrumentedProvider) PerformPostProvision(instance *Instance) (*Instance, error) {
+	provider, done := p.start("PerformPostProvision", instance.Plan)
+	newInstance, err := provider.PerformPostProvision(instance)
+	done(err)
+	return newInstance, err
+}
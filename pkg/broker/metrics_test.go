@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeMetricsStorage struct {
+	Storage
+}
+
+func (s fakeMetricsStorage) CountTasks() ([]TaskCount, error) {
+	return []TaskCount{{Action: ResyncFromProviderTask, Status: "pending", Count: 3}, {Action: DeleteTask, Status: "failed", Count: 1}}, nil
+}
+
+func (s fakeMetricsStorage) GetPreprovisionPools() ([]PreprovisionPool, error) {
+	return []PreprovisionPool{{Plan: "shared", Target: 2, Status: "available", Count: 1}, {Plan: "shared", Target: 2, Status: "provisioning", Count: 1}, {Plan: "dedicated", Target: 1}}, nil
+}
+
+type fakeFailingProvider struct {
+	Provider
+}
+
+func (p fakeFailingProvider) Tag(instance *Instance, Name string, Value string) error {
+	return errors.New("unable to tag")
+}
+
+func (p fakeFailingProvider) Cluster(plan *ProviderPlan) string {
+	return "mongodb.example.com:27017"
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Given a registry with the broker metrics", t, func() {
+		reg := prometheus.NewRegistry()
+		So(RegisterMetrics(reg, fakeMetricsStorage{}), ShouldBeNil)
+
+		Convey("The task queue and preprovision pools are read from storage", func() {
+			recorder := httptest.NewRecorder()
+			metricsHandler(reg).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			body, _ := ioutil.ReadAll(recorder.Body)
+			So(string(body), ShouldContainSubstring, `mongodb_broker_tasks{action="resync-from-provider",status="pending"} 3`)
+			So(string(body), ShouldContainSubstring, `mongodb_broker_preprovision_pool_size{plan="shared",status="available"} 1`)
+			So(string(body), ShouldContainSubstring, `mongodb_broker_preprovision_pool_target{plan="dedicated"} 1`)
+			So(strings.Contains(string(body), `mongodb_broker_preprovision_pool_size{plan="dedicated"`), ShouldBeFalse)
+		})
+
+		Convey("Provider errors are counted by method, plan and cluster", func() {
+			provider := instrumentedProvider{Provider: fakeFailingProvider{}}
+			errorsBefore := testutil.ToFloat64(providerCallErrors.WithLabelValues("Tag", "shared", "mongodb.example.com:27017"))
+			err := provider.Tag(&Instance{Plan: &ProviderPlan{ID: "shared"}}, "owner", "me")
+			So(err, ShouldNotBeNil)
+			So(testutil.ToFloat64(providerCallErrors.WithLabelValues("Tag", "shared", "mongodb.example.com:27017")), ShouldEqual, errorsBefore+1)
+		})
+
+		Convey("Webhook deliveries are counted by result", func() {
+			delivered := testutil.ToFloat64(webhookDeliveries.WithLabelValues("notify-binding", "delivered"))
+			rejected := testutil.ToFloat64(webhookDeliveries.WithLabelValues("notify-binding", "rejected"))
+			observeWebhookDelivery(WebhookDelivery{Event: "notify-binding", StatusCode: 200})
+			observeWebhookDelivery(WebhookDelivery{Event: "notify-binding", StatusCode: 500, Error: "Got invalid http status code from hook: 500"})
+			So(testutil.ToFloat64(webhookDeliveries.WithLabelValues("notify-binding", "delivered")), ShouldEqual, delivered+1)
+			So(testutil.ToFloat64(webhookDeliveries.WithLabelValues("notify-binding", "rejected")), ShouldEqual, rejected+1)
+		})
+
+		Convey("Task runs that fail for good are told apart from those that will be retried", func() {
+			observeTaskRun(DeleteTask, time.Now(), TaskFailed("gone"))
+			observeTaskRun(DeleteTask, time.Now(), errors.New("try again"))
+			recorder := httptest.NewRecorder()
+			metricsHandler(reg).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			body, _ := ioutil.ReadAll(recorder.Body)
+			So(string(body), ShouldContainSubstring, `mongodb_broker_task_run_duration_seconds_count{action="delete",outcome="failed"}`)
+			So(string(body), ShouldContainSubstring, `mongodb_broker_task_run_duration_seconds_count{action="delete",outcome="error"}`)
+		})
+	})
+}
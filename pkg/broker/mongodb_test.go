@@ -146,3 +146,23 @@ func TestMongoDBProvision(t *testing.T) {
 		})
 	})
 }
+
+func TestMongoDBMaintainInPlace(t *testing.T) {
+	Convey("Given an instance whose cluster was upgraded in place", t, func() {
+		instance := &Instance{Id: "i1", Name: "db", Username: "u1", Password: "p1", Status: "available",
+			Parameters: map[string]interface{}{"profiler_level": float64(1)},
+			Plan:       &ProviderPlan{ID: "p1", providerPrivateDetails: `{"master_uri":"mongodb://db.example.com:27017","engine_version":"3.6.3"}`}}
+		plan := &ProviderPlan{ID: "p1", providerPrivateDetails: `{"master_uri":"mongodb://db.example.com:27017","engine_version":"4.0.3"}`}
+
+		Convey("Maintenance keeps the instance as the broker knows it", func() {
+			maintained, err := MongodbProvider{}.Maintain(instance, plan)
+			So(err, ShouldBeNil)
+			So(maintained.Id, ShouldEqual, "i1")
+			So(maintained.Username, ShouldEqual, "u1")
+			So(maintained.Password, ShouldEqual, "p1")
+			So(maintained.Status, ShouldEqual, "available")
+			So(maintained.Parameters, ShouldResemble, instance.Parameters)
+			So(maintained.EngineVersion, ShouldEqual, "4.0.3")
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// defaultUpdateSchema is the update schema of plans that do not declare their own
+// in the plans update_schema column.
+const defaultUpdateSchema = `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "profiler_level": {"type": "integer", "minimum": 0, "maximum": 2, "description": "The database profiler level, 0 is off, 1 profiles slow operations and 2 profiles all operations."},
+    "deletion_protection": {"type": "boolean", "description": "When true the instance cannot be deprovisioned."},
+    "allowed_cidrs": {"type": "array", "maxItems": 64, "items": {"type": "string", "format": "cidr"}, "description": "The networks clients may connect from, empty allows any."},
+    "labels": {"type": "object", "maxProperties": 64, "additionalProperties": {"type": "string", "maxLength": 256}, "description": "Labels to keep on the instance."}
+  }
+}`
+
+// UpdateSchema is the json schema the parameters of an update must match.
+func (p *ProviderPlan) UpdateSchema() map[string]interface{} {
+	if p.basePlan.Schemas == nil || p.basePlan.Schemas.ServiceInstance == nil || p.basePlan.Schemas.ServiceInstance.Update == nil {
+		return nil
+	}
+	schema, _ := p.basePlan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})
+	return schema
+}
+
+func parseUpdateSchema(updateSchema string) (map[string]interface{}, error) {
+	if updateSchema == "" {
+		updateSchema = defaultUpdateSchema
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(updateSchema), &schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// ValidateParameters checks parameters against the subset of json schema plans
+// use: type, enum, minimum, maximum, maxLength, maxItems, maxProperties, items,
+// properties, required, additionalProperties and the cidr format.
+func ValidateParameters(schema map[string]interface{}, parameters map[string]interface{}) error {
+	if schema == nil {
+		return errors.New("parameters cannot be changed on this plan")
+	}
+	// round trip so numbers and nested values have the types json gives them.
+	byteData, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err = json.Unmarshal(byteData, &value); err != nil {
+		return err
+	}
+	return validateValue(schema, value, "parameters")
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, path string) error {
+	if t, ok := schema["type"].(string); ok && !hasSchemaType(t, value) {
+		return fmt.Errorf("%s must be of type %s", path, t)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && v < min {
+			return fmt.Errorf("%s must be at least %v", path, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && v > max {
+			return fmt.Errorf("%s must be at most %v", path, max)
+		}
+	case string:
+		if max, ok := schema["maxLength"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s must be at most %v characters", path, max)
+		}
+		if format, ok := schema["format"].(string); ok && format == "cidr" {
+			if _, _, err := net.ParseCIDR(v); err != nil {
+				return fmt.Errorf("%s must be a cidr (e.g. 10.0.0.0/8)", path)
+			}
+		}
+	case []interface{}:
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s must have at most %v items", path, max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if max, ok := schema["maxProperties"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s must have at most %v properties", path, max)
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if _, ok := v[fmt.Sprint(r)]; !ok {
+					return fmt.Errorf("%s.%v is required", path, r)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			_, known := properties[key]
+			if v[key] == nil && path == "parameters" && known {
+				// a null removes the parameter.
+				continue
+			}
+			if property, ok := properties[key].(map[string]interface{}); ok {
+				if err := validateValue(property, v[key], path+"."+key); err != nil {
+					return err
+				}
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				if err := validateValue(additional, v[key], path+"."+key); err != nil {
+					return err
+				}
+			} else if allowed, ok := schema["additionalProperties"].(bool); ok && !allowed {
+				return fmt.Errorf("%s.%s is not a known parameter", path, key)
+			}
+		}
+	}
+	return nil
+}
+
+func hasSchemaType(t string, value interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == float64(int64(n))
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+// mergeParameters is the instances parameters after an update, a null removes
+// a parameter.
+func mergeParameters(current map[string]interface{}, update map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range current {
+		merged[key] = value
+	}
+	for key, value := range update {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// deletionProtected is whether the deletion_protection parameter is set.
+func deletionProtected(Instance *Instance) bool {
+	protected, _ := Instance.Parameters["deletion_protection"].(bool)
+	return protected
+}
@@ -0,0 +1,35 @@
+package broker
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestValidateParameters(t *testing.T) {
+	Convey("Given the default update schema", t, func() {
+		schema, err := parseUpdateSchema("")
+		So(err, ShouldBeNil)
+
+		Convey("Known parameters of the right type are valid", func() {
+			So(ValidateParameters(schema, map[string]interface{}{
+				"profiler_level":      1,
+				"deletion_protection": true,
+				"allowed_cidrs":       []string{"10.0.0.0/8", "192.168.1.0/24"},
+				"labels":              map[string]string{"team": "data"},
+			}), ShouldBeNil)
+		})
+
+		Convey("A null removes a parameter", func() {
+			So(ValidateParameters(schema, map[string]interface{}{"profiler_level": nil}), ShouldBeNil)
+			So(mergeParameters(map[string]interface{}{"profiler_level": 1, "labels": map[string]interface{}{}}, map[string]interface{}{"profiler_level": nil}), ShouldResemble, map[string]interface{}{"labels": map[string]interface{}{}})
+		})
+
+		Convey("Invalid parameters say what is wrong", func() {
+			So(ValidateParameters(schema, map[string]interface{}{"profiler_level": 3}).Error(), ShouldEqual, "parameters.profiler_level must be at most 2")
+			So(ValidateParameters(schema, map[string]interface{}{"profiler_level": 1.5}).Error(), ShouldEqual, "parameters.profiler_level must be of type integer")
+			So(ValidateParameters(schema, map[string]interface{}{"allowed_cidrs": []string{"10.0.0.1"}}).Error(), ShouldEqual, "parameters.allowed_cidrs[0] must be a cidr (e.g. 10.0.0.0/8)")
+			So(ValidateParameters(schema, map[string]interface{}{"labels": map[string]interface{}{"team": 1}}).Error(), ShouldEqual, "parameters.labels.team must be of type string")
+			So(ValidateParameters(schema, map[string]interface{}{"size": "large"}).Error(), ShouldEqual, "parameters.size is not a known parameter")
+		})
+	})
+}
@@ -1,12 +1,12 @@
 package broker
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 
-	"github.com/golang/glog"
 	_ "github.com/lib/pq"
 
 	// "gopkg.in/mgo.v2"
@@ -17,6 +17,9 @@ import (
 	"time"
 
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type InfoData struct {
@@ -44,6 +47,9 @@ func (mpps MongodbProviderPlanSettings) MasterHost() string {
 type MongodbProvider struct {
 	Provider
 	namePrefix string
+	// ctx is the call to the provider the connections and commands are traced as
+	// part of.
+	ctx context.Context
 }
 
 func NewMongodbProvider(namePrefix string) (MongodbProvider, error) {
@@ -52,10 +58,129 @@ func NewMongodbProvider(namePrefix string) (MongodbProvider, error) {
 	}, nil
 }
 
+// WithContext traces the connections and commands of the provider as children
+// of the span of the context.
+func (provider MongodbProvider) WithContext(ctx context.Context) Provider {
+	provider.ctx = ctx
+	return provider
+}
+
+// traced runs a command (or anything else that goes to mongodb) in a span of its
+// own, so the time spent on each shows apart from the rest of the call.
+func (provider MongodbProvider) traced(operation string, database string, run func() error, attributes ...attribute.KeyValue) error {
+	ctx := provider.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attributes = append(attributes, attribute.String("db.system", "mongodb"), attribute.String("db.operation.name", operation))
+	if database != "" {
+		attributes = append(attributes, attribute.String("db.namespace", database))
+	}
+	_, span := tracer().Start(ctx, "mongodb "+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+	err := run()
+	endSpan(span, err)
+	return err
+}
+
+// connect dials the master of the plan settings.
+func (provider MongodbProvider) connect(settings MongodbProviderPlanSettings) (*mgo.Session, error) {
+	var session *mgo.Session
+	err := provider.traced("connect", "", func() (err error) {
+		session, err = connectToMongoDb(settings.MasterUri)
+		return err
+	}, attribute.String("server.address", settings.MasterHost()))
+	return session, err
+}
+
+// run runs a command on a database.
+func (provider MongodbProvider) run(db *mgo.Database, operation string, cmd interface{}, result interface{}) error {
+	return provider.traced(operation, db.Name, func() error {
+		return db.Run(cmd, result)
+	})
+}
+
+// upsertUser creates the user or updates its roles (and password if it is set).
+func (provider MongodbProvider) upsertUser(db *mgo.Database, user *mgo.User) error {
+	return provider.traced("upsertUser", db.Name, func() error {
+		return db.UpsertUser(user)
+	})
+}
+
+func (provider MongodbProvider) dropDatabase(db *mgo.Database) error {
+	return provider.traced("dropDatabase", db.Name, func() error {
+		return db.DropDatabase()
+	})
+}
+
+// Cluster is the host of the master the plan puts its databases on.
+func (provider MongodbProvider) Cluster(plan *ProviderPlan) string {
+	var settings MongodbProviderPlanSettings
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+		return ""
+	}
+	return settings.MasterHost()
+}
+
+// Ping checks the master the plan puts its databases on answers within the timeout.
+func (provider MongodbProvider) Ping(plan *ProviderPlan, timeout time.Duration) error {
+	var settings MongodbProviderPlanSettings
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+	dialInfo, err := mgo.ParseURL(settings.MasterUri)
+	if err != nil {
+		return errors.New("The master uri cannot be parsed: " + err.Error())
+	}
+	dialInfo.Timeout = timeout
+	dialInfo.Direct = true
+	dialInfo.FailFast = true
+	dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr.String(), nil)
+	}
+	session, err := mgo.DialWithInfo(dialInfo)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.SetSyncTimeout(timeout)
+	return session.Ping()
+}
+
+// Usage is the dbStats of the instances database.
+func (provider MongodbProvider) Usage(instance *Instance) (*UsageSample, error) {
+	var settings MongodbProviderPlanSettings
+	if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return nil, err
+	}
+	pSession, err := provider.connect(settings)
+	if err != nil {
+		return nil, err
+	}
+	defer pSession.Close()
+
+	var stats struct {
+		Collections int64   `bson:"collections"`
+		Objects     int64   `bson:"objects"`
+		DataSize    float64 `bson:"dataSize"`
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	if err = provider.run(pSession.DB(instance.Name), "dbStats", bson.D{{Name: "dbStats", Value: 1}}, &stats); err != nil {
+		return nil, err
+	}
+	return &UsageSample{
+		Collections: stats.Collections,
+		Objects:     stats.Objects,
+		DataSize:    int64(stats.DataSize),
+		StorageSize: int64(stats.StorageSize),
+		IndexSize:   int64(stats.IndexSize),
+	}, nil
+}
+
 func (provider MongodbProvider) GetInstance(name string, plan *ProviderPlan) (*Instance, error) {
 	var settings MongodbProviderPlanSettings
 
-	glog.V(3).Infof("[p.GetInstance] start name: %s, plan: %s", name, plan.ID)
+	logger.V(3).Infof("[p.GetInstance] start name: %s, plan: %s", name, plan.ID)
 
 	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
 		return nil, err
@@ -92,7 +217,7 @@ func redactMongoDbURL(dburl string) string {
 }
 
 func connectToMongoDb(mongoDbUri string) (*mgo.Session, error) {
-	glog.V(3).Infoln("[connectToMongoDb] start")
+	logger.V(3).Infoln("[connectToMongoDb] start")
 
 	dialInfo, err := mgo.ParseURL(mongoDbUri)
 
@@ -108,17 +233,17 @@ func connectToMongoDb(mongoDbUri string) (*mgo.Session, error) {
 		os.Exit(1)
 	}
 
-	glog.V(1).Infof("[m.connectToMongoDb] connect to mongodb: %s\n", redactMongoDbURL(mongoDbUri))
+	logger.V(1).Infof("[m.connectToMongoDb] connect to mongodb: %s\n", redactMongoDbURL(mongoDbUri))
 
-	glog.V(4).Infof("[m.connectToMongoDb] dialInfo: %+v", dialInfo)
+	logger.V(4).Infof("[m.connectToMongoDb] dialInfo: %+v", dialInfo)
 
 	pSession, err := mgo.DialWithInfo(dialInfo)
 	if err != nil {
-		glog.Errorf("[m.connectToMongoDb] error: %s", err)
+		logger.Errorf("[m.connectToMongoDb] error: %s", err)
 		return nil, err
 	}
 
-	glog.V(3).Infoln("[m.connectToMongoDb] SetMode")
+	logger.V(3).Infoln("[m.connectToMongoDb] SetMode")
 
 	pSession.SetMode(mgo.Monotonic, true)
 
@@ -128,17 +253,17 @@ func connectToMongoDb(mongoDbUri string) (*mgo.Session, error) {
 func (provider MongodbProvider) Provision(Id string, plan *ProviderPlan, Owner string) (*Instance, error) {
 	var settings MongodbProviderPlanSettings
 
-	glog.Infof("[m.Provision] start id: %s, plan %s\n", Id, plan.ID)
-	glog.V(4).Infof("[m.Provision] private details: %+v", plan.providerPrivateDetails)
+	logger.Infof("[m.Provision] start id: %s, plan %s\n", Id, plan.ID)
+	logger.V(4).Infof("[m.Provision] private details: %+v", plan.providerPrivateDetails)
 
 	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &settings); err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
 
-	glog.V(3).Infof("[m.Provision] plan settings: %+v", settings)
+	logger.V(3).Infof("[m.Provision] plan settings: %+v", settings)
 
-	pSession, err := connectToMongoDb(settings.MasterUri)
+	pSession, err := provider.connect(settings)
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +293,11 @@ func (provider MongodbProvider) Provision(Id string, plan *ProviderPlan, Owner s
 			},
 		}
 
-		glog.V(3).Infof("[m.Provision] Upsert user: %s\n", pUser.Username)
+		logger.V(3).Infof("[m.Provision] Upsert user: %s\n", pUser.Username)
 
-		err = pSession.DB(name).UpsertUser(&pUser)
+		err = provider.upsertUser(pSession.DB(name), &pUser)
 		if err != nil {
-			glog.V(3).Info(err)
+			logger.V(3).Info(err)
 			return nil, err
 		}
 	}
@@ -196,36 +321,288 @@ func (provider MongodbProvider) Provision(Id string, plan *ProviderPlan, Owner s
 func (provider MongodbProvider) Deprovision(instance *Instance, takeSnapshot bool) error {
 	var settings MongodbProviderPlanSettings
 
-	glog.V(3).Infof("[m.Deprovision] start instance: %s\n", instance.Id)
+	logger.V(3).Infof("[m.Deprovision] start instance: %s\n", instance.Id)
 
 	if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &settings); err != nil {
 		return err
 	}
 
-	rSession, err := connectToMongoDb(settings.MasterUri)
+	rSession, err := provider.connect(settings)
 	if err != nil {
 		return err
 	}
 	defer rSession.Close()
 
-	err = rSession.DB(instance.Name).RemoveUser(instance.Username)
+	err = provider.traced("dropUser", instance.Name, func() error {
+		return rSession.DB(instance.Name).RemoveUser(instance.Username)
+	})
 	if err != nil {
-		glog.Errorf("error removing user: %s", instance.Username)
+		logger.Errorf("error removing user: %s", instance.Username)
 		return err
 	}
 
-	err = rSession.DB(instance.Name).DropDatabase()
+	err = provider.dropDatabase(rSession.DB(instance.Name))
 	if err != nil {
-		glog.Errorf("error dropping: %s", instance.Name)
+		logger.Errorf("error dropping: %s", instance.Name)
 		return err
 	}
 
 	return err
 }
 
+// Modify moves an instance to a plan on the same cluster, nothing about the
+// database changes. Plans on other clusters are not supported.
 func (provider MongodbProvider) Modify(instance *Instance, plan *ProviderPlan) (*Instance, error) {
-	return nil,
-		errors.New("This feature is not available on this plan.")
+	if provider.Cluster(instance.Plan) == "" || provider.Cluster(instance.Plan) != provider.Cluster(plan) {
+		return nil,
+			errors.New("This feature is not available on this plan.")
+	}
+	newInstance, err := provider.GetInstance(instance.Name, plan)
+	if err != nil {
+		return nil, err
+	}
+	newInstance.Id = instance.Id
+	newInstance.Username = instance.Username
+	newInstance.Password = instance.Password
+	newInstance.Endpoint = instance.Endpoint
+	newInstance.Status = instance.Status
+	newInstance.Parameters = instance.Parameters
+	return newInstance, nil
+}
+
+// quotaExceededRole lets a user read and remove data but not add any, users over
+// the storage quota of their plan are given it in place of readWrite.
+const quotaExceededRole = "quotaExceeded"
+
+// RestrictStorage stops the instances user from writing (but not from removing)
+// data, or gives it back its usual roles.
+func (provider MongodbProvider) RestrictStorage(instance *Instance, restrict bool) error {
+	var settings MongodbProviderPlanSettings
+	if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+	pSession, err := provider.connect(settings)
+	if err != nil {
+		return err
+	}
+	defer pSession.Close()
+	db := pSession.DB(instance.Name)
+
+	if !restrict {
+		return provider.upsertUser(db, &mgo.User{Username: instance.Username, Roles: []mgo.Role{mgo.RoleReadWrite, mgo.RoleDBAdmin}})
+	}
+	privileges := []bson.M{{
+		"resource": bson.M{"db": instance.Name, "collection": ""},
+		"actions":  []string{"find", "remove", "dropCollection", "dropIndex", "listCollections", "listIndexes", "collStats", "dbStats"},
+	}}
+	err = provider.run(db, "createRole", bson.D{{Name: "createRole", Value: quotaExceededRole}, {Name: "privileges", Value: privileges}, {Name: "roles", Value: []string{}}}, nil)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+	return provider.upsertUser(db, &mgo.User{Username: instance.Username, Roles: []mgo.Role{quotaExceededRole}})
+}
+
+// Maintain moves a database onto the cluster of the plans current maintenance
+// version, the user (and its billing code) and every collection with its indexes
+// are copied over. The user can only read from the old cluster while it is being
+// copied so no writes are lost. The copy on the old cluster is left alone so the
+// move can be retried, it is removed once the instance has been updated.
+func (provider MongodbProvider) Maintain(instance *Instance, plan *ProviderPlan) (*Instance, error) {
+	var from, to MongodbProviderPlanSettings
+
+	logger.Infof("[m.Maintain] start instance: %s, version: %s\n", instance.Id, plan.MaintenanceVersion())
+
+	if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &from); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(plan.providerPrivateDetails), &to); err != nil {
+		return nil, err
+	}
+	if from.MasterHost() == to.MasterHost() {
+		// the cluster was upgraded in place, there is nothing to move.
+		return provider.maintainedInstance(instance, plan)
+	}
+
+	fSession, err := provider.connect(from)
+	if err != nil {
+		return nil, err
+	}
+	defer fSession.Close()
+	tSession, err := provider.connect(to)
+	if err != nil {
+		return nil, err
+	}
+	defer tSession.Close()
+
+	var usersInfo struct {
+		Users []struct {
+			CustomData InfoData `bson:"customData"`
+		} `bson:"users"`
+	}
+	if err = provider.run(fSession.DB(instance.Name), "usersInfo", bson.D{{Name: "usersInfo", Value: instance.Username}}, &usersInfo); err != nil {
+		return nil, err
+	}
+	customData := InfoData{DatabaseName: instance.Name}
+	if len(usersInfo.Users) > 0 {
+		customData = usersInfo.Users[0].CustomData
+	}
+
+	source := fSession.DB(instance.Name)
+	target := tSession.DB(instance.Name)
+	// anything left from an earlier attempt is copied again.
+	if err = provider.dropDatabase(target); err != nil {
+		return nil, err
+	}
+	err = provider.upsertUser(target, &mgo.User{
+		Username:   instance.Username,
+		Password:   instance.Password,
+		Roles:      []mgo.Role{mgo.RoleReadWrite, mgo.RoleDBAdmin},
+		CustomData: customData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly := mgo.User{Username: instance.Username, Roles: []mgo.Role{mgo.RoleRead}}
+	if err = provider.upsertUser(source, &readOnly); err != nil {
+		return nil, err
+	}
+	err = provider.traced("copyCollections", instance.Name, func() error {
+		return copyMongoDbCollections(source, target)
+	})
+	if err != nil {
+		readWrite := mgo.User{Username: instance.Username, Roles: []mgo.Role{mgo.RoleReadWrite, mgo.RoleDBAdmin}}
+		if rerr := provider.upsertUser(source, &readWrite); rerr != nil {
+			logger.Errorf("[m.Maintain] unable to give %s write access again on %s: %s\n", instance.Username, instance.Name, rerr.Error())
+		}
+		return nil, err
+	}
+
+	newInstance, err := provider.maintainedInstance(instance, plan)
+	if err != nil {
+		return nil, err
+	}
+	// the profiler level and the networks the user may connect from are settings of
+	// the old cluster, they are applied on the new one as well.
+	if err = provider.UpdateParameters(newInstance, instance.Parameters); err != nil {
+		return nil, err
+	}
+	return newInstance, nil
+}
+
+// maintainedInstance is the instance on the plan at its maintenance version, what
+// the broker keeps about it (rather than the cluster) is carried over.
+func (provider MongodbProvider) maintainedInstance(instance *Instance, plan *ProviderPlan) (*Instance, error) {
+	newInstance, err := provider.GetInstance(instance.Name, plan)
+	if err != nil {
+		return nil, err
+	}
+	newInstance.Id = instance.Id
+	newInstance.Username = instance.Username
+	newInstance.Password = instance.Password
+	newInstance.Status = instance.Status
+	newInstance.Parameters = instance.Parameters
+	return newInstance, nil
+}
+
+func copyMongoDbCollections(source *mgo.Database, target *mgo.Database) error {
+	names, err := source.CollectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") {
+			continue
+		}
+		logger.V(3).Infof("[m.Maintain] copying collection: %s.%s\n", source.Name, name)
+		if err = copyMongoDbCollection(source.C(name), target.C(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyMongoDbCollection(source *mgo.Collection, target *mgo.Collection) error {
+	indexes, err := source.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.Name == "_id_" {
+			continue
+		}
+		if err = target.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+
+	iter := source.Find(nil).Iter()
+	batch := make([]interface{}, 0, 1000)
+	var doc bson.Raw
+	for iter.Next(&doc) {
+		batch = append(batch, doc)
+		doc = bson.Raw{}
+		if len(batch) == cap(batch) {
+			if err = target.Insert(batch...); err != nil {
+				iter.Close()
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return target.Insert(batch...)
+	}
+	return nil
+}
+
+// UpdateParameters applies the parameters of an instance that mongodb has a
+// setting for, the profiler level of the database and the networks its user may
+// connect from. Everything else is only kept by the broker.
+func (provider MongodbProvider) UpdateParameters(instance *Instance, parameters map[string]interface{}) error {
+	var settings MongodbProviderPlanSettings
+
+	logger.V(3).Infof("[m.UpdateParameters] start instance: %s\n", instance.Id)
+
+	if err := json.Unmarshal([]byte(instance.Plan.providerPrivateDetails), &settings); err != nil {
+		return err
+	}
+
+	pSession, err := provider.connect(settings)
+	if err != nil {
+		return err
+	}
+	defer pSession.Close()
+	db := pSession.DB(instance.Name)
+
+	level := 0
+	if value, ok := parameters["profiler_level"].(float64); ok {
+		level = int(value)
+	}
+	if err = provider.run(db, "profile", bson.D{{Name: "profile", Value: level}}, nil); err != nil {
+		logger.Errorf("error setting profiler level of: %s", instance.Name)
+		return err
+	}
+
+	// authentication restrictions need mongodb 3.6, leave them alone unless they are
+	// (or were) asked for.
+	_, had := instance.Parameters["allowed_cidrs"]
+	cidrs, has := parameters["allowed_cidrs"].([]interface{})
+	if !had && !has {
+		return nil
+	}
+	restrictions := []bson.M{}
+	if len(cidrs) > 0 {
+		restrictions = append(restrictions, bson.M{"clientSource": cidrs})
+	}
+	if err = provider.run(db, "updateUser", bson.D{{Name: "updateUser", Value: instance.Username}, {Name: "authenticationRestrictions", Value: restrictions}}, nil); err != nil {
+		logger.Errorf("error restricting networks of user: %s", instance.Username)
+		return err
+	}
+	return nil
 }
 
 func (provider MongodbProvider) Tag(Instance *Instance, Name string, Value string) error {
@@ -1,8 +1,8 @@
 package broker
 
 import (
+	"encoding/json"
 	"errors"
-	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 )
 
@@ -27,6 +27,40 @@ type ProviderPlan struct {
 	ID                     string    `json:"id"`
 	Scheme                 string    `json:"scheme"`
 	preprovision           int       `json:"preprovision"`
+	serviceId              string    `json:"-"`
+	version                string    `json:"-"`
+	maxStorageSize         int64     `json:"-"`
+}
+
+// MaintenanceVersion is the maintenance_info.version the plan advertises, it is
+// the engine version of the plan.
+func (p *ProviderPlan) MaintenanceVersion() string {
+	return p.version
+}
+
+// atMaintenanceVersion is the plan as it was at an older maintenance version.
+// When the cluster a plan is on is replaced the settings of the old one are kept
+// in the provider private details under "versions", keyed by the version, so
+// instances that have not been moved yet still use the old cluster.
+func (p *ProviderPlan) atMaintenanceVersion(version string) *ProviderPlan {
+	if version == "" || version == p.version {
+		return p
+	}
+	var details struct {
+		Versions map[string]json.RawMessage `json:"versions"`
+	}
+	if err := json.Unmarshal([]byte(p.providerPrivateDetails), &details); err != nil {
+		logger.Errorf("Unable to unmarshal the provider private details of plan %s: %s\n", p.ID, err.Error())
+		return p
+	}
+	settings, ok := details.Versions[version]
+	if !ok {
+		return p
+	}
+	plan := *p
+	plan.providerPrivateDetails = string(settings)
+	plan.version = version
+	return &plan
 }
 
 type Provider interface {
@@ -34,6 +68,8 @@ type Provider interface {
 	Provision(string, *ProviderPlan, string) (*Instance, error)
 	Deprovision(*Instance, bool) error
 	Modify(*Instance, *ProviderPlan) (*Instance, error)
+	Maintain(*Instance, *ProviderPlan) (*Instance, error)
+	UpdateParameters(*Instance, map[string]interface{}) error
 	Tag(*Instance, string, string) error
 	Untag(*Instance, string) error
 	PerformPostProvision(*Instance) (*Instance, error)
@@ -41,9 +77,13 @@ type Provider interface {
 }
 
 func GetProviderByPlan(namePrefix string, plan *ProviderPlan) (Provider, error) {
-	glog.V(4).Infof("[GetProviderByPlan] start ")
+	logger.V(4).Infof("[GetProviderByPlan] start ")
 	if plan.Provider == MongoDBInstance {
-		return NewMongodbProvider(namePrefix)
+		provider, err := NewMongodbProvider(namePrefix)
+		if err != nil {
+			return nil, err
+		}
+		return instrumentedProvider{Provider: provider}, nil
 	} else {
 		return nil, errors.New("Unable to find provider for plan.")
 	}
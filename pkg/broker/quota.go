@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+)
+
+// QuotaState is where an instance is against the storage quota of its plan.
+type QuotaState string
+
+const (
+	QuotaOk QuotaState = ""
+	// QuotaWarned instances are over the soft limit, their owner has been told.
+	QuotaWarned QuotaState = "warned"
+	// QuotaRestricted instances are over the hard limit, their user may only read
+	// and remove data until they are back under it.
+	QuotaRestricted QuotaState = "restricted"
+)
+
+// quotaWarningRatio is the share of the plans maximum storage size at which the
+// owner is warned.
+const quotaWarningRatio = 0.8
+
+// StorageRestrictor is implemented by providers that can stop an instance from
+// growing, restricted instances can still be read and have data removed.
+type StorageRestrictor interface {
+	RestrictStorage(*Instance, bool) error
+}
+
+// MaxStorageSize is the most storage (in bytes) instances on the plan may use, 0
+// is no limit.
+func (p *ProviderPlan) MaxStorageSize() int64 {
+	return p.maxStorageSize
+}
+
+// storageUsed is the disk an instance takes, its collections and indexes.
+func storageUsed(sample *UsageSample) int64 {
+	return sample.StorageSize + sample.IndexSize
+}
+
+func quotaStateFor(used int64, limit int64) QuotaState {
+	if limit <= 0 {
+		return QuotaOk
+	}
+	if used >= limit {
+		return QuotaRestricted
+	}
+	if float64(used) >= float64(limit)*quotaWarningRatio {
+		return QuotaWarned
+	}
+	return QuotaOk
+}
+
+// quotaEvent is the event telling the owner an instance moved between states,
+// dropping from warned back under the soft limit is not worth an event.
+func quotaEvent(from QuotaState, to QuotaState) string {
+	switch {
+	case to == QuotaRestricted:
+		return QuotaExceededEvent
+	case from == QuotaRestricted:
+		return QuotaRestoredEvent
+	case to == QuotaWarned:
+		return QuotaWarningEvent
+	}
+	return ""
+}
+
+// EnforceQuota compares the storage an instance uses with the limit of its plan,
+// restricting it at the hard limit and lifting the restriction once it is under
+// the limit again (or on a plan with a larger one).
+func EnforceQuota(provider Provider, storage Storage, instance *Instance, current QuotaState, sample *UsageSample) error {
+	used, limit := storageUsed(sample), instance.Plan.MaxStorageSize()
+	state := quotaStateFor(used, limit)
+	if state == current {
+		return nil
+	}
+	restrictor, ok := unwrapProvider(provider).(StorageRestrictor)
+	if !ok {
+		return nil
+	}
+	if state == QuotaRestricted || current == QuotaRestricted {
+		if err := restrictor.RestrictStorage(instance, state == QuotaRestricted); err != nil {
+			return err
+		}
+	}
+	instanceLogger(logger, instance).Infof("Instance %s uses %d of %d bytes, its quota state is now %q (was %q)\n", instance.Id, used, limit, state, current)
+	return storage.UpdateQuotaState(instance.Id, state, quotaEvent(current, state), map[string]interface{}{
+		"instance_id":      instance.Id,
+		"plan_id":          instance.Plan.ID,
+		"storage_used":     used,
+		"max_storage_size": limit,
+		"state":            string(state),
+	})
+}
+
+// reapplyQuota restricts an instance that is over the quota of its plan again,
+// e.g., after it moved to another cluster where its user has the usual roles.
+func reapplyQuota(provider Provider, storage Storage, instance *Instance) error {
+	entry, err := storage.GetInstance(instance.Id)
+	if err != nil {
+		return err
+	}
+	if entry.QuotaState != QuotaRestricted {
+		return nil
+	}
+	restrictor, ok := unwrapProvider(provider).(StorageRestrictor)
+	if !ok {
+		return nil
+	}
+	return restrictor.RestrictStorage(instance, true)
+}
+
+// CheckQuota collects the usage of an instance and enforces the quota of its
+// plan right away, e.g., after it moved to a larger plan. The calls to the
+// provider are traced as part of the context.
+func CheckQuota(ctx context.Context, namePrefix string, storage Storage, instance *Instance) error {
+	entry, err := storage.GetInstance(instance.Id)
+	if err != nil {
+		return err
+	}
+	provider, err := GetProviderByPlan(namePrefix, instance.Plan)
+	if err != nil {
+		return err
+	}
+	provider = withProviderContext(provider, ctx)
+	collector, ok := unwrapProvider(provider).(UsageCollector)
+	if !ok {
+		return nil
+	}
+	sample, err := collector.Usage(instance)
+	if err != nil {
+		return err
+	}
+	return EnforceQuota(provider, storage, instance, entry.QuotaState, sample)
+}
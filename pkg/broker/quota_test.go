@@ -0,0 +1,107 @@
+package broker
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type fakeQuotaStorage struct {
+	Storage
+	state QuotaState
+	event string
+}
+
+func (s *fakeQuotaStorage) UpdateQuotaState(Id string, state QuotaState, eventType string, data map[string]interface{}) error {
+	s.state = state
+	s.event = eventType
+	return nil
+}
+
+func (s *fakeQuotaStorage) GetInstance(Id string) (*Entry, error) {
+	return &Entry{Id: Id, QuotaState: s.state}, nil
+}
+
+type fakeRestrictingProvider struct {
+	Provider
+	restricted bool
+	calls      int
+}
+
+func (p *fakeRestrictingProvider) RestrictStorage(instance *Instance, restrict bool) error {
+	p.restricted = restrict
+	p.calls++
+	return nil
+}
+
+func TestQuotaStateFor(t *testing.T) {
+	Convey("Given a plan with a storage quota of 1000 bytes", t, func() {
+		So(quotaStateFor(100, 1000), ShouldEqual, QuotaOk)
+		So(quotaStateFor(800, 1000), ShouldEqual, QuotaWarned)
+		So(quotaStateFor(1000, 1000), ShouldEqual, QuotaRestricted)
+		So(quotaStateFor(1000000, 0), ShouldEqual, QuotaOk)
+	})
+}
+
+func TestEnforceQuota(t *testing.T) {
+	Convey("Given an instance on a plan with a storage quota", t, func() {
+		storage := &fakeQuotaStorage{}
+		provider := &fakeRestrictingProvider{}
+		instance := &Instance{Id: "a", Plan: &ProviderPlan{ID: "shared", maxStorageSize: 1000}}
+		enforce := func(used int64) {
+			So(EnforceQuota(instrumentedProvider{Provider: provider}, storage, instance, storage.state, &UsageSample{StorageSize: used - 100, IndexSize: 100}), ShouldBeNil)
+		}
+
+		Convey("The owner is warned at the soft limit", func() {
+			enforce(850)
+			So(storage.state, ShouldEqual, QuotaWarned)
+			So(storage.event, ShouldEqual, QuotaWarningEvent)
+			So(provider.calls, ShouldEqual, 0)
+
+			Convey("And the user restricted at the hard limit until usage drops", func() {
+				enforce(1200)
+				So(storage.state, ShouldEqual, QuotaRestricted)
+				So(storage.event, ShouldEqual, QuotaExceededEvent)
+				So(provider.restricted, ShouldBeTrue)
+
+				enforce(1100)
+				So(provider.calls, ShouldEqual, 1)
+
+				enforce(900)
+				So(storage.state, ShouldEqual, QuotaWarned)
+				So(storage.event, ShouldEqual, QuotaRestoredEvent)
+				So(provider.restricted, ShouldBeFalse)
+			})
+		})
+
+		Convey("A larger plan lifts the restriction", func() {
+			enforce(1200)
+			So(provider.restricted, ShouldBeTrue)
+			instance.Plan = &ProviderPlan{ID: "dedicated", maxStorageSize: 100000}
+			enforce(1200)
+			So(storage.state, ShouldEqual, QuotaOk)
+			So(storage.event, ShouldEqual, QuotaRestoredEvent)
+			So(provider.restricted, ShouldBeFalse)
+		})
+	})
+}
+
+func TestReapplyQuota(t *testing.T) {
+	Convey("Given an instance that moved to another cluster", t, func() {
+		storage := &fakeQuotaStorage{}
+		provider := &fakeRestrictingProvider{}
+		instance := &Instance{Id: "a", Plan: &ProviderPlan{ID: "shared", maxStorageSize: 1000}}
+
+		Convey("It is restricted again if it was over its quota", func() {
+			storage.state = QuotaRestricted
+			So(reapplyQuota(instrumentedProvider{Provider: provider}, storage, instance), ShouldBeNil)
+			So(provider.calls, ShouldEqual, 1)
+			So(provider.restricted, ShouldBeTrue)
+		})
+
+		Convey("It is left alone otherwise", func() {
+			storage.state = QuotaWarned
+			So(reapplyQuota(instrumentedProvider{Provider: provider}, storage, instance), ShouldBeNil)
+			So(provider.calls, ShouldEqual, 0)
+		})
+	})
+}
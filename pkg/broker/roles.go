@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/shawn-hurley/osb-broker-k8s-lib/middleware"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Permission is what an extension action or admin endpoint needs the caller to
+// be allowed to do.
+type Permission string
+
+const (
+	ReadPermission              Permission = "read"
+	RedeliverWebhooksPermission Permission = "redeliver-webhooks"
+	RotateCredentialsPermission Permission = "rotate-credentials"
+	RestorePermission           Permission = "restore"
+	KillOperationsPermission    Permission = "kill-operations"
+	ManageTasksPermission       Permission = "manage-tasks"
+	ReadAuditPermission         Permission = "read-audit"
+	ReadUsagePermission         Permission = "read-usage"
+)
+
+// Roles are the permissions each role has, anything destructive is limited to
+// operators. Billing may only read usage.
+var Roles = map[string][]Permission{
+	"viewer":    {ReadPermission},
+	"developer": {ReadPermission, RedeliverWebhooksPermission, RotateCredentialsPermission},
+	"operator":  {ReadPermission, RedeliverWebhooksPermission, RotateCredentialsPermission, RestorePermission, KillOperationsPermission, ManageTasksPermission, ReadAuditPermission, ReadUsagePermission},
+	"billing":   {ReadUsagePermission},
+}
+
+// Principal is who made a request, a credential set (kind basic) or a kubernetes
+// user (kind kubernetes), scope is the scope of the credential set.
+type Principal struct {
+	Kind   string
+	Name   string
+	Groups []string
+	Scope  CredentialScope
+}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, principal Principal) *http.Request {
+	if actor, ok := r.Context().Value(auditActorKey{}).(*Principal); ok {
+		// the audit middleware runs before authentication, tell it who it was.
+		*actor = principal
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// PrincipalFromRequest is who made the request, if they were authenticated.
+func PrincipalFromRequest(r *http.Request) (Principal, bool) {
+	principal, ok := r.Context().Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// subjects are the names a principal can be bound to roles by.
+func (p Principal) subjects() []string {
+	if p.Kind == "kubernetes" {
+		subjects := []string{"user:" + p.Name}
+		for _, group := range p.Groups {
+			subjects = append(subjects, "group:"+group)
+		}
+		return subjects
+	}
+	return []string{"basic:" + p.Name}
+}
+
+// RoleBindings map principals to roles, subjects are basic:<credential set name>,
+// user:<kubernetes username> or group:<kubernetes group>.
+type RoleBindings struct {
+	bindings map[string][]string
+}
+
+// ParseRoleBindings reads comma separated subject=role pairs.
+func ParseRoleBindings(value string) (*RoleBindings, error) {
+	rb := &RoleBindings{bindings: make(map[string][]string)}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Role bindings must be of the form subject=role")
+		}
+		if _, ok := Roles[parts[1]]; !ok {
+			return nil, errors.New("The role binding " + pair + " is for an unknown role, it must be viewer, developer, operator or billing")
+		}
+		if !strings.HasPrefix(parts[0], "basic:") && !strings.HasPrefix(parts[0], "user:") && !strings.HasPrefix(parts[0], "group:") {
+			return nil, errors.New("The role binding " + pair + " must be for a basic:, user: or group: subject")
+		}
+		rb.bindings[parts[0]] = append(rb.bindings[parts[0]], parts[1])
+	}
+	return rb, nil
+}
+
+func roleBindingsFromOptions(o Options) (*RoleBindings, error) {
+	if o.RoleBindings == "" && os.Getenv("ROLE_BINDINGS") != "" {
+		o.RoleBindings = os.Getenv("ROLE_BINDINGS")
+	}
+	if o.RoleBindings == "" {
+		logger.Infof("No role bindings were specified, every authenticated caller may use every action.\n")
+		return nil, nil
+	}
+	return ParseRoleBindings(o.RoleBindings)
+}
+
+func (rb *RoleBindings) Allows(principal Principal, permission Permission) bool {
+	for _, subject := range principal.subjects() {
+		for _, role := range rb.bindings[subject] {
+			for _, p := range Roles[role] {
+				if p == permission {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func Forbidden(description string) error {
+	return osb.HTTPStatusCodeError{
+		StatusCode:  http.StatusForbidden,
+		Description: &description,
+	}
+}
+
+// Authorize checks the caller of a request has a permission, without role
+// bindings every caller has every permission.
+func (rb *RoleBindings) Authorize(r *http.Request, permission Permission) error {
+	if rb == nil {
+		return nil
+	}
+	principal, ok := PrincipalFromRequest(r)
+	if !ok {
+		return Forbidden("This requires the " + string(permission) + " permission.")
+	}
+	if !rb.Allows(principal, permission) {
+		logger.Infof("Denied %s %s to %s %s, it requires the %s permission\n", r.Method, r.URL.Path, principal.Kind, principal.Name, permission)
+		return Forbidden("This requires the " + string(permission) + " permission.")
+	}
+	return nil
+}
+
+// PrincipalAuthorizer is a kubernetes subject access review authorizer that also
+// records the user on the request so their roles can be checked, the token
+// review middleware passes the request it authorized on to the router.
+type PrincipalAuthorizer struct {
+	middleware.UserInfoAuthorizer
+}
+
+func (a PrincipalAuthorizer) Authorize(u authenticationv1.UserInfo, r *http.Request) (middleware.Decision, error) {
+	decision, err := a.UserInfoAuthorizer.Authorize(u, r)
+	if err == nil && decision == middleware.DecisionAllowed {
+		*r = *withPrincipal(r, Principal{Kind: "kubernetes", Name: u.Username, Groups: u.Groups})
+	}
+	return decision, err
+}
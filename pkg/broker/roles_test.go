@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoleBindings(t *testing.T) {
+	Convey("Given role bindings", t, func() {
+		roles, err := ParseRoleBindings("basic:platform=developer, user:jane=operator, group:support=viewer")
+		So(err, ShouldBeNil)
+
+		Convey("Principals have the permissions of their roles", func() {
+			So(roles.Allows(Principal{Kind: "basic", Name: "platform"}, RotateCredentialsPermission), ShouldBeTrue)
+			So(roles.Allows(Principal{Kind: "basic", Name: "platform"}, RestorePermission), ShouldBeFalse)
+			So(roles.Allows(Principal{Kind: "kubernetes", Name: "jane"}, KillOperationsPermission), ShouldBeTrue)
+			So(roles.Allows(Principal{Kind: "kubernetes", Name: "joe", Groups: []string{"support"}}, ReadPermission), ShouldBeTrue)
+			So(roles.Allows(Principal{Kind: "kubernetes", Name: "joe", Groups: []string{"support"}}, RedeliverWebhooksPermission), ShouldBeFalse)
+			So(roles.Allows(Principal{Kind: "basic", Name: "jane"}, ReadPermission), ShouldBeFalse)
+		})
+
+		Convey("Unknown roles and subjects are refused", func() {
+			_, err := ParseRoleBindings("basic:platform=root")
+			So(err, ShouldNotBeNil)
+			_, err = ParseRoleBindings("platform=viewer")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Actions are limited to callers with their permission", func() {
+			b := &BusinessLogic{}
+			b.roles = roles
+			b.AddActions("restore", "restore", "POST", RestorePermission, func(string, map[string]string, *broker.RequestContext) (interface{}, error) {
+				return nil, nil
+			})
+			router := mux.NewRouter()
+			b.RouteActions(router)
+			call := func(principal *Principal) int {
+				r := httptest.NewRequest("POST", "/v2/service_instances/i1/actions/restore", nil)
+				if principal != nil {
+					r = withPrincipal(r, *principal)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				return w.Code
+			}
+			So(call(nil), ShouldEqual, http.StatusForbidden)
+			So(call(&Principal{Kind: "basic", Name: "platform"}), ShouldEqual, http.StatusForbidden)
+			So(call(&Principal{Kind: "kubernetes", Name: "jane"}), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Admin endpoints are limited to operators", func() {
+			credentials, _ := credentialsFromOptions(Options{AdminCredentials: "jane:secret,platform:secret"})
+			roles, _ := ParseRoleBindings("basic:jane=operator,basic:platform=developer")
+			b := &BusinessLogic{credentials: credentials}
+			b.roles = roles
+			call := func(user string) int {
+				r := httptest.NewRequest("GET", "/admin/audit", nil)
+				r.SetBasicAuth(user, "secret")
+				w := httptest.NewRecorder()
+				_, ok := b.authorizeAdmin(w, r, ReadAuditPermission)
+				if ok {
+					return http.StatusOK
+				}
+				return w.Code
+			}
+			So(call("jane"), ShouldEqual, http.StatusOK)
+			So(call("platform"), ShouldEqual, http.StatusForbidden)
+			So(call("nobody"), ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
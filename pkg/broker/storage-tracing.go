@@ -0,0 +1,360 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedStorage traces every call to the storage it wraps as a child of the span
+// of its context, e.g., the request or task it is made for.
+type tracedStorage struct {
+	Storage
+	ctx context.Context
+}
+
+// traceStorage is the storage with its calls traced as part of the context.
+func traceStorage(ctx context.Context, storage Storage) Storage {
+	if traced, ok := storage.(tracedStorage); ok {
+		storage = traced.Storage
+	}
+	return tracedStorage{Storage: storage, ctx: ctx}
+}
+
+func (s tracedStorage) start(method string) trace.Span {
+	_, span := tracer().Start(s.ctx, "Storage."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation.name", method)))
+	return span
+}
+
+func (s tracedStorage) GetPlans(serviceId string) ([]ProviderPlan, error) {
+	span := s.start("GetPlans")
+	result, err := s.Storage.GetPlans(serviceId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetPlanByID(planId string) (*ProviderPlan, error) {
+	span := s.start("GetPlanByID")
+	result, err := s.Storage.GetPlanByID(planId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetInstance(Id string) (*Entry, error) {
+	span := s.start("GetInstance")
+	result, err := s.Storage.GetInstance(Id)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) AddInstance(Instance *Instance) error {
+	span := s.start("AddInstance")
+	err := s.Storage.AddInstance(Instance)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) DeleteInstance(Instance *Instance) error {
+	span := s.start("DeleteInstance")
+	err := s.Storage.DeleteInstance(Instance)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) UpdateInstance(Instance *Instance, PlanId string) error {
+	span := s.start("UpdateInstance")
+	err := s.Storage.UpdateInstance(Instance, PlanId)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) UpdateInstanceParameters(Id string, parameters map[string]interface{}) error {
+	span := s.start("UpdateInstanceParameters")
+	err := s.Storage.UpdateInstanceParameters(Id, parameters)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) AddTask(Id string, action TaskAction, metadata string) (string, error) {
+	span := s.start("AddTask")
+	result, err := s.Storage.AddTask(Id, action, metadata)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) AddDelayedTask(Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
+	span := s.start("AddDelayedTask")
+	result, err := s.Storage.AddDelayedTask(Id, action, metadata, delay)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) AddTaskForRequest(origin TaskOrigin, Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
+	span := s.start("AddTaskForRequest")
+	result, err := s.Storage.AddTaskForRequest(origin, Id, action, metadata, delay)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetServices() ([]osb.Service, error) {
+	span := s.start("GetServices")
+	result, err := s.Storage.GetServices()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) UpdateTask(Id string, status *string, retries *int64, metadata *string, result *string, started *time.Time, finished *time.Time) error {
+	span := s.start("UpdateTask")
+	err := s.Storage.UpdateTask(Id, status, retries, metadata, result, started, finished)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) PopPendingTask() (*Task, error) {
+	span := s.start("PopPendingTask")
+	result, err := s.Storage.PopPendingTask()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetTasks(resourceId string) ([]Task, error) {
+	span := s.start("GetTasks")
+	result, err := s.Storage.GetTasks(resourceId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetTask(resourceId string, taskId string) (*Task, error) {
+	span := s.start("GetTask")
+	result, err := s.Storage.GetTask(resourceId, taskId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetBindingTask(resourceId string, bindingId string) (*Task, error) {
+	span := s.start("GetBindingTask")
+	result, err := s.Storage.GetBindingTask(resourceId, bindingId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) InterveneInTask(Id string, intervention TaskIntervention) (*Task, error) {
+	span := s.start("InterveneInTask")
+	task, err := s.Storage.InterveneInTask(Id, intervention)
+	endSpan(span, err)
+	return task, err
+}
+
+func (s tracedStorage) AddWebhookDelivery(delivery *WebhookDelivery) error {
+	span := s.start("AddWebhookDelivery")
+	err := s.Storage.AddWebhookDelivery(delivery)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetWebhookDeliveries(resourceId string) ([]WebhookDelivery, error) {
+	span := s.start("GetWebhookDeliveries")
+	result, err := s.Storage.GetWebhookDeliveries(resourceId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) RedeliverWebhook(resourceId string, taskId string) (string, error) {
+	span := s.start("RedeliverWebhook")
+	redeliveryId, err := s.Storage.RedeliverWebhook(resourceId, taskId)
+	endSpan(span, err)
+	return redeliveryId, err
+}
+
+func (s tracedStorage) AddEvent(eventType string, subject string, data map[string]interface{}) error {
+	span := s.start("AddEvent")
+	err := s.Storage.AddEvent(eventType, subject, data)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) PopPendingEvents(limit int, lease time.Duration) ([]LifecycleEvent, error) {
+	span := s.start("PopPendingEvents")
+	result, err := s.Storage.PopPendingEvents(limit, lease)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) MarkEventDelivered(Id string) error {
+	span := s.start("MarkEventDelivered")
+	err := s.Storage.MarkEventDelivered(Id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) RescheduleEvent(Id string, delay time.Duration, lastError string) error {
+	span := s.start("RescheduleEvent")
+	err := s.Storage.RescheduleEvent(Id, delay, lastError)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) PruneEvents(retention time.Duration, undelivered bool) (int64, error) {
+	span := s.start("PruneEvents")
+	result, err := s.Storage.PruneEvents(retention, undelivered)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) AddAuditEntry(entry *AuditEntry) error {
+	span := s.start("AddAuditEntry")
+	err := s.Storage.AddAuditEntry(entry)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetAuditEntries(query AuditQuery) ([]AuditEntry, error) {
+	span := s.start("GetAuditEntries")
+	result, err := s.Storage.GetAuditEntries(query)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) RescheduleTask(Id string, retries int64, result string, delay time.Duration) error {
+	span := s.start("RescheduleTask")
+	err := s.Storage.RescheduleTask(Id, retries, result, delay)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetUnclaimedInstance(PlanId string, InstanceId string) (*Entry, error) {
+	span := s.start("GetUnclaimedInstance")
+	result, err := s.Storage.GetUnclaimedInstance(PlanId, InstanceId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) ReturnClaimedInstance(Id string) error {
+	span := s.start("ReturnClaimedInstance")
+	err := s.Storage.ReturnClaimedInstance(Id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) StartProvisioningTasks() ([]Entry, error) {
+	span := s.start("StartProvisioningTasks")
+	result, err := s.Storage.StartProvisioningTasks()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) NukeInstance(Id string) error {
+	span := s.start("NukeInstance")
+	err := s.Storage.NukeInstance(Id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) WarnOnUnfinishedTasks() {
+	span := s.start("WarnOnUnfinishedTasks")
+	s.Storage.WarnOnUnfinishedTasks()
+	span.End()
+}
+
+func (s tracedStorage) CountTasks() ([]TaskCount, error) {
+	span := s.start("CountTasks")
+	result, err := s.Storage.CountTasks()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) Ping() error {
+	span := s.start("Ping")
+	err := s.Storage.Ping()
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetLiveInstances() ([]Entry, error) {
+	span := s.start("GetLiveInstances")
+	result, err := s.Storage.GetLiveInstances()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) AddUsageSample(sample *UsageSample) error {
+	span := s.start("AddUsageSample")
+	err := s.Storage.AddUsageSample(sample)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) SetInstanceOwner(Id string, owner string) error {
+	span := s.start("SetInstanceOwner")
+	err := s.Storage.SetInstanceOwner(Id, owner)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetMeteringPeriods(from time.Time, to time.Time, owner string) ([]MeteringPeriod, error) {
+	span := s.start("GetMeteringPeriods")
+	result, err := s.Storage.GetMeteringPeriods(from, to, owner)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) UpdateQuotaState(Id string, state QuotaState, eventType string, data map[string]interface{}) error {
+	span := s.start("UpdateQuotaState")
+	err := s.Storage.UpdateQuotaState(Id, state, eventType, data)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) GetSchemaVersion() (int, error) {
+	span := s.start("GetSchemaVersion")
+	result, err := s.Storage.GetSchemaVersion()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) GetPreprovisionPools() ([]PreprovisionPool, error) {
+	span := s.start("GetPreprovisionPools")
+	result, err := s.Storage.GetPreprovisionPools()
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) IsRestoring(dbId string) (bool, error) {
+	span := s.start("IsRestoring")
+	result, err := s.Storage.IsRestoring(dbId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) IsUpgrading(dbId string) (bool, error) {
+	span := s.start("IsUpgrading")
+	result, err := s.Storage.IsUpgrading(dbId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) IsDeleting(dbId string) (bool, error) {
+	span := s.start("IsDeleting")
+	result, err := s.Storage.IsDeleting(dbId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) WasDeleted(dbId string) (bool, error) {
+	span := s.start("WasDeleted")
+	result, err := s.Storage.WasDeleted(dbId)
+	endSpan(span, err)
+	return result, err
+}
+
+func (s tracedStorage) ValidateInstanceID(id string) error {
+	span := s.start("ValidateInstanceID")
+	err := s.Storage.ValidateInstanceID(id)
+	endSpan(span, err)
+	return err
+}
@@ -14,7 +14,6 @@ import (
 
 	"github.com/lib/pq"
 
-	"github.com/golang/glog"
 	_ "github.com/lib/pq"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 )
@@ -46,7 +45,9 @@ select
     plans.beta,
     plans.provider,
     plans.provider_private_details::text,
-    plans.deprecated
+    plans.deprecated,
+    coalesce(plans.update_schema::text, ''),
+    plans.max_storage_size
 from plans join services on services.service = plans.service
     where services.deleted = false and plans.deleted = false `
 
@@ -149,6 +150,8 @@ begin
         created timestamp with time zone not null default now(),
         updated timestamp with time zone not null default now()
     );
+    alter table plans add column if not exists update_schema json;
+    alter table plans add column if not exists max_storage_size bigint not null default 0;
     drop trigger if exists plans_updated on plans;
     create trigger plans_updated before update on plans for each row execute procedure mark_updated_column();
 
@@ -166,6 +169,11 @@ begin
         updated timestamp with time zone not null default now(),
         deleted bool not null default false
     );
+    alter table resources add column if not exists parameters text not null default '{}';
+    alter table resources add column if not exists maintenance_version varchar(128) not null default '';
+    alter table resources add column if not exists owner varchar(1024) not null default '';
+    alter table resources add column if not exists quota_state varchar(32) not null default '';
+    update resources set maintenance_version = plans.version from plans where plans.plan = resources.plan and resources.maintenance_version = '' and resources.status != 'provisioning';
     drop trigger if exists resources_updated on resources;
     create trigger resources_updated before update on resources for each row execute procedure mark_updated_column();
 
@@ -184,6 +192,11 @@ begin
         finished timestamp with time zone,
         deleted bool not null default false
     );
+    alter table tasks add column if not exists run_after timestamp with time zone not null default now();
+    -- the request that queued the task (or the task before it), so its logs can be tied to the request.
+    alter table tasks add column if not exists request_id varchar(1024) not null default '';
+    -- the w3c traceparent of the span that queued the task, the worker traces the task as its child.
+    alter table tasks add column if not exists trace_context varchar(1024) not null default '';
     
     if exists (SELECT NULL 
               FROM INFORMATION_SCHEMA.COLUMNS
@@ -206,6 +219,104 @@ begin
     drop trigger if exists tasks_updated on tasks;
     create trigger tasks_updated before update on tasks for each row execute procedure mark_updated_column();
 
+    create table if not exists webhook_deliveries
+    (
+        delivery uuid not null primary key,
+        task uuid references tasks("task") not null,
+        resource varchar(1024) references resources("id") not null,
+        event varchar(1024) not null,
+        url_host varchar(1024) not null default '',
+        status_code int not null default 0,
+        latency_ms int not null default 0,
+        response text not null default '',
+        error text not null default '',
+        created timestamp with time zone not null default now()
+    );
+
+    create table if not exists event_outbox
+    (
+        event uuid not null primary key,
+        type varchar(1024) not null,
+        subject varchar(1024) not null,
+        data text not null default '{}',
+        attempts int not null default 0,
+        last_error text not null default '',
+        run_after timestamp with time zone not null default now(),
+        delivered timestamp with time zone,
+        created timestamp with time zone not null default now()
+    );
+    create index if not exists event_outbox_pending on event_outbox (run_after) where delivered is null;
+
+    create table if not exists audit_log
+    (
+        audit uuid not null primary key,
+        platform varchar(1024) not null default '',
+        identity varchar(1024) not null default '',
+        origin text not null default '',
+        method varchar(16) not null,
+        path varchar(2048) not null,
+        instance varchar(1024) not null default '',
+        binding varchar(1024) not null default '',
+        parameters text not null default '{}',
+        status_code int not null,
+        latency_ms int not null default 0,
+        created timestamp with time zone not null default now()
+    );
+    create index if not exists audit_log_instance on audit_log (instance, created);
+    create index if not exists audit_log_identity on audit_log (identity, created);
+    alter table audit_log add column if not exists principal varchar(1024) not null default '';
+    alter table audit_log add column if not exists scope varchar(32) not null default '';
+
+    create table if not exists task_interventions
+    (
+        intervention uuid not null primary key,
+        task uuid references tasks("task") not null,
+        action varchar(1024) not null,
+        from_status varchar(1024) not null,
+        to_status varchar(1024) not null,
+        actor varchar(1024) not null,
+        reason text not null,
+        created timestamp with time zone not null default now()
+    );
+
+    create table if not exists usage_samples
+    (
+        resource varchar(1024) not null,
+        plan varchar(1024) not null,
+        owner varchar(1024) not null,
+        data_size bigint not null,
+        storage_size bigint not null,
+        index_size bigint not null,
+        objects bigint not null,
+        collections bigint not null,
+        collected timestamp with time zone not null default now()
+    );
+    create index if not exists usage_samples_resource_collected on usage_samples (resource, collected);
+    -- returning a claimed instance gives its resource a new id, the samples keep the old one.
+    alter table usage_samples drop constraint if exists usage_samples_resource_fkey;
+
+    create table if not exists metering_periods
+    (
+        resource varchar(1024) not null,
+        plan uuid references plans("plan") not null,
+        owner varchar(1024) not null default '',
+        started timestamp with time zone not null default now(),
+        ended timestamp with time zone
+    );
+    create index if not exists metering_periods_resource on metering_periods (resource);
+    create index if not exists metering_periods_started_ended on metering_periods (started, ended);
+    -- instances from before metering are metered from when they were created.
+    insert into metering_periods (resource, plan, owner, started, ended)
+        select id, plan, owner, created, case when deleted then updated else null end from resources
+        where claimed = true and not exists (select 1 from metering_periods where metering_periods.resource = resources.id);
+
+    create table if not exists schema_version
+    (
+        id boolean not null primary key default true check (id),
+        version int not null,
+        updated timestamp with time zone not null default now()
+    );
+
     -- populate some default services
     if (select count(*) from services) = 0 then
         insert into services 
@@ -225,6 +336,19 @@ end
 $$
 `
 
+// SchemaVersion is the version of sqlCreateScript, bump it whenever the script
+// changes so readiness can tell when the database is behind.
+const SchemaVersion = 8
+
+const sqlUpdateSchemaVersion string = `
+    insert into schema_version (id, version) values (true, $1)
+    on conflict (id) do update set version = greatest(schema_version.version, excluded.version), updated = now()
+`
+
+// Adding a value to an enum cannot happen inside of the transaction the create
+// script runs in, so it is run on its own afterwards.
+const sqlAlterTaskStatusScript string = `alter type task_status add value if not exists 'cancelled'`
+
 func cancelOnInterrupt(ctx context.Context, db *sql.DB) {
 	term := make(chan os.Signal)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
@@ -246,17 +370,46 @@ type Storage interface {
 	AddInstance(*Instance) error
 	DeleteInstance(*Instance) error
 	UpdateInstance(*Instance, string) error
+	UpdateInstanceParameters(string, map[string]interface{}) error
 	AddTask(string, TaskAction, string) (string, error)
+	AddDelayedTask(string, TaskAction, string, time.Duration) (string, error)
+	AddTaskForRequest(TaskOrigin, string, TaskAction, string, time.Duration) (string, error)
 	GetServices() ([]osb.Service, error)
 	UpdateTask(string, *string, *int64, *string, *string, *time.Time, *time.Time) error
 	PopPendingTask() (*Task, error)
+	GetTasks(string) ([]Task, error)
+	GetTask(string, string) (*Task, error)
+	GetBindingTask(string, string) (*Task, error)
+	InterveneInTask(string, TaskIntervention) (*Task, error)
+	AddWebhookDelivery(*WebhookDelivery) error
+	GetWebhookDeliveries(string) ([]WebhookDelivery, error)
+	RedeliverWebhook(string, string) (string, error)
+	AddEvent(string, string, map[string]interface{}) error
+	PopPendingEvents(int, time.Duration) ([]LifecycleEvent, error)
+	MarkEventDelivered(string) error
+	RescheduleEvent(string, time.Duration, string) error
+	PruneEvents(time.Duration, bool) (int64, error)
+	AddAuditEntry(*AuditEntry) error
+	GetAuditEntries(AuditQuery) ([]AuditEntry, error)
+	RescheduleTask(string, int64, string, time.Duration) error
 	GetUnclaimedInstance(string, string) (*Entry, error)
 	ReturnClaimedInstance(string) error
 	StartProvisioningTasks() ([]Entry, error)
 	NukeInstance(string) error
 	WarnOnUnfinishedTasks()
+	CountTasks() ([]TaskCount, error)
+	Ping() error
+	GetLiveInstances() ([]Entry, error)
+	AddUsageSample(*UsageSample) error
+	SetInstanceOwner(string, string) error
+	GetMeteringPeriods(time.Time, time.Time, string) ([]MeteringPeriod, error)
+	UpdateQuotaState(string, QuotaState, string, map[string]interface{}) error
+	GetSchemaVersion() (int, error)
+	GetPreprovisionPools() ([]PreprovisionPool, error)
 	IsRestoring(string) (bool, error)
 	IsUpgrading(string) (bool, error)
+	IsDeleting(string) (bool, error)
+	WasDeleted(string) (bool, error)
 	ValidateInstanceID(string) error
 }
 
@@ -265,27 +418,52 @@ type PostgresStorage struct {
 	db *sql.DB
 }
 
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// addEvent writes a lifecycle event to the outbox, db should be the transaction
+// that makes the change the event describes.
+func (b *PostgresStorage) addEvent(db execer, eventType string, subject string, data map[string]interface{}) error {
+	byteData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("insert into event_outbox (event, type, subject, data) values (uuid_generate_v4(), $1, $2, $3)", eventType, subject, string(byteData))
+	return err
+}
+
+func instanceEventData(Id string, PlanId string, Status string) map[string]interface{} {
+	return map[string]interface{}{"instance_id": Id, "plan_id": PlanId, "status": Status}
+}
+
 func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan, error) {
 
-	glog.V(3).Infoln("[getPlans] start")
+	logger.V(3).Infoln("[getPlans] start")
 
 	// arg could be a service ID or Plan Id
 	rows, err := b.db.Query(plansQuery+subquery, arg)
 	if err != nil {
-		glog.Errorf("GetPlans query failed: %s\n", err.Error())
+		logger.Errorf("GetPlans query failed: %s\n", err.Error())
 		return nil, err
 	}
 	defer rows.Close()
 	plans := make([]ProviderPlan, 0)
 	for rows.Next() {
-		var planId, serviceId, serviceName, name, humanName, description, engineVersion, engineType, scheme, categories, costUnits, provider, attributes, providerPrivateDetails string
+		var planId, serviceId, serviceName, name, humanName, description, engineVersion, engineType, scheme, categories, costUnits, provider, attributes, providerPrivateDetails, updateSchema string
 		var costInCents, preprovision int
+		var maxStorageSize int64
 		var beta, deprecated, installInsidePrivateNetwork, installOutsidePrivateNetwork, supportsMultipleInstallations, supportsSharing bool
 		var created, updated time.Time
 
-		err := rows.Scan(&planId, &serviceId, &serviceName, &name, &humanName, &description, &engineVersion, &engineType, &scheme, &categories, &costInCents, &costUnits, &attributes, &installInsidePrivateNetwork, &installOutsidePrivateNetwork, &supportsMultipleInstallations, &supportsSharing, &preprovision, &beta, &provider, &providerPrivateDetails, &deprecated)
+		err := rows.Scan(&planId, &serviceId, &serviceName, &name, &humanName, &description, &engineVersion, &engineType, &scheme, &categories, &costInCents, &costUnits, &attributes, &installInsidePrivateNetwork, &installOutsidePrivateNetwork, &supportsMultipleInstallations, &supportsSharing, &preprovision, &beta, &provider, &providerPrivateDetails, &deprecated, &updateSchema, &maxStorageSize)
+		if err != nil {
+			logger.Errorf("Scan from query failed: %s\n", err.Error())
+			return nil, err
+		}
+		updateParameters, err := parseUpdateSchema(updateSchema)
 		if err != nil {
-			glog.Errorf("Scan from query failed: %s\n", err.Error())
+			logger.Errorf("Unable to unmarshal the update schema of plan %s: %s\n", planId, err.Error())
 			return nil, err
 		}
 		var free = falsePtr()
@@ -295,7 +473,7 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 
 		var attributesJson map[string]interface{}
 		if err = json.Unmarshal([]byte(attributes), &attributesJson); err != nil {
-			glog.Errorf("Unable to unmarshal attributes in plans query: %s\n", err.Error())
+			logger.Errorf("Unable to unmarshal attributes in plans query: %s\n", err.Error())
 			return nil, err
 		}
 		var state = "ga"
@@ -314,6 +492,7 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 				Schemas: &osb.Schemas{
 					ServiceInstance: &osb.ServiceInstanceSchema{
 						Create: &osb.InputParametersSchema{},
+						Update: &osb.InputParametersSchema{Parameters: updateParameters},
 					},
 				},
 				Metadata: map[string]interface{}{
@@ -342,7 +521,8 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 						"type":    engineType,
 						"version": engineVersion,
 					},
-					"preprovision": preprovision,
+					"preprovision":     preprovision,
+					"max_storage_size": maxStorageSize,
 				},
 			},
 			Provider:               GetProvidersFromString(provider),
@@ -350,6 +530,9 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 			providerPrivateDetails: os.ExpandEnv(providerPrivateDetails),
 			ID:                     planId,
 			preprovision:           preprovision,
+			serviceId:              serviceId,
+			version:                engineVersion,
+			maxStorageSize:         maxStorageSize,
 		})
 	}
 	return plans, nil
@@ -358,7 +541,7 @@ func (b *PostgresStorage) getPlans(subquery string, arg string) ([]ProviderPlan,
 func (b *PostgresStorage) GetServices() ([]osb.Service, error) {
 	services := make([]osb.Service, 0)
 
-	glog.V(3).Infoln("[GetServices] start")
+	logger.V(3).Infoln("[GetServices] start")
 	rows, err := b.db.Query(servicesQuery)
 	if err != nil {
 		return nil, err
@@ -375,7 +558,7 @@ func (b *PostgresStorage) GetServices() ([]osb.Service, error) {
 
 		plans, err := b.GetPlans(service_id)
 		if err != nil {
-			glog.Errorf("Unable to get MongoDB plans: %s\n", err.Error())
+			logger.Errorf("Unable to get MongoDB plans: %s\n", err.Error())
 			return nil, InternalServerError()
 		}
 
@@ -402,7 +585,7 @@ func (b *PostgresStorage) GetServices() ([]osb.Service, error) {
 }
 
 func (b *PostgresStorage) GetPlanByID(planId string) (*ProviderPlan, error) {
-	glog.V(4).Infof("[GetPlanById] start planId: %s", planId)
+	logger.V(4).Infof("[GetPlanById] start planId: %s", planId)
 
 	plans, err := b.getPlans(" and plans.plan::varchar(1024) = $1::varchar(1024)", planId)
 	if err != nil {
@@ -420,7 +603,7 @@ func (b *PostgresStorage) GetPlans(serviceId string) ([]ProviderPlan, error) {
 
 func (b *PostgresStorage) IsUpgrading(dbId string) (bool, error) {
 	var count int64
-	err := b.db.QueryRow("select count(*) from tasks where ( status = 'started' or status = 'pending' ) and (action = 'change-providers' OR action = 'change-plans') and deleted = false and resource = $1", dbId).Scan(&count)
+	err := b.db.QueryRow("select count(*) from tasks where ( status = 'started' or status = 'pending' ) and (action = 'change-providers' OR action = 'change-plans' OR action = 'maintenance' OR action = 'update-parameters') and deleted = false and resource = $1", dbId).Scan(&count)
 	return count > 0, err
 }
 
@@ -430,15 +613,27 @@ func (b *PostgresStorage) IsRestoring(dbId string) (bool, error) {
 	return count > 0, err
 }
 
+func (b *PostgresStorage) IsDeleting(dbId string) (bool, error) {
+	var count int64
+	err := b.db.QueryRow("select count(*) from tasks where ( status = 'started' or status = 'pending' ) and action = 'delete' and deleted = false and resource = $1", dbId).Scan(&count)
+	return count > 0, err
+}
+
+func (b *PostgresStorage) WasDeleted(dbId string) (bool, error) {
+	var count int64
+	err := b.db.QueryRow("select count(*) from resources where deleted = true and id = $1", dbId).Scan(&count)
+	return count > 0, err
+}
+
 func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string) (*Entry, error) {
-	glog.V(3).Infof("[GetUnclaimedInstance] start PlandId: %s InstanceId: %s", PlanId, InstanceId)
+	logger.V(3).Infof("[GetUnclaimedInstance] start PlandId: %s InstanceId: %s", PlanId, InstanceId)
 
 	tx, err := b.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	var entry Entry
-	err = tx.QueryRow("select id, name, plan, claimed, status, username, password, endpoint from resources where claimed = false and status = 'available' and deleted = false and id != $1 and plan = $2 limit 1", InstanceId, PlanId).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint)
+	err = tx.QueryRow("select id, name, plan, claimed, status, username, password, endpoint, maintenance_version from resources where claimed = false and status = 'available' and deleted = false and id != $1 and plan = $2 limit 1", InstanceId, PlanId).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.MaintenanceVersion)
 	if err != nil && err.Error() == "sql: no rows in result set" {
 		tx.Rollback()
 		return nil, errors.New("Cannot find resource instance")
@@ -447,7 +642,7 @@ func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string)
 		return nil, err
 	}
 
-	if _, err = tx.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint) values ($1, $2, $3, true, $4, $5, $6, $7)", InstanceId, entry.Name, entry.PlanId, entry.Status, entry.Username, entry.Password, entry.Endpoint); err != nil {
+	if _, err = tx.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint, maintenance_version) values ($1, $2, $3, true, $4, $5, $6, $7, $8)", InstanceId, entry.Name, entry.PlanId, entry.Status, entry.Username, entry.Password, entry.Endpoint, entry.MaintenanceVersion); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
@@ -457,6 +652,16 @@ func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string)
 		return nil, err
 	}
 
+	if _, err = tx.Exec("update usage_samples set resource = $2 where resource = $1", entry.Id, InstanceId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if _, err = tx.Exec("insert into metering_periods (resource, plan) values ($1, $2)", InstanceId, entry.PlanId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
 	if _, err = tx.Exec("delete from resources where id = $1 and deleted = false and claimed = false", entry.Id); err != nil {
 		tx.Rollback()
 		return nil, err
@@ -465,6 +670,15 @@ func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string)
 	entry.Claimed = true
 	entry.Id = InstanceId
 
+	if err = b.addEvent(tx, ProvisionRequestedEvent, InstanceId, instanceEventData(InstanceId, entry.PlanId, entry.Status)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = b.addEvent(tx, ProvisionCompletedEvent, InstanceId, instanceEventData(InstanceId, entry.PlanId, entry.Status)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
@@ -472,24 +686,61 @@ func (b *PostgresStorage) GetUnclaimedInstance(PlanId string, InstanceId string)
 }
 
 func (b *PostgresStorage) ReturnClaimedInstance(Id string) error {
-	glog.V(4).Infof("[ReturnClaimedInstance] start Id: %s\n", Id)
-	rows, err := b.db.Exec("update resources set claimed = false, id = uuid_generate_v4()::varchar(1024) where id = $1 and status = 'available' and deleted = false and claimed = true", Id)
+	logger.V(4).Infof("[ReturnClaimedInstance] start Id: %s\n", Id)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	// the instance was never usable, so it is not metered.
+	if _, err = tx.Exec("delete from metering_periods where resource = $1 and ended is null", Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	rows, err := tx.Exec("update resources set claimed = false, id = uuid_generate_v4()::varchar(1024) where id = $1 and status = 'available' and deleted = false and claimed = true", Id)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	count, err := rows.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	if count != 1 {
+		tx.Rollback()
 		return errors.New("invalid count returned after trying to return unclaimed db " + Id)
 	}
-	return nil
+	return tx.Commit()
 }
 
 func (b *PostgresStorage) AddInstance(Instance *Instance) error {
-	_, err := b.db.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint) values ($1, $2, $3, true, $4, $5, $6, $7)", Instance.Id, Instance.Name, Instance.Plan.ID, Instance.Status, Instance.Username, Instance.Password, Instance.Endpoint)
-	return err
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	parameters, err := json.Marshal(Instance.Parameters)
+	if err != nil || Instance.Parameters == nil {
+		parameters = []byte("{}")
+	}
+	if _, err = tx.Exec("insert into resources (id, name, plan, claimed, status, username, password, endpoint, parameters, maintenance_version, owner) values ($1, $2, $3, true, $4, $5, $6, $7, $8, $9, $10)", Instance.Id, Instance.Name, Instance.Plan.ID, Instance.Status, Instance.Username, Instance.Password, Instance.Endpoint, string(parameters), Instance.Plan.MaintenanceVersion(), Instance.Owner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("insert into metering_periods (resource, plan, owner) values ($1, $2, $3)", Instance.Id, Instance.Plan.ID, Instance.Owner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = b.addEvent(tx, ProvisionRequestedEvent, Instance.Id, instanceEventData(Instance.Id, Instance.Plan.ID, Instance.Status)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if IsAvailable(Instance.Status) {
+		if err = b.addEvent(tx, ProvisionCompletedEvent, Instance.Id, instanceEventData(Instance.Id, Instance.Plan.ID, Instance.Status)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (b *PostgresStorage) NukeInstance(Id string) error {
@@ -498,19 +749,166 @@ func (b *PostgresStorage) NukeInstance(Id string) error {
 }
 
 func (b *PostgresStorage) DeleteInstance(Instance *Instance) error {
-	b.db.Exec("update tasks set deleted = true where resource = $1", Instance.Id)
-	_, err := b.db.Exec("update resources set deleted = true where id = $1", Instance.Id)
-	return err
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	// a synchronous deprovision has no delete task that recorded it was requested.
+	var requested bool
+	if err = tx.QueryRow("select exists (select 1 from tasks where resource = $1 and action = 'delete' and deleted = false)", Instance.Id).Scan(&requested); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !requested {
+		if err = b.addEvent(tx, DeprovisionRequestedEvent, Instance.Id, instanceEventData(Instance.Id, Instance.Plan.ID, Instance.Status)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("update tasks set deleted = true where resource = $1", Instance.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("update resources set deleted = true where id = $1", Instance.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("update metering_periods set ended = now() where resource = $1 and ended is null", Instance.Id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = b.addEvent(tx, DeprovisionCompletedEvent, Instance.Id, instanceEventData(Instance.Id, Instance.Plan.ID, Instance.Status)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (b *PostgresStorage) UpdateInstance(Instance *Instance, PlanId string) error {
-	_, err := b.db.Exec("update resources set plan = $1, endpoint = $2, status = $3, username = $4, password = $5, name = $6 where id = $7", PlanId, Instance.Endpoint, Instance.Status, Instance.Username, Instance.Password, Instance.Name, Instance.Id)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	var currentPlanId string
+	if err = tx.QueryRow("select plan from resources where id = $1 for update", Instance.Id).Scan(&currentPlanId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("update resources set plan = $1, endpoint = $2, status = $3, username = $4, password = $5, name = $6, maintenance_version = $8 where id = $7", PlanId, Instance.Endpoint, Instance.Status, Instance.Username, Instance.Password, Instance.Name, Instance.Id, Instance.Plan.MaintenanceVersion()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if currentPlanId != PlanId {
+		// the instance is metered on its new plan from now on.
+		if _, err = tx.Exec("update metering_periods set ended = now() where resource = $1 and ended is null", Instance.Id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("insert into metering_periods (resource, plan, owner) select id, plan, owner from resources where id = $1 and claimed = true and deleted = false", Instance.Id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateQuotaState records where an instance is against the storage quota of its
+// plan and, unless eventType is empty, the event telling its owner.
+func (b *PostgresStorage) UpdateQuotaState(Id string, state QuotaState, eventType string, data map[string]interface{}) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("update resources set quota_state = $2 where id = $1", Id, string(state)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if eventType != "" {
+		if err = b.addEvent(tx, eventType, Id, data); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetInstanceOwner records the organization an instance belongs to, e.g., when a
+// preprovisioned instance is claimed.
+func (b *PostgresStorage) SetInstanceOwner(Id string, owner string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("update resources set owner = $2 where id = $1", Id, owner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("update metering_periods set owner = $2 where resource = $1 and ended is null", Id, owner); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMeteringPeriods are the metering periods that overlap from and to (of one
+// owner unless it is empty), with the average and largest storage sampled while
+// they overlap.
+func (b *PostgresStorage) GetMeteringPeriods(from time.Time, to time.Time, owner string) ([]MeteringPeriod, error) {
+	rows, err := b.db.Query(`
+        select 
+            metering_periods.resource,
+            plans.name,
+            metering_periods.owner,
+            plans.cost_cents,
+            plans.cost_unit::text,
+            metering_periods.started,
+            metering_periods.ended,
+            coalesce(samples.average, 0)::bigint,
+            coalesce(samples.largest, 0)
+        from 
+            metering_periods join plans on plans.plan = metering_periods.plan
+            left join lateral (
+                select avg(storage_size) as average, max(storage_size) as largest from usage_samples 
+                where 
+                    usage_samples.resource = metering_periods.resource and 
+                    usage_samples.collected >= greatest(metering_periods.started, $1) and 
+                    usage_samples.collected < least(coalesce(metering_periods.ended, $2), $2)
+            ) samples on true
+        where 
+            metering_periods.started < $2 and 
+            (metering_periods.ended is null or metering_periods.ended > $1) and 
+            ($3 = '' or metering_periods.owner = $3)
+        order by metering_periods.owner, metering_periods.started
+    `, from, to, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	periods := make([]MeteringPeriod, 0)
+	for rows.Next() {
+		var period MeteringPeriod
+		if err := rows.Scan(&period.ResourceId, &period.Plan, &period.Owner, &period.CostCents, &period.CostUnit, &period.Started, &period.Ended, &period.AverageStorageSize, &period.MaxStorageSize); err != nil {
+			return nil, err
+		}
+		periods = append(periods, period)
+	}
+	return periods, rows.Err()
+}
+
+// UpdateInstanceParameters replaces the provision parameters stored with an
+// instance, e.g., when a preprovisioned instance is claimed.
+func (b *PostgresStorage) UpdateInstanceParameters(Id string, parameters map[string]interface{}) error {
+	byteData, err := json.Marshal(parameters)
+	if err != nil || parameters == nil {
+		byteData = []byte("{}")
+	}
+	_, err = b.db.Exec("update resources set parameters = $2 where id = $1 and deleted = false", Id, string(byteData))
 	return err
 }
 
 func (b *PostgresStorage) ValidateInstanceID(id string) error {
 	var count int64
-	glog.V(4).Infof("[ValidateInstanceID] start: %s\n", id)
+	logger.V(4).Infof("[ValidateInstanceID] start: %s\n", id)
 	err := b.db.QueryRow("select count(*) from resources where id = $1", id).Scan(&count)
 	if err != nil {
 		return err
@@ -535,14 +933,14 @@ func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
             services.deprecated = false
     `
 
-	glog.V(4).Infoln("[StartPrevisionTasks] begin")
+	logger.V(4).Infoln("[StartPrevisionTasks] begin")
 	rows, err := b.db.Query(sqlSelectToProvisionQuery)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	glog.V(4).Infof("[StartProvisioningTasks] %-v\n", rows)
+	logger.V(4).Infof("[StartProvisioningTasks] %-v\n", rows)
 
 	entries := make([]Entry, 0)
 
@@ -555,7 +953,7 @@ func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
 		for i := 0; i < needed; i++ {
 			var entry Entry
 			if err := b.db.QueryRow("insert into resources (id, name, plan, claimed, status, username, password, endpoint) values (uuid_generate_v4(), '', $1, false, 'provisioning', '', '', '') returning id", planId).Scan(&entry.Id); err != nil {
-				glog.Infof("Unable to insert resource entry for preprovisioning: %s\n", err.Error())
+				logger.Infof("Unable to insert resource entry for preprovisioning: %s\n", err.Error())
 			} else {
 				entry.PlanId = planId
 				entries = append(entries, entry)
@@ -563,7 +961,7 @@ func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
 		}
 	}
 
-	glog.V(4).Infoln("[StartPrevisionTasks] end")
+	logger.V(4).Infoln("[StartPrevisionTasks] end")
 
 	return entries, nil
 }
@@ -571,8 +969,8 @@ func (b *PostgresStorage) StartProvisioningTasks() ([]Entry, error) {
 func (b *PostgresStorage) GetInstance(Id string) (*Entry, error) {
 	var entry Entry
 
-	glog.V(4).Infof("[GetInstance] start: %s\n", Id)
-	err := b.db.QueryRow("select id, name, plan, claimed, status, username, password, endpoint, (select count(*) from tasks where tasks.resource=resources.id and tasks.status = 'started' and tasks.deleted = false) as tasks from resources where id = $1 and deleted = false", Id).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.Tasks)
+	logger.V(4).Infof("[GetInstance] start: %s\n", Id)
+	err := b.db.QueryRow("select id, name, plan, claimed, status, username, password, endpoint, parameters, maintenance_version, quota_state, (select count(*) from tasks where tasks.resource=resources.id and tasks.status = 'started' and tasks.deleted = false) as tasks from resources where id = $1 and deleted = false", Id).Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.Username, &entry.Password, &entry.Endpoint, &entry.Parameters, &entry.MaintenanceVersion, &entry.QuotaState, &entry.Tasks)
 
 	if err != nil && err.Error() == "sql: no rows in result set" {
 		return nil, errors.New("Cannot find resource instance")
@@ -583,27 +981,185 @@ func (b *PostgresStorage) GetInstance(Id string) (*Entry, error) {
 }
 
 func (b *PostgresStorage) AddTask(Id string, action TaskAction, metadata string) (string, error) {
+	return b.AddDelayedTask(Id, action, metadata, 0)
+}
+
+// AddDelayedTask queues a task that the worker will not pick up until the delay
+// has passed, the delay is relative to the database clock.
+func (b *PostgresStorage) AddDelayedTask(Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
+	return b.AddTaskForRequest(TaskOrigin{}, Id, action, metadata, delay)
+}
+
+// AddTaskForRequest queues a task on behalf of a request, the worker logs the
+// task with the id of the request and traces it as part of the span that queued
+// it so the two can be tied together.
+func (b *PostgresStorage) AddTaskForRequest(origin TaskOrigin, Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
 	var task_id string
-	glog.V(4).Infof("[AddTask] start: %s\n", Id)
-	return task_id, b.db.QueryRow("insert into tasks (task, resource, action, metadata) values (uuid_generate_v4(), $1, $2, $3) returning task", Id, action, metadata).Scan(&task_id)
+	logger.With("request_id", origin.RequestId).With("instance_id", Id).V(4).Infof("[AddTask] start: %s (delay: %s)\n", Id, delay)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	if err = tx.QueryRow("insert into tasks (task, resource, action, metadata, run_after, request_id, trace_context) values (uuid_generate_v4(), $1, $2, $3, now() + $4::double precision * interval '1 second', $5, $6) returning task", Id, action, metadata, delay.Seconds(), origin.RequestId, origin.TraceContext).Scan(&task_id); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if eventType, ok := taskRequestedEvent(action); ok {
+		if err = b.addEvent(tx, eventType, Id, map[string]interface{}{"instance_id": Id, "task_id": task_id, "action": action}); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+	return task_id, tx.Commit()
 }
 
+// errTaskNotStarted is returned when the outcome of a task is recorded but the task
+// is no longer started, e.g., an admin stopped or requeued it in the meantime.
+var errTaskNotStarted = errors.New("The task is no longer started, its outcome was not recorded")
+
 func (b *PostgresStorage) UpdateTask(Id string, status *string, retries *int64, metadata *string, result *string, started *time.Time, finsihed *time.Time) error {
-	glog.V(4).Infof("[UpdateTask] start: %s\n", Id)
-	_, err := b.db.Exec("update tasks set status = coalesce($2, status), retries = coalesce($3, retries), metadata = coalesce($4, metadata), result = coalesce($5, result), started = coalesce($6, started), finished = coalesce($7, finished) where task = $1", Id, status, retries, metadata, result, started, finsihed)
-	return err
+	logger.V(4).Infof("[UpdateTask] start: %s\n", Id)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	var action TaskAction
+	var resource string
+	var taskResult string
+	var claimed bool
+	err = tx.QueryRow("update tasks set status = coalesce($2, status), retries = coalesce($3, retries), metadata = coalesce($4, metadata), result = coalesce($5, result), started = coalesce($6, started), finished = coalesce($7, finished) where task = $1 and status = 'started' returning action, resource, result, coalesce((select claimed from resources where resources.id = tasks.resource), false)", Id, status, retries, metadata, result, started, finsihed).Scan(&action, &resource, &taskResult, &claimed)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		tx.Rollback()
+		return errTaskNotStarted
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Unclaimed (preprovisioned) instances are not yet anyones, so nothing is said about them.
+	if status != nil && claimed {
+		if eventType, ok := taskOutcomeEvent(action, *status); ok {
+			if err = b.addEvent(tx, eventType, resource, map[string]interface{}{"instance_id": resource, "task_id": Id, "action": action, "status": *status, "result": taskResult}); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// RescheduleTask puts a task back into the queue with its new retry count and
+// result, it will not be picked up again until the delay has passed.
+func (b *PostgresStorage) RescheduleTask(Id string, retries int64, result string, delay time.Duration) error {
+	logger.V(4).Infof("[RescheduleTask] start: %s (delay: %s)\n", Id, delay)
+	res, err := b.db.Exec("update tasks set status = 'pending', retries = $2, result = $3, run_after = now() + $4::double precision * interval '1 second' where task = $1 and status = 'started'", Id, retries, result, delay.Seconds())
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return errTaskNotStarted
+	}
+	return nil
 }
 
 func (b *PostgresStorage) WarnOnUnfinishedTasks() {
 	var amount int
 	err := b.db.QueryRow("select count(*) from tasks where status = 'started' and extract(hours from now() - started) > 24 and deleted = false").Scan(&amount)
 	if err != nil {
-		glog.Errorf("Unable to select stale tasks: %s\n", err.Error())
+		logger.Errorf("Unable to select stale tasks: %s\n", err.Error())
 		return
 	}
 	if amount < 0 {
-		glog.Errorf("WARNING: There are %d started tasks that are now over 24 hours old and have not yet finished, they may be stale.\n", amount)
+		logger.Errorf("WARNING: There are %d started tasks that are now over 24 hours old and have not yet finished, they may be stale.\n", amount)
+	}
+}
+
+// GetLiveInstances are the instances that have been provisioned and not deleted,
+// preprovisioned ones are left out until they are claimed.
+func (b *PostgresStorage) GetLiveInstances() ([]Entry, error) {
+	rows, err := b.db.Query("select id, name, plan, claimed, status, quota_state, owner from resources where deleted = false and claimed = true and name <> '' and status <> 'provisioning' order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var entry Entry
+		if err := rows.Scan(&entry.Id, &entry.Name, &entry.PlanId, &entry.Claimed, &entry.Status, &entry.QuotaState, &entry.Owner); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (b *PostgresStorage) AddUsageSample(sample *UsageSample) error {
+	return b.db.QueryRow(`
+        insert into usage_samples 
+            (resource, plan, owner, data_size, storage_size, index_size, objects, collections) 
+        values 
+            ($1, $2, $3, $4, $5, $6, $7, $8) 
+        returning collected`,
+		sample.ResourceId, sample.Plan, sample.Owner, sample.DataSize, sample.StorageSize, sample.IndexSize, sample.Objects, sample.Collections).Scan(&sample.Collected)
+}
+
+func (b *PostgresStorage) Ping() error {
+	return b.db.Ping()
+}
+
+func (b *PostgresStorage) GetSchemaVersion() (int, error) {
+	var version int
+	err := b.db.QueryRow("select version from schema_version where id = true").Scan(&version)
+	return version, err
+}
+
+func (b *PostgresStorage) CountTasks() ([]TaskCount, error) {
+	rows, err := b.db.Query("select action, status, count(*) from tasks where deleted = false group by action, status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]TaskCount, 0)
+	for rows.Next() {
+		var count TaskCount
+		if err := rows.Scan(&count.Action, &count.Status, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
 	}
+	return counts, rows.Err()
+}
+
+func (b *PostgresStorage) GetPreprovisionPools() ([]PreprovisionPool, error) {
+	rows, err := b.db.Query(`
+        select 
+            plans.name,
+            plans.preprovision,
+            coalesce(resources.status, ''),
+            count(resources.id)
+        from 
+            plans left join resources on resources.plan = plans.plan and resources.claimed = false and resources.deleted = false
+        where 
+            plans.deleted = false and 
+            (plans.preprovision > 0 or resources.id is not null)
+        group by plans.name, plans.preprovision, resources.status
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pools := make([]PreprovisionPool, 0)
+	for rows.Next() {
+		var pool PreprovisionPool
+		if err := rows.Scan(&pool.Plan, &pool.Target, &pool.Status, &pool.Count); err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, rows.Err()
 }
 
 func (b *PostgresStorage) PopPendingTask() (*Task, error) {
@@ -613,15 +1169,250 @@ func (b *PostgresStorage) PopPendingTask() (*Task, error) {
             status = 'started', 
             started = now() 
         where 
-            task in ( select task from tasks where status = 'pending' and deleted = false order by updated asc limit 1)
-        returning task, action, resource, status, retries, metadata, result, started, finished
-    `).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Started, &task.Finished)
+            task in ( select task from tasks where status = 'pending' and deleted = false and run_after <= now() order by updated asc limit 1)
+        returning task, action, resource, status, retries, metadata, result, created, updated, started, finished, run_after, request_id, trace_context
+    `).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Created, &task.Updated, &task.Started, &task.Finished, &task.RunAfter, &task.RequestId, &task.TraceContext)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (b *PostgresStorage) GetTasks(resourceId string) ([]Task, error) {
+	logger.V(4).Infof("[GetTasks] start: %s\n", resourceId)
+	rows, err := b.db.Query("select task, action, resource, status, retries, metadata, result, created, updated, started, finished, run_after, request_id, trace_context from tasks where resource = $1 and deleted = false order by created desc", resourceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		var task Task
+		if err := rows.Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Created, &task.Updated, &task.Started, &task.Finished, &task.RunAfter, &task.RequestId, &task.TraceContext); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// GetTask returns a task of a resource, even one that was deleted along with
+// the resource.
+func (b *PostgresStorage) GetTask(resourceId string, taskId string) (*Task, error) {
+	logger.V(4).Infof("[GetTask] start: %s %s\n", resourceId, taskId)
+	var task Task
+	err := b.db.QueryRow("select task, action, resource, status, retries, metadata, result, created, updated, started, finished, run_after, request_id, trace_context from tasks where resource = $1 and task::varchar(1024) = $2", resourceId, taskId).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Created, &task.Updated, &task.Started, &task.Finished, &task.RunAfter, &task.RequestId, &task.TraceContext)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Cannot find task")
+	} else if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// GetBindingTask returns the latest task that created or deleted a binding.
+func (b *PostgresStorage) GetBindingTask(resourceId string, bindingId string) (*Task, error) {
+	logger.V(4).Infof("[GetBindingTask] start: %s %s\n", resourceId, bindingId)
+	var task Task
+	err := b.db.QueryRow(`
+        select task, action, resource, status, retries, metadata, result, created, updated, started, finished, run_after, request_id, trace_context 
+        from tasks 
+        where 
+            resource = $1 and 
+            deleted = false and 
+            (case when action in ('create-binding', 'delete-binding') then metadata::json->>'binding_id' else null end) = $2 
+        order by created desc limit 1
+    `, resourceId, bindingId).Scan(&task.Id, &task.Action, &task.ResourceId, &task.Status, &task.Retries, &task.Metadata, &task.Result, &task.Created, &task.Updated, &task.Started, &task.Finished, &task.RunAfter, &task.RequestId, &task.TraceContext)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return nil, errors.New("Cannot find binding")
+	} else if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// InterveneInTask moves a task from one status to another on behalf of an
+// operator and records who did it and why, it fails if the task is not in
+// the status the intervention expects it to be in. The task is returned as
+// the intervention left it.
+func (b *PostgresStorage) InterveneInTask(Id string, intervention TaskIntervention) (*Task, error) {
+	logger.V(4).Infof("[InterveneInTask] start: %s %s by %s\n", Id, intervention.Action, intervention.Actor)
+	tx, err := b.db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	var task Task
+	err = tx.QueryRow("select task, status, action, resource, retries, metadata, request_id, trace_context from tasks where task::varchar(1024) = $1 and deleted = false for update", Id).Scan(&task.Id, &task.Status, &task.Action, &task.ResourceId, &task.Retries, &task.Metadata, &task.RequestId, &task.TraceContext)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		tx.Rollback()
+		return nil, errors.New("Cannot find task")
+	} else if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if task.Status != intervention.FromStatus {
+		tx.Rollback()
+		return nil, errors.New("Task is " + task.Status + " not " + intervention.FromStatus)
+	}
+	result := intervention.Action + " by " + intervention.Actor + ": " + intervention.Reason
+	if intervention.ToStatus == "pending" {
+		_, err = tx.Exec("update tasks set status = 'pending', retries = 0, result = $2, run_after = now(), started = null, finished = null where task = $1", Id, result)
+	} else {
+		_, err = tx.Exec("update tasks set status = $2, result = $3, finished = now() where task = $1", Id, intervention.ToStatus, result)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err = tx.Exec("insert into task_interventions (intervention, task, action, from_status, to_status, actor, reason) values (uuid_generate_v4(), $1, $2, $3, $4, $5, $6)", Id, intervention.Action, intervention.FromStatus, intervention.ToStatus, intervention.Actor, intervention.Reason); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if intervention.ToStatus == "failed" {
+		if err = b.addEvent(tx, TaskFailedEvent, task.ResourceId, map[string]interface{}{"instance_id": task.ResourceId, "task_id": Id, "action": task.Action, "status": intervention.ToStatus, "result": result}); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	task.Status = intervention.ToStatus
+	task.Result = result
 	return &task, nil
 }
 
+func (b *PostgresStorage) AddWebhookDelivery(delivery *WebhookDelivery) error {
+	logger.V(4).Infof("[AddWebhookDelivery] start: %s\n", delivery.EventId)
+	return b.db.QueryRow("insert into webhook_deliveries (delivery, task, resource, event, url_host, status_code, latency_ms, response, error) values (uuid_generate_v4(), $1, $2, $3, $4, $5, $6, $7, $8) returning delivery, created", delivery.EventId, delivery.ResourceId, delivery.Event, delivery.UrlHost, delivery.StatusCode, delivery.LatencyMs, delivery.Response, delivery.Error).Scan(&delivery.Id, &delivery.Created)
+}
+
+func (b *PostgresStorage) GetWebhookDeliveries(resourceId string) ([]WebhookDelivery, error) {
+	logger.V(4).Infof("[GetWebhookDeliveries] start: %s\n", resourceId)
+	rows, err := b.db.Query("select delivery, task, event, resource, url_host, status_code, latency_ms, response, error, created from webhook_deliveries where resource = $1 order by created desc", resourceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.Id, &delivery.EventId, &delivery.Event, &delivery.ResourceId, &delivery.UrlHost, &delivery.StatusCode, &delivery.LatencyMs, &delivery.Response, &delivery.Error, &delivery.Created); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook queues a webhook task that has finished or failed again as a
+// new task, so the event is sent with a new delivery id that receivers rejecting
+// replays do not drop. The new task is the event id of the redelivery.
+func (b *PostgresStorage) RedeliverWebhook(resourceId string, taskId string) (string, error) {
+	logger.V(4).Infof("[RedeliverWebhook] start: %s %s\n", resourceId, taskId)
+	tx, err := b.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	var status, action, metadata, requestId, traceContext string
+	err = tx.QueryRow("select status, action, metadata, request_id, trace_context from tasks where task::varchar(1024) = $1 and resource = $2 and action like 'notify-%' and deleted = false", taskId, resourceId).Scan(&status, &action, &metadata, &requestId, &traceContext)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		tx.Rollback()
+		return "", errors.New("Cannot find webhook")
+	} else if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if status != "finished" && status != "failed" {
+		tx.Rollback()
+		return "", errors.New("Webhook is " + status + " and cannot be redelivered")
+	}
+	var redeliveryId string
+	if err = tx.QueryRow("insert into tasks (task, resource, action, metadata, request_id, trace_context) values (uuid_generate_v4(), $1, $2, $3, $4, $5) returning task", resourceId, action, metadata, requestId, traceContext).Scan(&redeliveryId); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return redeliveryId, tx.Commit()
+}
+
+// AddEvent records a lifecycle event that does not come with a change to a
+// resource or task (e.g., a binding, which the broker does not store).
+func (b *PostgresStorage) AddEvent(eventType string, subject string, data map[string]interface{}) error {
+	logger.V(4).Infof("[AddEvent] start: %s %s\n", eventType, subject)
+	return b.addEvent(b.db, eventType, subject, data)
+}
+
+// PopPendingEvents takes up to limit events that are due for delivery from the
+// outbox, they are hidden from other workers for the lease so they are not sent
+// twice, if they are not marked as delivered by then they are tried again.
+func (b *PostgresStorage) PopPendingEvents(limit int, lease time.Duration) ([]LifecycleEvent, error) {
+	rows, err := b.db.Query(`
+        update event_outbox set
+            attempts = attempts + 1,
+            run_after = now() + $2::double precision * interval '1 second'
+        where
+            event in ( select event from event_outbox where delivered is null and run_after <= now() order by created asc limit $1 for update skip locked )
+        returning event, type, subject, data, attempts, created
+    `, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]LifecycleEvent, 0)
+	for rows.Next() {
+		var event LifecycleEvent
+		if err := rows.Scan(&event.Id, &event.Type, &event.Subject, &event.Data, &event.Attempts, &event.Created); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (b *PostgresStorage) MarkEventDelivered(Id string) error {
+	_, err := b.db.Exec("update event_outbox set delivered = now(), last_error = '' where event = $1", Id)
+	return err
+}
+
+func (b *PostgresStorage) RescheduleEvent(Id string, delay time.Duration, lastError string) error {
+	_, err := b.db.Exec("update event_outbox set run_after = now() + $2::double precision * interval '1 second', last_error = $3 where event = $1", Id, delay.Seconds(), lastError)
+	return err
+}
+
+// PruneEvents removes delivered events older than the retention from the outbox,
+// and the ones that were never delivered as well if undelivered is set.
+func (b *PostgresStorage) PruneEvents(retention time.Duration, undelivered bool) (int64, error) {
+	res, err := b.db.Exec("delete from event_outbox where created < now() - $1::double precision * interval '1 second' and (delivered is not null or $2)", retention.Seconds(), undelivered)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (b *PostgresStorage) AddAuditEntry(entry *AuditEntry) error {
+	return b.db.QueryRow("insert into audit_log (audit, platform, identity, origin, principal, scope, method, path, instance, binding, parameters, status_code, latency_ms) values (uuid_generate_v4(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning audit, created", entry.Platform, entry.Identity, entry.Origin, entry.Principal, entry.Scope, entry.Method, entry.Path, entry.InstanceId, entry.BindingId, string(entry.Parameters), entry.StatusCode, entry.LatencyMs).Scan(&entry.Id, &entry.Created)
+}
+
+func (b *PostgresStorage) GetAuditEntries(query AuditQuery) ([]AuditEntry, error) {
+	logger.V(4).Infof("[GetAuditEntries] start: %#+v\n", query)
+	rows, err := b.db.Query("select audit, platform, identity, origin, principal, scope, method, path, instance, binding, parameters, status_code, latency_ms, created from audit_log where ($1 = '' or instance = $1) and ($2 = '' or identity = $2) order by created desc limit $3", query.InstanceId, query.Identity, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		var parameters string
+		if err := rows.Scan(&entry.Id, &entry.Platform, &entry.Identity, &entry.Origin, &entry.Principal, &entry.Scope, &entry.Method, &entry.Path, &entry.InstanceId, &entry.BindingId, &parameters, &entry.StatusCode, &entry.LatencyMs, &entry.Created); err != nil {
+			return nil, err
+		}
+		entry.Parameters = json.RawMessage(parameters)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 func redactDatabaseURL(dburl string) string {
 	pstr, err := pq.ParseURL(dburl)
 
@@ -650,11 +1441,11 @@ func InitStorage(ctx context.Context, o Options) (*PostgresStorage, error) {
 		return nil, errors.New("unable to connect to database, none was specified in the environment via DATABASE_URL or through the -database-url cli option")
 	}
 
-	glog.Infof("DATABASE_URL=%s", redactDatabaseURL(o.DatabaseUrl))
+	logger.Infof("DATABASE_URL=%s", redactDatabaseURL(o.DatabaseUrl))
 
 	db, err := sql.Open("postgres", o.DatabaseUrl)
 	if err != nil {
-		glog.Errorf("Unable to open database: %s\n", err.Error())
+		logger.Errorf("Unable to open database: %s\n", err.Error())
 		return nil, errors.New("Unable to open database: " + err.Error())
 	}
 
@@ -662,6 +1453,14 @@ func InitStorage(ctx context.Context, o Options) (*PostgresStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec(sqlAlterTaskStatusScript)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqlUpdateSchemaVersion, SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
 
 	go cancelOnInterrupt(ctx, db)
 
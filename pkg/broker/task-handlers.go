@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+func init() {
+	RegisterTaskHandler(DeleteTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 10, Timeout: time.Minute * 10, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Hour * 2, Jitter: 0.2}, RequiresInstance: true, Operation: "deprovision"},
+		Handler:    RunDeleteTask,
+	})
+	RegisterTaskHandler(ResyncFromProviderTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 2, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true},
+		Handler:    RunResyncFromProviderTask,
+	})
+	RegisterTaskHandler(ResyncFromProviderUntilAvailableTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 2, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true},
+		Handler:    RunResyncFromProviderUntilAvailableTask,
+	})
+	RegisterTaskHandler(PerformPostProvisionTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 10, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true},
+		Handler:    RunPerformPostProvisionTask,
+	})
+	RegisterTaskHandler(NotifyCreateServiceWebhookTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Hour, Jitter: 0.2}, RequiresInstance: true},
+		Handler:    RunNotifyCreateServiceWebhookTask,
+	})
+	RegisterTaskHandler(NotifyCreateBindingWebhookTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Hour, Jitter: 0.2}, RequiresInstance: true},
+		Handler:    RunNotifyCreateBindingWebhookTask,
+	})
+	RegisterTaskHandler(NotifyOperationWebhookTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Hour, Jitter: 0.2}},
+		Handler:    RunNotifyOperationWebhookTask,
+	})
+	RegisterTaskHandler(CreateBindingTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 2, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true, Operation: "bind"},
+		Handler:    RunCreateBindingTask,
+	})
+	RegisterTaskHandler(DeleteBindingTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 2, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true, Operation: "unbind"},
+		Handler:    RunDeleteBindingTask,
+	})
+	RegisterTaskHandler(ChangePlansTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 30, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Hour, Jitter: 0.2}, RequiresInstance: true, Operation: "update"},
+		Handler:    RunChangePlansTask,
+	})
+	RegisterTaskHandler(ChangeProvidersTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 30, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Hour, Jitter: 0.2}, RequiresInstance: true, Operation: "update"},
+		Handler:    RunChangeProvidersTask,
+	})
+	RegisterTaskHandler(MaintenanceTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Hour, Backoff: ExponentialBackoff{Initial: time.Minute, Max: time.Hour, Jitter: 0.2}, RequiresInstance: true, Operation: "update"},
+		Handler:    RunMaintenanceTask,
+	})
+	RegisterTaskHandler(UpdateParametersTask, BasicTaskHandler{
+		TaskPolicy: TaskPolicy{RetryLimit: 60, Timeout: time.Minute * 2, Backoff: ExponentialBackoff{Initial: time.Second * 30, Max: time.Minute * 30, Jitter: 0.2}, RequiresInstance: true, Operation: "update"},
+		Handler:    RunUpdateParametersTask,
+	})
+}
+
+func RunDeleteTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Delete and deprovision database for task: %s\n", tc.Task.Id)
+	provider, err := tc.GetProvider(tc.Instance.Plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	if err = provider.Deprovision(tc.Instance, true); err != nil {
+		return "", errors.New("Failed to deprovision: " + err.Error())
+	}
+	if err = tc.Storage.DeleteInstance(tc.Instance); err != nil {
+		return "", errors.New("Failed to delete: " + err.Error())
+	}
+	return "", nil
+}
+
+func RunResyncFromProviderTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Resyncing from provider for task: %s\n", tc.Task.Id)
+	Entry, err := tc.Storage.GetInstance(tc.Task.ResourceId)
+	if err != nil {
+		return "", errors.New("Cannot get Entry: " + err.Error())
+	}
+	if tc.Instance.Status == Entry.Status {
+		tc.Log.Infof("Status did not change at provider for task: %s\n", tc.Task.Id)
+		return "", errors.New("No change in status since last check")
+	}
+	if err = tc.Storage.UpdateInstance(tc.Instance, tc.Instance.Plan.ID); err != nil {
+		return "", errors.New("Failed to update instance: " + err.Error())
+	}
+	return "", nil
+}
+
+func RunResyncFromProviderUntilAvailableTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Resyncing from provider until available for task: %s\n", tc.Task.Id)
+	if err := tc.Storage.UpdateInstance(tc.Instance, tc.Instance.Plan.ID); err != nil {
+		return "", errors.New("Failed to update instance: " + err.Error())
+	}
+	if !IsAvailable(tc.Instance.Status) {
+		tc.Log.Infof("Status did not change at provider for task: %s\n", tc.Task.Id)
+		return "", errors.New("No change in status since last check (" + tc.Instance.Status + ")")
+	}
+	return "", nil
+}
+
+func RunPerformPostProvisionTask(ctx context.Context, tc *TaskContext) (string, error) {
+	if _, err := RunResyncFromProviderUntilAvailableTask(ctx, tc); err != nil {
+		return "", err
+	}
+	provider, err := tc.GetProvider(tc.Instance.Plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	newInstance, err := provider.PerformPostProvision(tc.Instance)
+	if err != nil {
+		return "", errors.New("Failed to update instance: " + err.Error())
+	}
+	if err = tc.Storage.UpdateInstance(newInstance, newInstance.Plan.ID); err != nil {
+		return "", errors.New("Failed to update instance after post provision: " + err.Error())
+	}
+	return "", nil
+}
+
+func RunNotifyCreateServiceWebhookTask(ctx context.Context, tc *TaskContext) (string, error) {
+	if !IsAvailable(tc.Instance.Status) {
+		tc.Log.Infof("Status did not change at provider for task: %s\n", tc.Task.Id)
+		return "", errors.New("No change in status since last check")
+	}
+
+	var taskMetaData WebhookTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to callback on create service: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to callback on create service: " + err.Error())
+	}
+	return SendWebhook(ctx, tc.Storage, tc.Task, taskMetaData, map[string]interface{}{"state": "succeeded", "description": "available"})
+}
+
+// RunNotifyCreateBindingWebhookTask tells the platform a binding can be used, this
+// waits until the instance is available so the credentials handed out will work.
+func RunNotifyCreateBindingWebhookTask(ctx context.Context, tc *TaskContext) (string, error) {
+	if !IsAvailable(tc.Instance.Status) || !tc.Instance.Ready {
+		tc.Log.Infof("Binding credentials are not yet usable for task: %s (%s)\n", tc.Task.Id, tc.Instance.Status)
+		return "", errors.New("Binding credentials are not yet usable (" + tc.Instance.Status + ")")
+	}
+
+	var taskMetaData BindingWebhookTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to callback on create binding: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to callback on create binding: " + err.Error())
+	}
+	return SendWebhook(ctx, tc.Storage, tc.Task, taskMetaData.WebhookTaskMetadata, map[string]interface{}{"state": "succeeded", "description": "available", "binding_id": taskMetaData.BindingId})
+}
+
+// RunNotifyOperationWebhookTask reports the outcome of an asynchronous operation, the
+// instance may no longer exist (e.g., after a deprovision) so it is not looked up.
+func RunNotifyOperationWebhookTask(ctx context.Context, tc *TaskContext) (string, error) {
+	var taskMetaData OperationWebhookTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		metadata := tc.Task.Metadata
+		var fields interface{}
+		if json.Unmarshal([]byte(metadata), &fields) == nil {
+			// valid json of the wrong shape, it may still hold the webhook secret.
+			if byteData, err := json.Marshal(redactParameters(fields)); err == nil {
+				metadata = string(byteData)
+			}
+		}
+		tc.Log.Infof("Cannot unmarshal task metadata to callback on operation: %s, %s (metadata: %s)\n", tc.Task.Id, err.Error(), metadata)
+		return "", TaskFailed("Cannot unmarshal task metadata to callback on operation: " + err.Error())
+	}
+	return SendWebhook(ctx, tc.Storage, tc.Task, taskMetaData.WebhookTaskMetadata, map[string]interface{}{
+		"instance_id": taskMetaData.InstanceId,
+		"operation":   taskMetaData.Operation,
+		"state":       taskMetaData.State,
+		"description": taskMetaData.Description,
+	})
+}
+
+// RunCreateBindingTask creates a binding asked for with accepts_incomplete, it waits
+// until the instance is available so the credentials handed out will work.
+func RunCreateBindingTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Creating binding for task: %s\n", tc.Task.Id)
+	if !IsAvailable(tc.Instance.Status) || !tc.Instance.Ready {
+		return "", errors.New("Instance is not yet available (" + tc.Instance.Status + ")")
+	}
+	var taskMetaData BindingTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to create binding: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to create binding: " + err.Error())
+	}
+	provider, err := tc.GetProvider(tc.Instance.Plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	if err = TagBinding(provider, tc.Instance, taskMetaData.BindingId, taskMetaData.AppGuid); err != nil {
+		return "", errors.New("Failed to create binding: " + err.Error())
+	}
+	return "", nil
+}
+
+func RunDeleteBindingTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Deleting binding for task: %s\n", tc.Task.Id)
+	provider, err := tc.GetProvider(tc.Instance.Plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	if err = UntagBinding(provider, tc.Instance); err != nil {
+		return "", errors.New("Failed to delete binding: " + err.Error())
+	}
+	return "", nil
+}
+
+func RunChangePlansTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Changing plans for database: %s\n", tc.Task.Id)
+	var taskMetaData ChangePlansTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to change plans: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to change plans: " + err.Error())
+	}
+	output, err := UpgradeWithinProviders(ctx, tc.Storage, tc.Instance, taskMetaData.Plan, tc.NamePrefix)
+	if err != nil {
+		tc.Log.Infof("Cannot change plans for: %s, %s\n", tc.Task.Id, err.Error())
+		return "", errors.New("Cannot change plans: " + err.Error())
+	}
+	return output, nil
+}
+
+func RunChangeProvidersTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Changing providers for database: %s\n", tc.Task.Id)
+	var taskMetaData ChangeProvidersTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to change providers: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to change providers: " + err.Error())
+	}
+	output, err := UpgradeAcrossProviders(ctx, tc.Storage, tc.Instance, taskMetaData.Plan, tc.NamePrefix)
+	if err != nil {
+		tc.Log.Infof("Cannot switch providers: %s, %s\n", tc.Task.Id, err.Error())
+		return "", errors.New("Cannot switch providers: " + err.Error())
+	}
+	return output, nil
+}
+
+// RunMaintenanceTask moves an instance onto the cluster of its plans current
+// maintenance version, the old copy is only removed once the instance has moved.
+func RunMaintenanceTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Performing maintenance for database: %s\n", tc.Task.Id)
+	var taskMetaData MaintenanceTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to perform maintenance: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to perform maintenance: " + err.Error())
+	}
+	if tc.Instance.Plan.MaintenanceVersion() == taskMetaData.Version {
+		return "", nil
+	}
+	plan, err := tc.Storage.GetPlanByID(tc.Instance.Plan.ID)
+	if err != nil {
+		return "", errors.New("Cannot get plan: " + err.Error())
+	}
+	if plan.MaintenanceVersion() != taskMetaData.Version {
+		return "", TaskFailed("The plan is no longer at maintenance version " + taskMetaData.Version)
+	}
+	provider, err := tc.GetProvider(plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	Instance, err := provider.Maintain(tc.Instance, plan)
+	if err != nil {
+		return "", errors.New("Cannot perform maintenance: " + err.Error())
+	}
+	if Instance.Endpoint != tc.Instance.Endpoint {
+		if err = reapplyQuota(provider, tc.Storage, Instance); err != nil {
+			return "", errors.New("Cannot restrict the instance after maintenance: " + err.Error())
+		}
+	}
+	if err = tc.Storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
+		return "", errors.New("Failed to update instance after maintenance: " + err.Error())
+	}
+	if Instance.Endpoint != tc.Instance.Endpoint {
+		if err = provider.Deprovision(tc.Instance, false); err != nil {
+			tc.Log.Errorf("Unable to remove %s from the cluster it was moved off of: %s\n", tc.Instance.Name, err.Error())
+		}
+	}
+	return "", nil
+}
+
+// RunUpdateParametersTask applies the parameters of an update and then records
+// them along with the instances other parameters.
+func RunUpdateParametersTask(ctx context.Context, tc *TaskContext) (string, error) {
+	tc.Log.Infof("Updating parameters for database: %s\n", tc.Task.Id)
+	var taskMetaData UpdateParametersTaskMetadata
+	if err := json.Unmarshal([]byte(tc.Task.Metadata), &taskMetaData); err != nil {
+		tc.Log.Infof("Cannot unmarshal task metadata to update parameters: %s, %s\n", tc.Task.Id, err.Error())
+		return "", TaskFailed("Cannot unmarshal task metadata to update parameters: " + err.Error())
+	}
+	provider, err := tc.GetProvider(tc.Instance.Plan)
+	if err != nil {
+		return "", errors.New("Cannot get provider: " + err.Error())
+	}
+	// the update is merged into the parameters the instance has now so the ones it
+	// was provisioned with are not lost.
+	parameters := mergeParameters(tc.Instance.Parameters, taskMetaData.Parameters)
+	if err = provider.UpdateParameters(tc.Instance, parameters); err != nil {
+		return "", errors.New("Cannot update parameters: " + err.Error())
+	}
+	if err = tc.Storage.UpdateInstanceParameters(tc.Instance.Id, parameters); err != nil {
+		return "", errors.New("Failed to record parameters: " + err.Error())
+	}
+	return "", nil
+}
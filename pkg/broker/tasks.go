@@ -1,17 +1,16 @@
 package broker
 
 import (
-	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"github.com/golang/glog"
-	"net/http"
-	"os"
+	"math"
+	"math/rand"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TaskAction string
@@ -22,37 +21,99 @@ const (
 	ResyncFromProviderUntilAvailableTask TaskAction = "resync-until-available"
 	NotifyCreateServiceWebhookTask       TaskAction = "notify-create-service-webhook"
 	NotifyCreateBindingWebhookTask       TaskAction = "notify-create-binding-webhook"
+	NotifyOperationWebhookTask           TaskAction = "notify-operation-webhook"
 	ChangeProvidersTask                  TaskAction = "change-providers"
 	ChangePlansTask                      TaskAction = "change-plans"
 	RestoreDbTask                        TaskAction = "restore-database"
 	PerformPostProvisionTask             TaskAction = "perform-post-provision"
+	CreateBindingTask                    TaskAction = "create-binding"
+	DeleteBindingTask                    TaskAction = "delete-binding"
+	MaintenanceTask                      TaskAction = "maintenance"
+	UpdateParametersTask                 TaskAction = "update-parameters"
 )
 
 type Task struct {
-	Id         string
-	Action     TaskAction
-	ResourceId string
-	Status     string
-	Retries    int64
-	Metadata   string
-	Result     string
-	Started    *time.Time
-	Finished   *time.Time
+	Id         string     `json:"id"`
+	Action     TaskAction `json:"action"`
+	ResourceId string     `json:"resource_id"`
+	Status     string     `json:"status"`
+	Retries    int64      `json:"retries"`
+	Metadata   string     `json:"-"` /* NEVER serialize this, it holds webhook secrets */
+	Result     string     `json:"result"`
+	Created    time.Time  `json:"created"`
+	Updated    time.Time  `json:"updated"`
+	Started    *time.Time `json:"started"`
+	Finished   *time.Time `json:"finished"`
+	RunAfter   time.Time  `json:"run_after"`
+	RequestId  string     `json:"request_id,omitempty"`
+	// TraceContext is the traceparent of the span that queued the task.
+	TraceContext string `json:"-"`
 }
 
 type WebhookTaskMetadata struct {
 	Url    string `json:"url"`
 	Secret string `json:"secret"`
+	KeyId  string `json:"key_id,omitempty"`
+}
+
+type BindingWebhookTaskMetadata struct {
+	WebhookTaskMetadata
+	BindingId string `json:"binding_id"`
+}
+
+// OperationWebhookTaskMetadata is the metadata of a NotifyOperationWebhookTask, it
+// carries the outcome of the task that asked for the callback.
+type OperationWebhookTaskMetadata struct {
+	WebhookTaskMetadata
+	InstanceId  string `json:"instance_id"`
+	Operation   string `json:"operation"`
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+// TaskWebhook can be embedded in a tasks metadata to have the outcome of the task
+// (once it has finished or failed) sent to a webhook.
+type TaskWebhook struct {
+	Webhook *WebhookTaskMetadata `json:"webhook,omitempty"`
+}
+
+type DeleteTaskMetadata struct {
+	TaskWebhook
+	Name string `json:"name"`
 }
 
 type ChangeProvidersTaskMetadata struct {
+	TaskWebhook
 	Plan string `json:"plan"`
 }
 
 type ChangePlansTaskMetadata struct {
+	TaskWebhook
 	Plan string `json:"plan"`
 }
 
+// BindingTaskMetadata is the metadata of a CreateBindingTask or DeleteBindingTask,
+// the binding id is what a bindings last operation is looked up by.
+type BindingTaskMetadata struct {
+	TaskWebhook
+	BindingId string `json:"binding_id"`
+	AppGuid   string `json:"app_guid,omitempty"`
+}
+
+// MaintenanceTaskMetadata is the metadata of a MaintenanceTask, version is the
+// maintenance_info.version the platform asked for.
+type MaintenanceTaskMetadata struct {
+	TaskWebhook
+	Version string `json:"version"`
+}
+
+// UpdateParametersTaskMetadata is the metadata of an UpdateParametersTask, the
+// parameters are the ones the update changes, a null removes a parameter.
+type UpdateParametersTaskMetadata struct {
+	TaskWebhook
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
 type RestoreDbTaskMetadata struct {
 	Backup string `json:"backup"`
 }
@@ -61,68 +122,379 @@ func FinishedTask(storage Storage, taskId string, retries int64, result string,
 	var t = time.Now()
 	err := storage.UpdateTask(taskId, &status, &retries, nil, &result, nil, &t)
 	if err != nil {
-		glog.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
+		logger.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
 	}
 }
 
 func UpdateTaskStatus(storage Storage, taskId string, retries int64, result string, status string) {
 	err := storage.UpdateTask(taskId, &status, &retries, nil, &result, nil, nil)
 	if err != nil {
-		glog.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
+		logger.Errorf("Unable to update task %s due to: %s (taskId: %s, retries: %d, result: [%s], status: [%s]\n", taskId, err.Error(), taskId, retries, result, status)
+	}
+}
+
+// BackoffPolicy decides how long a failed task waits before it is attempted
+// again, retries is the number of attempts that have failed so far.
+type BackoffPolicy interface {
+	Delay(retries int64) time.Duration
+}
+
+// ConstantBackoff waits the same amount of time between every attempt.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Delay(retries int64) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff multiplies the delay after every failed attempt up to Max,
+// Jitter is the fraction (0 to 1) of the delay that is randomly taken off so
+// tasks that failed together do not retry together.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func (b ExponentialBackoff) Delay(retries int64) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	if retries < 1 {
+		retries = 1
+	}
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(retries-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay = delay * (1 - math.Min(b.Jitter, 1)*rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// TaskPolicy describes how the worker treats a task action, a handler declares
+// how many times it may be attempted, how long a single attempt may take, how
+// long to wait before retrying and whether the worker should look up the
+// instance the task belongs to before running it. Without a Backoff a failed
+// task is retried on the next tick. Operation is the OSB operation (e.g.,
+// deprovision, update) the task carries out, it is reported to webhooks.
+type TaskPolicy struct {
+	RetryLimit       int64
+	Timeout          time.Duration
+	Backoff          BackoffPolicy
+	RequiresInstance bool
+	Operation        string
+}
+
+func (p TaskPolicy) retryDelay(retries int64) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff.Delay(retries)
+}
+
+// TaskContext is what a TaskHandler is given to perform its work, Instance is
+// only populated if the handlers policy requires an instance.
+type TaskContext struct {
+	Storage    Storage
+	NamePrefix string
+	Task       *Task
+	Instance   *Instance
+	// Log carries the request, task, instance, plan and cluster the task is for.
+	Log Logger
+	// ctx has the logger and span of the task.
+	ctx context.Context
+}
+
+// GetProvider is the provider of the plan, its calls are logged and traced with
+// the task.
+func (tc *TaskContext) GetProvider(plan *ProviderPlan) (Provider, error) {
+	provider, err := GetProviderByPlan(tc.NamePrefix, plan)
+	if err != nil {
+		return nil, err
+	}
+	if tc.ctx == nil {
+		return withProviderContext(provider, withLogger(context.Background(), tc.Log)), nil
+	}
+	return withProviderContext(provider, tc.ctx), nil
+}
+
+// TaskHandler performs the work for a single TaskAction. The lifecycle of the task
+// (retry limits, instance lookup, status updates) is owned by RunTask, a handler
+// only needs to do its work and return a result or an error. Returning an error
+// re-queues the task, unless the error is a TaskFailedError.
+type TaskHandler interface {
+	Policy() TaskPolicy
+	Run(context.Context, *TaskContext) (string, error)
+}
+
+// TaskFailedError is returned by a TaskHandler when retrying the task is
+// pointless, the task is marked as failed immediately.
+type TaskFailedError struct {
+	Message string
+}
+
+func (e TaskFailedError) Error() string {
+	return e.Message
+}
+
+func TaskFailed(message string) error {
+	return TaskFailedError{Message: message}
+}
+
+// BasicTaskHandler adapts a policy and a function into a TaskHandler.
+type BasicTaskHandler struct {
+	TaskPolicy
+	Handler func(context.Context, *TaskContext) (string, error)
+}
+
+func (h BasicTaskHandler) Policy() TaskPolicy {
+	return h.TaskPolicy
+}
+
+func (h BasicTaskHandler) Run(ctx context.Context, tc *TaskContext) (string, error) {
+	return h.Handler(ctx, tc)
+}
+
+var taskHandlers = struct {
+	sync.RWMutex
+	handlers map[TaskAction]TaskHandler
+}{handlers: make(map[TaskAction]TaskHandler)}
+
+// RegisterTaskHandler sets the handler the worker uses for an action, registering
+// an action twice replaces the previous handler.
+func RegisterTaskHandler(action TaskAction, handler TaskHandler) {
+	taskHandlers.Lock()
+	defer taskHandlers.Unlock()
+	taskHandlers.handlers[action] = handler
+}
+
+func GetTaskHandler(action TaskAction) (TaskHandler, bool) {
+	taskHandlers.RLock()
+	defer taskHandlers.RUnlock()
+	handler, ok := taskHandlers.handlers[action]
+	return handler, ok
+}
+
+// taskLogger logs with the request that queued the task, the task and the
+// instance it is for.
+func taskLogger(task *Task) Logger {
+	return logger.With("request_id", task.RequestId).With("task_id", task.Id).With("action", string(task.Action)).With("instance_id", task.ResourceId)
+}
+
+func retryOrFailTask(ctx context.Context, storage Storage, task *Task, policy TaskPolicy, result string) {
+	log := taskLogger(task)
+	retries := task.Retries + 1
+	if retries >= policy.RetryLimit {
+		log.Infof("Retry limit was reached for task: %s %d\n", task.Id, retries)
+		failTask(ctx, storage, task, policy, retries, "Unable to perform "+string(task.Action)+" on "+task.ResourceId+" as it failed multiple times ("+result+")")
+		return
+	}
+	delay := policy.retryDelay(retries)
+	log.Infof("Task %s will be retried in %s\n", task.Id, delay)
+	taskRetries.WithLabelValues(string(task.Action)).Inc()
+	if err := storage.RescheduleTask(task.Id, retries, result, delay); err != nil {
+		log.Errorf("Unable to reschedule task %s due to: %s (retries: %d, result: [%s])\n", task.Id, err.Error(), retries, result)
+	}
+}
+
+func failTask(ctx context.Context, storage Storage, task *Task, policy TaskPolicy, retries int64, result string) {
+	FinishedTask(storage, task.Id, retries, result, "failed")
+	notifyTaskOutcome(ctx, storage, task, policy, "failed", result)
+}
+
+func finishTask(ctx context.Context, storage Storage, task *Task, policy TaskPolicy, result string) {
+	FinishedTask(storage, task.Id, task.Retries, result, "finished")
+	notifyTaskOutcome(ctx, storage, task, policy, "succeeded", result)
+}
+
+// notifyTaskOutcome schedules a callback with the outcome of a task if its metadata
+// asked for one, metadata that is not json (or has no webhook) is ignored. The
+// callback is traced as part of the task.
+func notifyTaskOutcome(ctx context.Context, storage Storage, task *Task, policy TaskPolicy, state string, description string) {
+	var hook TaskWebhook
+	if err := json.Unmarshal([]byte(task.Metadata), &hook); err != nil || hook.Webhook == nil {
+		return
+	}
+	operation := policy.Operation
+	if operation == "" {
+		operation = string(task.Action)
+	}
+	byteData, err := json.Marshal(OperationWebhookTaskMetadata{
+		WebhookTaskMetadata: *hook.Webhook,
+		InstanceId:          task.ResourceId,
+		Operation:           operation,
+		State:               state,
+		Description:         description,
+	})
+	if err != nil {
+		taskLogger(task).Errorf("Error: failed to marshal operation webhook task metadata: %s\n", err)
+		return
+	}
+	if _, err = storage.AddTaskForRequest(TaskOrigin{RequestId: task.RequestId, TraceContext: taskOrigin(ctx).TraceContext}, task.ResourceId, NotifyOperationWebhookTask, string(byteData), 0); err != nil {
+		taskLogger(task).Errorf("Error: Unable to schedule %s webhook for task %s: %s\n", operation, task.Id, err.Error())
 	}
 }
 
+// taskTimeoutGrace is how long a handler that ran over its timeout is waited on
+// before the task is retried (or failed) without it.
+var taskTimeoutGrace = time.Minute
+
+func runTaskHandler(ctx context.Context, handler TaskHandler, tc *TaskContext, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return handler.Run(ctx, tc)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type outcome struct {
+		result string
+		err    error
+	}
+	// Provider calls do not take a context, so a handler that runs over its timeout
+	// may not notice its context is done. It is given a grace period to return so a
+	// retry does not work on the same database at the same time, after that it is
+	// left to finish on its own and its outcome is thrown away.
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := handler.Run(ctx, tc)
+		done <- outcome{result: result, err: err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+	}
+	log := LoggerFrom(ctx)
+	log.Warningf("Task %s did not finish within %s, waiting up to %s for it to return\n", tc.Task.Id, timeout, taskTimeoutGrace)
+	grace := time.NewTimer(taskTimeoutGrace)
+	defer grace.Stop()
+	select {
+	case <-done:
+	case <-grace.C:
+		log.Errorf("Task %s did not return within %s of its timeout, giving up on it\n", tc.Task.Id, taskTimeoutGrace)
+	}
+	return "", errors.New("Task did not finish within " + timeout.String())
+}
+
+// RunTask runs a single task that has been popped off the queue with the handler
+// registered for its action, and records whether it finished, failed or should
+// be retried. The task is traced as a child of the span that queued it.
+func RunTask(ctx context.Context, storage Storage, namePrefix string, task *Task) {
+	log := taskLogger(task)
+	ctx, span := tracer().Start(taskTraceContext(ctx, task), "task "+string(task.Action), trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("broker.task_id", task.Id),
+		attribute.String("broker.task.action", string(task.Action)),
+		attribute.String("broker.instance_id", task.ResourceId),
+		attribute.Int64("broker.task.retries", task.Retries)))
+	var err error
+	defer func() { endSpan(span, err) }()
+	if span.SpanContext().IsValid() {
+		log = log.With("trace_id", span.SpanContext().TraceID().String())
+	}
+	ctx = withLogger(ctx, log)
+	storage = traceStorage(ctx, storage)
+
+	handler, ok := GetTaskHandler(task.Action)
+	if !ok {
+		err = errors.New("No handler is registered for action " + string(task.Action))
+		log.Errorf("No handler is registered for task: %s (action: %s)\n", task.Id, task.Action)
+		FinishedTask(storage, task.Id, task.Retries, err.Error(), "failed")
+		return
+	}
+	policy := handler.Policy()
+	if task.Retries >= policy.RetryLimit {
+		err = errors.New("Retry limit was reached")
+		log.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
+		failTask(ctx, storage, task, policy, task.Retries, "Unable to perform "+string(task.Action)+" on "+task.ResourceId+" as it failed multiple times ("+task.Result+")")
+		return
+	}
+
+	tc := TaskContext{Storage: storage, NamePrefix: namePrefix, Task: task}
+	if policy.RequiresInstance {
+		var Instance *Instance
+		Instance, err = GetInstanceById(namePrefix, storage, task.ResourceId)
+		if err != nil {
+			log.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
+			retryOrFailTask(ctx, storage, task, policy, "Cannot get Instance: "+err.Error())
+			return
+		}
+		tc.Instance = Instance
+		log = instanceLogger(log, Instance)
+	}
+	tc.Log = log
+	tc.ctx = withLogger(ctx, log)
+
+	start := time.Now()
+	var result string
+	result, err = runTaskHandler(tc.ctx, handler, &tc, policy.Timeout)
+	observeTaskRun(task.Action, start, err)
+	if err != nil {
+		if _, ok := err.(TaskFailedError); ok {
+			log.Infof("Task %s failed: %s\n", task.Id, err.Error())
+			failTask(ctx, storage, task, policy, task.Retries+1, err.Error())
+			return
+		}
+		log.Infof("Task %s did not succeed: %s\n", task.Id, err.Error())
+		retryOrFailTask(ctx, storage, task, policy, err.Error())
+		return
+	}
+	finishTask(ctx, storage, task, policy, result)
+}
+
 func RunPreprovisionTasks(ctx context.Context, o Options, namePrefix string, storage Storage, wait int64) {
-	glog.V(4).Infoln("[RunPreprovisionTasks] start")
+	logger.V(4).Infoln("[RunPreprovisionTasks] start")
 	t := time.NewTicker(time.Second * time.Duration(wait))
 	dbEntries, err := storage.StartProvisioningTasks()
 	if err != nil {
-		glog.Errorf("Get pending tasks failed: %s\n", err.Error())
+		logger.Errorf("Get pending tasks failed: %s\n", err.Error())
 		return
 	}
 	for _, entry := range dbEntries {
-		glog.V(4).Infoln("[RunPreprovisionTasks] loop start")
+		logger.V(4).Infoln("[RunPreprovisionTasks] loop start")
 
-		glog.Infof("Starting preprovisioning database: %s with plan: %s\n", entry.Id, entry.PlanId)
+		logger.Infof("Starting preprovisioning database: %s with plan: %s\n", entry.Id, entry.PlanId)
 
 		plan, err := storage.GetPlanByID(entry.PlanId)
 		if err != nil {
-			glog.Errorf("Unable to provision, cannot find plan: %s, %s\n", entry.PlanId, err.Error())
+			logger.Errorf("Unable to provision, cannot find plan: %s, %s\n", entry.PlanId, err.Error())
 			storage.NukeInstance(entry.Id)
 			continue
 		}
 		provider, err := GetProviderByPlan(namePrefix, plan)
 		if err != nil {
-			glog.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
+			logger.Errorf("Unable to provision, cannot find provider (GetProviderByPlan failed): %s\n", err.Error())
 			storage.NukeInstance(entry.Id)
 			continue
 		}
 
 		Instance, err := provider.Provision(entry.Id, plan, "preprovisioned")
 		if err != nil {
-			glog.Errorf("Error provisioning database (%s): %s\n", plan.ID, err.Error())
+			logger.Errorf("Error provisioning database (%s): %s\n", plan.ID, err.Error())
 			storage.NukeInstance(entry.Id)
 			continue
 		}
 
 		if err = storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
-			glog.Errorf("Error inserting record into provisioned table: %s\n", err.Error())
+			logger.Errorf("Error inserting record into provisioned table: %s\n", err.Error())
 
 			if err = provider.Deprovision(Instance, false); err != nil {
-				glog.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Database Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
+				logger.Errorf("Error cleaning up (deprovision failed) after insert record failed but provision succeeded (Database Id:%s Name: %s) %s\n", Instance.Id, Instance.Name, err.Error())
 				if _, err = storage.AddTask(Instance.Id, DeleteTask, Instance.Name); err != nil {
-					glog.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
+					logger.Errorf("Error: Unable to add task to delete instance, WE HAVE AN ORPHAN! (%s): %s\n", Instance.Name, err.Error())
 				}
 			}
 			continue
 		}
 		if !IsAvailable(Instance.Status) {
 			if _, err = storage.AddTask(Instance.Id, ResyncFromProviderUntilAvailableTask, ""); err != nil {
-				glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
+				logger.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 			}
 		}
-		glog.Infof("Finished preprovisioning database: %s with plan: %s\n", entry.Id, entry.PlanId)
-		glog.V(4).Infoln("[RunPreprovisionTasks] loop end")
+		logger.Infof("Finished preprovisioning database: %s with plan: %s\n", entry.Id, entry.PlanId)
+		logger.V(4).Infoln("[RunPreprovisionTasks] loop end")
 
 		<-t.C
 	}
@@ -136,7 +508,8 @@ func TickTocPreprovisionTasks(ctx context.Context, o Options, namePrefix string,
 	}
 }
 
-func UpgradeWithinProviders(storage Storage, fromDb *Instance, toPlanId string, namePrefix string) (string, error) {
+func UpgradeWithinProviders(ctx context.Context, storage Storage, fromDb *Instance, toPlanId string, namePrefix string) (string, error) {
+	log := LoggerFrom(ctx)
 	toPlan, err := storage.GetPlanByID(toPlanId)
 	if err != nil {
 		return "", err
@@ -145,6 +518,7 @@ func UpgradeWithinProviders(storage Storage, fromDb *Instance, toPlanId string,
 	if err != nil {
 		return "", err
 	}
+	fromProvider = withProviderContext(fromProvider, ctx)
 	if toPlanId == fromDb.Plan.ID {
 		return "", errors.New("Cannot upgrade to the same plan")
 	}
@@ -155,26 +529,30 @@ func UpgradeWithinProviders(storage Storage, fromDb *Instance, toPlanId string,
 	// This could take a very long time.
 	Instance, err := fromProvider.Modify(fromDb, toPlan)
 	if err != nil && err.Error() == "This feature is not available on this plan." {
-		return UpgradeAcrossProviders(storage, fromDb, toPlanId, namePrefix)
+		return UpgradeAcrossProviders(ctx, storage, fromDb, toPlanId, namePrefix)
 	}
 	if err != nil {
 		return "", err
 	}
 
 	if err = storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
-		glog.Errorf("ERROR: Cannot update instance in database after upgrade change %s (to plan: %s) %s\n", Instance.Name, Instance.Plan.ID, err.Error())
+		log.Errorf("ERROR: Cannot update instance in database after upgrade change %s (to plan: %s) %s\n", Instance.Name, Instance.Plan.ID, err.Error())
 		return "", err
 	}
+	// a larger plan lifts a restriction right away rather than at the next collection.
+	if err = CheckQuota(ctx, namePrefix, storage, Instance); err != nil {
+		log.Errorf("Unable to check the storage quota of %s after changing plans: %s\n", Instance.Name, err.Error())
+	}
 
 	if !IsAvailable(Instance.Status) {
-		if _, err = storage.AddTask(Instance.Id, ResyncFromProviderTask, ""); err != nil {
-			glog.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
+		if _, err = storage.AddTaskForRequest(taskOrigin(ctx), Instance.Id, ResyncFromProviderTask, "", 0); err != nil {
+			log.Errorf("Error: Unable to schedule resync from provider! (%s): %s\n", Instance.Name, err.Error())
 		}
 	}
 	return "", err
 }
 
-func UpgradeAcrossProviders(storage Storage, fromDb *Instance, toPlanId string, namePrefix string) (string, error) {
+func UpgradeAcrossProviders(ctx context.Context, storage Storage, fromDb *Instance, toPlanId string, namePrefix string) (string, error) {
 	return "", errors.New("Mongodb cannot be upgraded across providers.")
 }
 
@@ -187,267 +565,17 @@ func RunWorkerTasks(ctx context.Context, o Options, namePrefix string, storage S
 
 		task, err := storage.PopPendingTask()
 		if err != nil && err.Error() != "sql: no rows in result set" {
-			glog.Errorf("Getting a pending task failed: %s\n", err.Error())
+			logger.Errorf("Getting a pending task failed: %s\n", err.Error())
 			return err
 		} else if err != nil && err.Error() == "sql: no rows in result set" {
 			// Nothing to do...
 			continue
 		}
 
-		glog.Infof("Started task: %s\n", task.Id)
-
-		if task.Action == DeleteTask {
-			glog.Infof("Delete and deprovision database for task: %s\n", task.Id)
-
-			if task.Retries >= 10 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to delete database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get provider: "+err.Error(), "pending")
-				continue
-			}
-			if err = provider.Deprovision(Instance, true); err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to deprovision: "+err.Error(), "pending")
-				continue
-			}
-			if err = storage.DeleteInstance(Instance); err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to delete: "+err.Error(), "pending")
-				continue
-			}
-			FinishedTask(storage, task.Id, task.Retries, "", "finished")
-		} else if task.Action == ResyncFromProviderTask {
-			glog.Infof("Resyncing from provider for task: %s\n", task.Id)
-			if task.Retries >= 60 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to resync information from provider for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			Entry, err := storage.GetInstance(task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get database instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Entry: "+err.Error(), "pending")
-				continue
-			}
-			if Instance.Status != Entry.Status {
-				if err = storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
-					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
-					continue
-				}
-			} else {
-				glog.Infof("Status did not change at provider for task: %s\n", task.Id)
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "No change in status since last check", "pending")
-				continue
-			}
-
-			FinishedTask(storage, task.Id, task.Retries, "", "finished")
-		} else if task.Action == ResyncFromProviderUntilAvailableTask {
-			glog.Infof("Resyncing from provider until available for task: %s\n", task.Id)
-			if task.Retries >= 60 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to resync information from provider for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			if err = storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
-				continue
-			}
-			if !IsAvailable(Instance.Status) {
-				glog.Infof("Status did not change at provider for task: %s\n", task.Id)
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "No change in status since last check ("+Instance.Status+")", "pending")
-				continue
-			}
-			FinishedTask(storage, task.Id, task.Retries, "", "finished")
-		} else if task.Action == PerformPostProvisionTask {
-			glog.Infof("Resyncing from provider until available (for perform post provision) for task: %s\n", task.Id)
-			if task.Retries >= 60 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to resync information from provider for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			if err = storage.UpdateInstance(Instance, Instance.Plan.ID); err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
-				continue
-			}
-			if !IsAvailable(Instance.Status) {
-				glog.Infof("Status did not change at provider for task: %s\n", task.Id)
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "No change in status since last check ("+Instance.Status+")", "pending")
-				continue
-			}
-
-			provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot get provider: "+err.Error(), "pending")
-				continue
-			}
-
-			newInstance, err := provider.PerformPostProvision(Instance)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance: "+err.Error(), "pending")
-				continue
-			}
-
-			if err = storage.UpdateInstance(newInstance, newInstance.Plan.ID); err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to update instance after post provision: "+err.Error(), "pending")
-				continue
-			}
-
-			FinishedTask(storage, task.Id, task.Retries, "", "finished")
-		} else if task.Action == NotifyCreateServiceWebhookTask {
-
-			if task.Retries >= 60 {
-				FinishedTask(storage, task.Id, task.Retries, "Unable to deliver webhook: "+task.Result, "failed")
-				continue
-			}
-
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			if !IsAvailable(Instance.Status) {
-				glog.Infof("Status did not change at provider for task: %s\n", task.Id)
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "No change in status since last check", "pending")
-				continue
-			}
-
-			byteData, err := json.Marshal(map[string]interface{}{"state": "succeeded", "description": "available"})
-			// seems like this would be more useful, but whatevs: byteData, err := json.Marshal(Instance)
-
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot marshal Instance to json: "+err.Error(), "pending")
-				continue
-			}
-
-			var taskMetaData WebhookTaskMetadata
-			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
-			if err != nil {
-				glog.Infof("Cannot unmarshal task metadata to callback on create service: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to callback on create service: "+err.Error(), "pending")
-				continue
-			}
-
-			h := hmac.New(sha256.New, []byte(taskMetaData.Secret))
-			h.Write(byteData)
-			sha := base64.StdEncoding.EncodeToString(h.Sum(nil))
-
-			client := &http.Client{}
-			req, err := http.NewRequest("POST", taskMetaData.Url, bytes.NewReader(byteData))
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to create http post request: "+err.Error(), "pending")
-				continue
-			}
-			req.Header.Add("content-type", "application/json")
-			req.Header.Add("x-osb-signature", sha)
-			resp, err := client.Do(req)
-			if err != nil {
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Failed to send http post operation: "+err.Error(), "pending")
-				continue
-			}
-			resp.Body.Close() // ignore it, we dont want to hear it.
-
-			if os.Getenv("RETRY_WEBHOOKS") != "" {
-				if resp.StatusCode < 200 || resp.StatusCode > 399 {
-					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Got invalid http status code from hook: "+resp.Status, "pending")
-					continue
-				}
-				FinishedTask(storage, task.Id, task.Retries, resp.Status, "finished")
-			} else {
-				if resp.StatusCode < 200 || resp.StatusCode > 399 {
-					UpdateTaskStatus(storage, task.Id, task.Retries+1, "Got invalid http status code from hook: "+resp.Status, "failed")
-				} else {
-					FinishedTask(storage, task.Id, task.Retries, resp.Status, "finished")
-				}
-			}
-		} else if task.Action == ChangePlansTask {
-			glog.Infof("Changing plans for database: %s\n", task.Id)
-			if task.Retries >= 60 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to change plans for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			var taskMetaData ChangePlansTaskMetadata
-			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
-			if err != nil {
-				glog.Infof("Cannot unmarshal task metadata to change providers: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot unmarshal task metadata to change providers: "+err.Error(), "pending")
-				continue
-			}
-			output, err := UpgradeWithinProviders(storage, Instance, taskMetaData.Plan, namePrefix)
-			if err != nil {
-				glog.Infof("Cannot change plans for: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries+1, "Cannot change plans: "+err.Error(), "pending")
-				continue
-			}
-
-			FinishedTask(storage, task.Id, task.Retries, output, "finished")
-		} else if task.Action == ChangeProvidersTask {
-			glog.Infof("Changing providers for database: %s\n", task.Id)
-			if task.Retries >= 60 {
-				glog.Infof("Retry limit was reached for task: %s %d\n", task.Id, task.Retries)
-				FinishedTask(storage, task.Id, task.Retries, "Unable to resync information from provider for database "+task.ResourceId+" as it failed multiple times ("+task.Result+")", "failed")
-				continue
-			}
-			Instance, err := GetInstanceById(namePrefix, storage, task.ResourceId)
-			if err != nil {
-				glog.Infof("Failed to get provider instance for task: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot get Instance: "+err.Error(), "pending")
-				continue
-			}
-			var taskMetaData ChangeProvidersTaskMetadata
-			err = json.Unmarshal([]byte(task.Metadata), &taskMetaData)
-			if err != nil {
-				glog.Infof("Cannot unmarshal task metadata to change providers: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot unmarshal task metadata to change providers: "+err.Error(), "pending")
-				continue
-			}
-			output, err := UpgradeAcrossProviders(storage, Instance, taskMetaData.Plan, namePrefix)
-			if err != nil {
-				glog.Infof("Cannot switch providers: %s, %s\n", task.Id, err.Error())
-				UpdateTaskStatus(storage, task.Id, task.Retries, "Cannot switch providers: "+err.Error(), "pending")
-				continue
-			}
-
-			FinishedTask(storage, task.Id, task.Retries, output, "finished")
-		}
-		// TODO: create binding NotifyCreateBindingWebhookTask
-
-		glog.Infof("Finished task: %s\n", task.Id)
+		taskLogger(task).Infof("Started task: %s\n", task.Id)
+		RunTask(ctx, storage, namePrefix, task)
+		taskLogger(task).Infof("Finished task: %s\n", task.Id)
 	}
-	return nil
 }
 
 func RunBackgroundTasks(ctx context.Context, o Options) error {
@@ -455,7 +583,23 @@ func RunBackgroundTasks(ctx context.Context, o Options) error {
 	if err != nil {
 		return err
 	}
+	if err = initTracing(ctx, o, "mongodb-broker-worker"); err != nil {
+		return err
+	}
 
+	go func() {
+		if err := ServeWorkerEndpoints(ctx, metricsAddrFromOptions(o), namePrefix, storage); err != nil {
+			logger.Errorf("Unable to serve metrics and health checks: %s\n", err.Error())
+		}
+	}()
 	go TickTocPreprovisionTasks(ctx, o, namePrefix, storage)
+	go RunUsageCollection(ctx, o, namePrefix, storage)
+	sink := eventSinkFromOptions(o)
+	if sink.Url != "" {
+		go RunEventDelivery(ctx, sink, storage)
+	} else {
+		logger.Infof("No event sink was specified, lifecycle events are kept in the outbox for %s.\n", eventRetention)
+	}
+	go RunEventPruning(ctx, sink, storage)
 	return RunWorkerTasks(ctx, o, namePrefix, storage)
 }
@@ -0,0 +1,216 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type taskUpdate struct {
+	status  string
+	retries int64
+	result  string
+	delay   time.Duration
+}
+
+type fakeTaskStorage struct {
+	Storage
+	updates []taskUpdate
+	added   []Task
+}
+
+func (s *fakeTaskStorage) AddTaskForRequest(origin TaskOrigin, Id string, action TaskAction, metadata string, delay time.Duration) (string, error) {
+	s.added = append(s.added, Task{ResourceId: Id, Action: action, Metadata: metadata, RequestId: origin.RequestId, TraceContext: origin.TraceContext})
+	return "", nil
+}
+
+func (s *fakeTaskStorage) UpdateTask(Id string, status *string, retries *int64, metadata *string, result *string, started *time.Time, finished *time.Time) error {
+	s.updates = append(s.updates, taskUpdate{status: *status, retries: *retries, result: *result})
+	return nil
+}
+
+func (s *fakeTaskStorage) RescheduleTask(Id string, retries int64, result string, delay time.Duration) error {
+	s.updates = append(s.updates, taskUpdate{status: "pending", retries: retries, result: result, delay: delay})
+	return nil
+}
+
+func (s *fakeTaskStorage) last() taskUpdate {
+	return s.updates[len(s.updates)-1]
+}
+
+func TestRunTask(t *testing.T) {
+	Convey("Given a registered task handler", t, func() {
+		var action TaskAction = "test-action"
+		var err error
+		var calls int
+		var log Logger
+		RegisterTaskHandler(action, BasicTaskHandler{
+			TaskPolicy: TaskPolicy{RetryLimit: 3, Timeout: time.Millisecond * 50, Backoff: ConstantBackoff(time.Minute)},
+			Handler: func(ctx context.Context, tc *TaskContext) (string, error) {
+				calls++
+				log = LoggerFrom(ctx)
+				return "done", err
+			},
+		})
+		storage := &fakeTaskStorage{}
+
+		Convey("A successful run finishes the task", func() {
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action})
+			So(calls, ShouldEqual, 1)
+			So(storage.last(), ShouldResemble, taskUpdate{status: "finished", retries: 0, result: "done"})
+		})
+
+		Convey("A failed run is re-queued after its backoff and its retries incremented", func() {
+			err = errors.New("boom")
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, Retries: 1})
+			So(storage.last(), ShouldResemble, taskUpdate{status: "pending", retries: 2, result: "boom", delay: time.Minute})
+		})
+
+		Convey("A failed run that reaches the retry limit fails the task", func() {
+			err = errors.New("boom")
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, Retries: 2})
+			So(storage.last().status, ShouldEqual, "failed")
+			So(storage.last().retries, ShouldEqual, 3)
+			So(storage.last().result, ShouldContainSubstring, "boom")
+		})
+
+		Convey("A task already over its retry limit is not run", func() {
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, Retries: 3})
+			So(calls, ShouldEqual, 0)
+			So(storage.last().status, ShouldEqual, "failed")
+		})
+
+		Convey("A TaskFailedError fails the task without retrying", func() {
+			err = TaskFailed("no point")
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action})
+			So(storage.last(), ShouldResemble, taskUpdate{status: "failed", retries: 1, result: "no point"})
+		})
+
+		Convey("A task that asked for a webhook schedules one with its outcome", func() {
+			err = TaskFailed("no point")
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, ResourceId: "i1", RequestId: "r1", Metadata: `{"webhook":{"url":"https://example.com","secret":"s"}}`})
+			So(len(storage.added), ShouldEqual, 1)
+			So(storage.added[0].Action, ShouldEqual, NotifyOperationWebhookTask)
+			So(storage.added[0].RequestId, ShouldEqual, "r1")
+			So(storage.added[0].Metadata, ShouldContainSubstring, `"state":"failed"`)
+			So(storage.added[0].Metadata, ShouldContainSubstring, `"description":"no point"`)
+			So(storage.added[0].Metadata, ShouldContainSubstring, `"instance_id":"i1"`)
+		})
+
+		Convey("The handler logs with the request that queued the task", func() {
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, ResourceId: "i1", RequestId: "r1"})
+			So(log.RequestId(), ShouldEqual, "r1")
+			So(log.Field("task_id"), ShouldEqual, "t1")
+			So(log.Field("instance_id"), ShouldEqual, "i1")
+		})
+
+		Convey("A task without a webhook does not schedule one", func() {
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action, Metadata: "not json"})
+			So(storage.last().status, ShouldEqual, "finished")
+			So(len(storage.added), ShouldEqual, 0)
+		})
+
+		Convey("A task without a handler fails", func() {
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: "does-not-exist"})
+			So(storage.last().status, ShouldEqual, "failed")
+		})
+
+		Convey("A handler that exceeds its timeout is retried", func() {
+			RegisterTaskHandler(action, BasicTaskHandler{
+				TaskPolicy: TaskPolicy{RetryLimit: 3, Timeout: time.Millisecond * 10},
+				Handler: func(ctx context.Context, tc *TaskContext) (string, error) {
+					<-ctx.Done()
+					time.Sleep(time.Millisecond * 10)
+					calls++
+					return "late", nil
+				},
+			})
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action})
+			So(storage.last().status, ShouldEqual, "pending")
+			So(storage.last().retries, ShouldEqual, 1)
+			// the retry must not overlap with the run that timed out.
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("A handler that never returns is given up on", func() {
+			grace := taskTimeoutGrace
+			taskTimeoutGrace = time.Millisecond * 20
+			release := make(chan struct{})
+			Reset(func() {
+				taskTimeoutGrace = grace
+				close(release)
+			})
+			RegisterTaskHandler(action, BasicTaskHandler{
+				TaskPolicy: TaskPolicy{RetryLimit: 3, Timeout: time.Millisecond * 10},
+				Handler: func(ctx context.Context, tc *TaskContext) (string, error) {
+					<-release
+					return "never", nil
+				},
+			})
+			RunTask(context.TODO(), storage, "test", &Task{Id: "t1", Action: action})
+			So(storage.last().status, ShouldEqual, "pending")
+			So(storage.last().retries, ShouldEqual, 1)
+			So(storage.last().result, ShouldContainSubstring, "did not finish within")
+		})
+	})
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	Convey("Given an exponential backoff without jitter", t, func() {
+		b := ExponentialBackoff{Initial: time.Minute, Max: time.Minute * 10}
+		So(b.Delay(0), ShouldEqual, time.Minute)
+		So(b.Delay(1), ShouldEqual, time.Minute)
+		So(b.Delay(2), ShouldEqual, time.Minute*2)
+		So(b.Delay(4), ShouldEqual, time.Minute*8)
+		So(b.Delay(5), ShouldEqual, time.Minute*10)
+		So(b.Delay(100), ShouldEqual, time.Minute*10)
+	})
+	Convey("Given an exponential backoff with jitter", t, func() {
+		b := ExponentialBackoff{Initial: time.Minute, Max: time.Minute * 10, Multiplier: 3, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			So(b.Delay(3), ShouldBeBetweenOrEqual, time.Minute*9/2, time.Minute*9)
+			So(b.Delay(10), ShouldBeBetweenOrEqual, time.Minute*5, time.Minute*10)
+		}
+	})
+}
+
+type fakeInterventionStorage struct {
+	fakeTaskStorage
+	task *Task
+}
+
+func (s *fakeInterventionStorage) InterveneInTask(Id string, intervention TaskIntervention) (*Task, error) {
+	task := *s.task
+	task.Status = intervention.ToStatus
+	task.Result = intervention.Action + " by " + intervention.Actor + ": " + intervention.Reason
+	return &task, nil
+}
+
+func TestInterveneInTask(t *testing.T) {
+	Convey("Given a stuck deprovision that asked for a webhook", t, func() {
+		storage := &fakeInterventionStorage{task: &Task{Id: "t1", ResourceId: "i1", Action: DeleteTask, Status: "started", RequestId: "r1",
+			Metadata: `{"webhook":{"url":"https://example.com/hook","secret":"s"}}`}}
+		b := &BusinessLogic{storage: storage}
+
+		Convey("Failing it tells the caller the deprovision failed", func() {
+			So(b.FailTask("t1", "ops", "stuck on a dead cluster"), ShouldBeNil)
+			So(storage.added, ShouldHaveLength, 1)
+			So(storage.added[0].Action, ShouldEqual, NotifyOperationWebhookTask)
+			So(storage.added[0].RequestId, ShouldEqual, "r1")
+			var metadata OperationWebhookTaskMetadata
+			So(json.Unmarshal([]byte(storage.added[0].Metadata), &metadata), ShouldBeNil)
+			So(metadata.Operation, ShouldEqual, "deprovision")
+			So(metadata.State, ShouldEqual, "failed")
+			So(metadata.Description, ShouldEqual, "fail by ops: stuck on a dead cluster")
+		})
+
+		Convey("Requeueing it sends nothing", func() {
+			storage.task.Status = "failed"
+			So(b.RequeueTask("t1", "ops", "the cluster is back"), ShouldBeNil)
+			So(storage.added, ShouldHaveLength, 0)
+		})
+	})
+}
@@ -0,0 +1,209 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/akkeris/mongodb-broker"
+
+// tracer is looked up on every use so a provider set after start up (or by a
+// test) is used.
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+// endSpan records the error of the work a span is for, if there was one, and
+// ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func requestContext(c *broker.RequestContext) context.Context {
+	if c == nil || c.Request == nil {
+		return context.Background()
+	}
+	return c.Request.Context()
+}
+
+// TaskOrigin is the request (or task) a task was queued by, the worker logs and
+// traces the task as part of it.
+type TaskOrigin struct {
+	RequestId string
+	// TraceContext is the W3C traceparent of the span that queued the task.
+	TraceContext string
+}
+
+// taskOrigin is the request id and span of the request or task the context is for.
+func taskOrigin(ctx context.Context) TaskOrigin {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return TaskOrigin{RequestId: LoggerFrom(ctx).RequestId(), TraceContext: carrier.Get("traceparent")}
+}
+
+// taskTraceContext is the context of the span that queued the task, the span of
+// the task is its child.
+func taskTraceContext(ctx context.Context, task *Task) context.Context {
+	if task.TraceContext == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": task.TraceContext})
+}
+
+// otlpProtocol is the protocol spans are exported with, http/protobuf unless
+// OTEL_EXPORTER_OTLP_TRACES_PROTOCOL or OTEL_EXPORTER_OTLP_PROTOCOL say otherwise.
+func otlpProtocol() string {
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if protocol := os.Getenv(env); protocol != "" {
+			return protocol
+		}
+	}
+	return "http/protobuf"
+}
+
+// tracingEnabled is whether a collector is set, with -otlp-endpoint,
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+func tracingEnabled(o Options) bool {
+	return o.OTLPEndpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// newOTLPExporter is the exporter for the protocol of the collector, the rest of
+// its settings (headers, timeouts, tls) are read by the exporter from the
+// standard OTEL_EXPORTER_OTLP_* environment variables. -otlp-endpoint is the base
+// url of the collector and takes precedence over them.
+func newOTLPExporter(ctx context.Context, o Options) (sdktrace.SpanExporter, error) {
+	switch protocol := otlpProtocol(); protocol {
+	case "grpc":
+		var options []otlptracegrpc.Option
+		if o.OTLPEndpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpointURL(o.OTLPEndpoint))
+		}
+		return otlptracegrpc.New(ctx, options...)
+	case "http/protobuf":
+		var options []otlptracehttp.Option
+		if o.OTLPEndpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(strings.TrimSuffix(o.OTLPEndpoint, "/")+"/v1/traces"))
+		}
+		return otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("The OTLP protocol %s is not supported, use grpc or http/protobuf", protocol)
+	}
+}
+
+// initTracing exports spans to the OTLP collector set in the options until the
+// context is done, the service name can be overridden with OTEL_SERVICE_NAME.
+// The W3C trace context of incoming requests is always honoured so traces of the
+// platform carry on through the broker.
+func initTracing(ctx context.Context, o Options, serviceName string) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !tracingEnabled(o) {
+		return nil
+	}
+	res := resource.Default()
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		var err error
+		if res, err = resource.Merge(res, resource.NewSchemaless(attribute.String("service.name", serviceName))); err != nil {
+			return err
+		}
+	}
+	exporter, err := newOTLPExporter(ctx, o)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Errorf("Unable to export spans: %s\n", err.Error())
+	}))
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("Unable to flush spans: %s\n", err.Error())
+		}
+	}()
+	logger.Infof("Exporting spans with OTLP over %s\n", otlpProtocol())
+	return nil
+}
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// TracingMiddleware starts a span for every request, a child of the span of the
+// platform if it sent a traceparent header. The OSB handlers, the storage and
+// provider calls they make and the tasks they queue are all part of it.
+func (b *BusinessLogic) TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// probes and scrapes would drown out the traces of the OSB api.
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		v := mux.Vars(r)
+		attributes := []attribute.KeyValue{
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		}
+		if v["instance_id"] != "" {
+			attributes = append(attributes, attribute.String("broker.instance_id", v["instance_id"]))
+		}
+		if v["binding_id"] != "" {
+			attributes = append(attributes, attribute.String("broker.binding_id", v["binding_id"]))
+		}
+		ctx, span := tracer().Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+		defer span.End()
+
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func endedSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	Convey("Given a tracer provider that records spans", t, func() {
+		recorder := tracetest.NewSpanRecorder()
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		Reset(func() {
+			otel.SetTracerProvider(previous)
+		})
+
+		Convey("A task continues the trace of the request that queued it", func() {
+			var action TaskAction = "test-traced-action"
+			var log Logger
+			RegisterTaskHandler(action, BasicTaskHandler{
+				TaskPolicy: TaskPolicy{RetryLimit: 3},
+				Handler: func(ctx context.Context, tc *TaskContext) (string, error) {
+					log = LoggerFrom(ctx)
+					provider, err := tc.GetProvider(&ProviderPlan{ID: "p1", Provider: MongoDBInstance})
+					if err != nil {
+						return "", err
+					}
+					return "done", provider.Tag(&Instance{Plan: &ProviderPlan{ID: "p1"}}, "owner", "me")
+				},
+			})
+			ctx, request := tracer().Start(withLogger(context.Background(), logger.With("request_id", "r1")), "PUT /v2/service_instances/{instance_id}")
+			origin := taskOrigin(ctx)
+			request.End()
+			So(origin.RequestId, ShouldEqual, "r1")
+			So(origin.TraceContext, ShouldStartWith, "00-"+request.SpanContext().TraceID().String()+"-"+request.SpanContext().SpanID().String())
+
+			RunTask(context.TODO(), &fakeTaskStorage{}, "test", &Task{Id: "t1", Action: action, RequestId: origin.RequestId, TraceContext: origin.TraceContext})
+			task := endedSpan(recorder, "task test-traced-action")
+			So(task, ShouldNotBeNil)
+			So(task.Parent().TraceID(), ShouldEqual, request.SpanContext().TraceID())
+			So(task.Parent().SpanID(), ShouldEqual, request.SpanContext().SpanID())
+			So(spanAttribute(task, "broker.task_id").AsString(), ShouldEqual, "t1")
+			So(log.Field("trace_id"), ShouldEqual, request.SpanContext().TraceID().String())
+
+			call := endedSpan(recorder, "Provider.Tag")
+			So(call, ShouldNotBeNil)
+			So(call.Parent().SpanID(), ShouldEqual, task.SpanContext().SpanID())
+			update := endedSpan(recorder, "Storage.UpdateTask")
+			So(update, ShouldNotBeNil)
+			So(update.Parent().SpanID(), ShouldEqual, task.SpanContext().SpanID())
+		})
+
+		Convey("A provider call that fails has an error status", func() {
+			provider := withProviderContext(instrumentedProvider{Provider: fakeFailingProvider{}}, context.Background())
+			So(provider.Tag(&Instance{Plan: &ProviderPlan{ID: "shared"}}, "owner", "me"), ShouldNotBeNil)
+			call := endedSpan(recorder, "Provider.Tag")
+			So(call, ShouldNotBeNil)
+			So(call.Status().Code, ShouldEqual, codes.Error)
+			So(spanAttribute(call, "broker.cluster").AsString(), ShouldEqual, "mongodb.example.com:27017")
+		})
+
+		Convey("A request continues the trace of the platform", func() {
+			router := mux.NewRouter()
+			router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+			b := &BusinessLogic{}
+			router.Use(b.TracingMiddleware)
+			r := httptest.NewRequest("PUT", "/v2/service_instances/i1", nil)
+			r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+			router.ServeHTTP(httptest.NewRecorder(), r)
+
+			span := endedSpan(recorder, "PUT /v2/service_instances/{instance_id}")
+			So(span, ShouldNotBeNil)
+			So(span.SpanContext().TraceID().String(), ShouldEqual, "0af7651916cd43dd8448eb211c80319c")
+			So(span.Parent().SpanID().String(), ShouldEqual, "b7ad6b7169203331")
+			So(spanAttribute(span, "broker.instance_id").AsString(), ShouldEqual, "i1")
+			So(spanAttribute(span, "http.response.status_code").AsInt64(), ShouldEqual, 500)
+			So(span.Status().Code, ShouldEqual, codes.Error)
+		})
+
+		Convey("Spans are exported to the collector as OTLP protobuf", func() {
+			var request coltracepb.ExportTraceServiceRequest
+			var path, apiKey string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				apiKey = r.Header.Get("x-api-key")
+				byteData, _ := ioutil.ReadAll(r.Body)
+				proto.Unmarshal(byteData, &request)
+			}))
+			defer server.Close()
+			t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=k")
+
+			_, span := tracer().Start(context.Background(), "Storage.GetTask")
+			span.SetAttributes(attribute.Int("broker.task.retries", 2))
+			endSpan(span, os.ErrNotExist)
+			exporter, err := newOTLPExporter(context.Background(), Options{OTLPEndpoint: server.URL + "/"})
+			So(err, ShouldBeNil)
+			So(exporter.ExportSpans(context.Background(), recorder.Ended()), ShouldBeNil)
+			So(exporter.Shutdown(context.Background()), ShouldBeNil)
+			So(path, ShouldEqual, "/v1/traces")
+			So(apiKey, ShouldEqual, "k")
+
+			scopeSpans := request.ResourceSpans[0].ScopeSpans[0]
+			So(scopeSpans.Scope.Name, ShouldEqual, instrumentationName)
+			exported := scopeSpans.Spans[0]
+			So(exported.Name, ShouldEqual, "Storage.GetTask")
+			So(hex.EncodeToString(exported.TraceId), ShouldEqual, span.SpanContext().TraceID().String())
+			So(exported.Status.Code, ShouldEqual, tracepb.Status_STATUS_CODE_ERROR)
+			So(exported.Attributes[0].Key, ShouldEqual, "broker.task.retries")
+			So(exported.Attributes[0].Value.GetIntValue(), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given the OTLP settings", t, func() {
+		So(tracingEnabled(Options{}), ShouldBeFalse)
+		So(tracingEnabled(Options{OTLPEndpoint: "http://localhost:4318"}), ShouldBeTrue)
+		So(otlpProtocol(), ShouldEqual, "http/protobuf")
+
+		t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+		exporter, err := newOTLPExporter(context.Background(), Options{OTLPEndpoint: "http://localhost:4317"})
+		So(err, ShouldBeNil)
+		So(exporter.Shutdown(context.Background()), ShouldBeNil)
+
+		t.Setenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "http/json")
+		_, err = newOTLPExporter(context.Background(), Options{OTLPEndpoint: "http://localhost:4318"})
+		So(err, ShouldNotBeNil)
+	})
+}
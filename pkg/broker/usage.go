@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultUsageInterval is how often the usage of every instance is collected if
+// it is not set with -usage-interval or USAGE_INTERVAL.
+const defaultUsageInterval = time.Minute * 15
+
+// UsageSample is the storage a single instance used when it was collected.
+type UsageSample struct {
+	ResourceId  string    `json:"instance_id"`
+	Plan        string    `json:"plan"`
+	Owner       string    `json:"owner"`
+	DataSize    int64     `json:"data_size"`
+	StorageSize int64     `json:"storage_size"`
+	IndexSize   int64     `json:"index_size"`
+	Objects     int64     `json:"objects"`
+	Collections int64     `json:"collections"`
+	Collected   time.Time `json:"collected"`
+}
+
+// UsageCollector is implemented by providers that can say how much storage an
+// instance uses.
+type UsageCollector interface {
+	Usage(*Instance) (*UsageSample, error)
+}
+
+var usageLabels = []string{"instance_id", "plan", "owner"}
+
+var (
+	usageDataSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mongodb_broker",
+		Name:      "instance_data_size_bytes",
+		Help:      "The size of the data in an instance (dbStats dataSize).",
+	}, usageLabels)
+	usageStorageSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mongodb_broker",
+		Name:      "instance_storage_size_bytes",
+		Help:      "The storage allocated to an instance (dbStats storageSize).",
+	}, usageLabels)
+	usageIndexSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mongodb_broker",
+		Name:      "instance_index_size_bytes",
+		Help:      "The size of the indexes of an instance (dbStats indexSize).",
+	}, usageLabels)
+	usageObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mongodb_broker",
+		Name:      "instance_objects",
+		Help:      "The number of documents in an instance (dbStats objects).",
+	}, usageLabels)
+	usageCollections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mongodb_broker",
+		Name:      "instance_collections",
+		Help:      "The number of collections in an instance (dbStats collections).",
+	}, usageLabels)
+)
+
+// usageGauges keeps the gauges to the instances seen in the last collection so
+// deleted instances drop out of them.
+type usageGauges struct {
+	sync.Mutex
+	labels map[string][]string
+}
+
+var usage = usageGauges{labels: make(map[string][]string)}
+
+func (u *usageGauges) set(samples []UsageSample) {
+	u.Lock()
+	defer u.Unlock()
+	current := make(map[string][]string)
+	for _, sample := range samples {
+		labels := []string{sample.ResourceId, sample.Plan, sample.Owner}
+		current[sample.ResourceId] = labels
+		usageDataSize.WithLabelValues(labels...).Set(float64(sample.DataSize))
+		usageStorageSize.WithLabelValues(labels...).Set(float64(sample.StorageSize))
+		usageIndexSize.WithLabelValues(labels...).Set(float64(sample.IndexSize))
+		usageObjects.WithLabelValues(labels...).Set(float64(sample.Objects))
+		usageCollections.WithLabelValues(labels...).Set(float64(sample.Collections))
+	}
+	for id, labels := range u.labels {
+		if newLabels, ok := current[id]; ok && newLabels[1] == labels[1] && newLabels[2] == labels[2] {
+			continue
+		}
+		for _, gauge := range []*prometheus.GaugeVec{usageDataSize, usageStorageSize, usageIndexSize, usageObjects, usageCollections} {
+			gauge.DeleteLabelValues(labels...)
+		}
+	}
+	u.labels = current
+}
+
+func usageIntervalFromOptions(o Options) time.Duration {
+	if o.UsageInterval == 0 && os.Getenv("USAGE_INTERVAL") != "" {
+		interval, err := time.ParseDuration(os.Getenv("USAGE_INTERVAL"))
+		if err != nil {
+			logger.Errorf("Unable to parse USAGE_INTERVAL, using %s: %s\n", defaultUsageInterval, err.Error())
+		}
+		o.UsageInterval = interval
+	}
+	if o.UsageInterval <= 0 {
+		o.UsageInterval = defaultUsageInterval
+	}
+	return o.UsageInterval
+}
+
+// CollectUsage samples the usage of every live instance, records it, enforces the
+// storage quota of its plan and updates the gauges. An instance whose usage cannot
+// be collected is skipped.
+func CollectUsage(namePrefix string, storage Storage) ([]UsageSample, error) {
+	ctx, span := tracer().Start(context.Background(), "CollectUsage")
+	defer span.End()
+	entries, err := storage.GetLiveInstances()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]UsageSample, 0)
+	for _, entry := range entries {
+		log := logger.With("instance_id", entry.Id)
+		Instance, err := GetInstanceById(namePrefix, storage, entry.Id)
+		if err != nil {
+			log.Errorf("Unable to get instance %s to collect its usage: %s\n", entry.Id, err.Error())
+			continue
+		}
+		log = instanceLogger(log, Instance)
+		provider, err := GetProviderByPlan(namePrefix, Instance.Plan)
+		if err != nil {
+			log.Errorf("Unable to get provider for instance %s to collect its usage: %s\n", entry.Id, err.Error())
+			continue
+		}
+		provider = withProviderContext(provider, withLogger(ctx, log))
+		collector, ok := unwrapProvider(provider).(UsageCollector)
+		if !ok {
+			continue
+		}
+		sample, err := collector.Usage(Instance)
+		if err != nil {
+			log.Errorf("Unable to collect usage of instance %s: %s\n", entry.Id, err.Error())
+			continue
+		}
+		sample.ResourceId = entry.Id
+		sample.Plan = Instance.Plan.basePlan.Name
+		// the owner is the organization recorded when the instance was provisioned
+		// or claimed, the user of a preprovisioned instance does not know it.
+		sample.Owner = entry.Owner
+		if err = storage.AddUsageSample(sample); err != nil {
+			log.Errorf("Unable to record usage of instance %s: %s\n", entry.Id, err.Error())
+		}
+		if err = EnforceQuota(provider, storage, Instance, entry.QuotaState, sample); err != nil {
+			log.Errorf("Unable to enforce the storage quota of instance %s: %s\n", entry.Id, err.Error())
+		}
+		samples = append(samples, *sample)
+	}
+	usage.set(samples)
+	return samples, nil
+}
+
+// RunUsageCollection collects the usage of every instance each interval until the
+// context is done.
+func RunUsageCollection(ctx context.Context, o Options, namePrefix string, storage Storage) {
+	t := time.NewTicker(usageIntervalFromOptions(o))
+	defer t.Stop()
+	for {
+		if samples, err := CollectUsage(namePrefix, storage); err != nil {
+			logger.Errorf("Collecting usage failed: %s\n", err.Error())
+		} else {
+			logger.V(1).Infof("Collected the usage of %d instances\n", len(samples))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
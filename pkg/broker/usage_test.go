@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUsageGauges(t *testing.T) {
+	Convey("Given the usage of two instances was collected", t, func() {
+		usage.set([]UsageSample{
+			{ResourceId: "a", Plan: "shared", Owner: "org-1", DataSize: 1024, StorageSize: 4096, IndexSize: 512, Objects: 10, Collections: 2},
+			{ResourceId: "b", Plan: "shared", Owner: "org-2", DataSize: 2048},
+		})
+		So(testutil.ToFloat64(usageDataSize.WithLabelValues("a", "shared", "org-1")), ShouldEqual, 1024)
+		So(testutil.ToFloat64(usageStorageSize.WithLabelValues("a", "shared", "org-1")), ShouldEqual, 4096)
+		So(testutil.ToFloat64(usageCollections.WithLabelValues("a", "shared", "org-1")), ShouldEqual, 2)
+
+		Convey("Instances that are gone or changed plans drop out of the gauges", func() {
+			usage.set([]UsageSample{{ResourceId: "a", Plan: "dedicated", Owner: "org-1", DataSize: 1024}})
+			So(usageDataSize.DeleteLabelValues("b", "shared", "org-2"), ShouldBeFalse)
+			So(usageDataSize.DeleteLabelValues("a", "shared", "org-1"), ShouldBeFalse)
+			So(testutil.ToFloat64(usageDataSize.WithLabelValues("a", "dedicated", "org-1")), ShouldEqual, 1024)
+		})
+	})
+}
+
+func TestUsageInterval(t *testing.T) {
+	Convey("Given the usage interval options", t, func() {
+		So(usageIntervalFromOptions(Options{}), ShouldEqual, defaultUsageInterval)
+		So(usageIntervalFromOptions(Options{UsageInterval: time.Minute}), ShouldEqual, time.Minute)
+		os.Setenv("USAGE_INTERVAL", "1h")
+		defer os.Unsetenv("USAGE_INTERVAL")
+		So(usageIntervalFromOptions(Options{}), ShouldEqual, time.Hour)
+	})
+}
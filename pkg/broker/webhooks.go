@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhooks are signed over "<timestamp>.<delivery id>.<body>" with every active
+// secret, so a receiver can reject deliveries that are too old or that it has
+// already seen, and secrets can be rotated by adding the new one before the
+// old one is removed. The legacy x-osb-signature header (the body signed with
+// the secret given on the request) is still sent for older receivers.
+const (
+	WebhookTimestampHeader = "x-osb-webhook-timestamp"
+	WebhookDeliveryHeader  = "x-osb-webhook-delivery"
+	WebhookSignatureHeader = "x-osb-webhook-signature"
+	LegacySignatureHeader  = "x-osb-signature"
+
+	// DefaultWebhookKeyId is the key id of the secret given on a request if
+	// no key_id was given with it.
+	DefaultWebhookKeyId = "default"
+)
+
+var (
+	ErrWebhookMissingHeaders = errors.New("The webhook is missing its timestamp, delivery or signature headers")
+	ErrWebhookStale          = errors.New("The webhook timestamp is outside of the allowed window")
+	ErrWebhookBadSignature   = errors.New("The webhook signature does not match any known secret")
+)
+
+// ParseWebhookSecrets reads a comma separated list of key_id:secret pairs.
+func ParseWebhookSecrets(secrets string) map[string]string {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(secrets, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys
+}
+
+// webhookSecrets returns every secret a webhook should be signed with, the one
+// given on the request and any the broker has been configured with through
+// WEBHOOK_SECRETS.
+func webhookSecrets(hook WebhookTaskMetadata) map[string]string {
+	secrets := ParseWebhookSecrets(os.Getenv("WEBHOOK_SECRETS"))
+	if hook.Secret != "" {
+		keyId := hook.KeyId
+		if keyId == "" {
+			keyId = DefaultWebhookKeyId
+		}
+		secrets[keyId] = hook.Secret
+	}
+	return secrets
+}
+
+func signWebhook(secret string, timestamp string, deliveryId string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "." + deliveryId + "."))
+	h.Write(body)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// SignWebhook returns the headers for a delivery of body, the signature header
+// holds a space separated list of key_id=signature for every secret.
+func SignWebhook(secrets map[string]string, deliveryId string, timestamp time.Time, body []byte) http.Header {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	signatures := make([]string, 0)
+	for keyId, secret := range secrets {
+		signatures = append(signatures, keyId+"="+signWebhook(secret, ts, deliveryId, body))
+	}
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, ts)
+	header.Set(WebhookDeliveryHeader, deliveryId)
+	header.Set(WebhookSignatureHeader, strings.Join(signatures, " "))
+	return header
+}
+
+// VerifyWebhook is for receivers of webhooks from this broker, it checks the body
+// was signed with one of the secrets (by key id) and that the delivery is no
+// older (or newer) than maxAge. It returns the delivery id, which receivers
+// should remember for at least maxAge to reject replays of the same delivery.
+func VerifyWebhook(header http.Header, body []byte, secrets map[string]string, maxAge time.Duration) (string, error) {
+	ts := header.Get(WebhookTimestampHeader)
+	deliveryId := header.Get(WebhookDeliveryHeader)
+	signatures := header.Get(WebhookSignatureHeader)
+	if ts == "" || deliveryId == "" || signatures == "" {
+		return "", ErrWebhookMissingHeaders
+	}
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", ErrWebhookMissingHeaders
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > maxAge || age < -maxAge {
+		return "", ErrWebhookStale
+	}
+	for _, signature := range strings.Fields(signatures) {
+		parts := strings.SplitN(signature, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		secret, ok := secrets[parts[0]]
+		if !ok {
+			continue
+		}
+		if hmac.Equal([]byte(parts[1]), []byte(signWebhook(secret, ts, deliveryId, body))) {
+			return deliveryId, nil
+		}
+	}
+	return "", ErrWebhookBadSignature
+}
+
+// WebhookDelivery is a single attempt at delivering a webhook, the event id is the
+// task that sent it (which is also the delivery id receivers see). Only the host
+// of the url is kept as the rest of it may hold tokens.
+type WebhookDelivery struct {
+	Id         string    `json:"id"`
+	EventId    string    `json:"event_id"`
+	Event      string    `json:"event"`
+	ResourceId string    `json:"resource_id"`
+	UrlHost    string    `json:"url_host"`
+	StatusCode int       `json:"status_code"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Response   string    `json:"response"`
+	Error      string    `json:"error"`
+	Created    time.Time `json:"created"`
+}
+
+// maxWebhookResponse is how much of a receivers response is kept with a delivery.
+const maxWebhookResponse = 1024
+
+// PostWebhook posts the payload to the webhook url signed with its secrets and
+// reports how the attempt went, the delivery id should stay the same across
+// retries of the same event (but not when it is redelivered by hand).
+func PostWebhook(ctx context.Context, deliveryId string, hook WebhookTaskMetadata, byteData []byte) WebhookDelivery {
+	delivery := WebhookDelivery{EventId: deliveryId}
+	if u, err := url.Parse(hook.Url); err == nil {
+		delivery.UrlHost = u.Host
+	}
+
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(byteData))
+	if err != nil {
+		delivery.Error = "Failed to create http post request: " + err.Error()
+		return delivery
+	}
+	req = req.WithContext(ctx)
+	for name, values := range SignWebhook(webhookSecrets(hook), deliveryId, time.Now(), byteData) {
+		req.Header[name] = values
+	}
+	req.Header.Add("content-type", "application/json")
+	if hook.Secret != "" {
+		h := hmac.New(sha256.New, []byte(hook.Secret))
+		h.Write(byteData)
+		req.Header.Add(LegacySignatureHeader, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	delivery.LatencyMs = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		delivery.Error = "Failed to send http post operation: " + err.Error()
+		return delivery
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	delivery.StatusCode = resp.StatusCode
+	delivery.Response = strings.ToValidUTF8(string(body), "")
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		delivery.Error = "Got invalid http status code from hook: " + resp.Status
+	}
+	return delivery
+}
+
+// SendWebhook delivers the payload for a task and records the attempt. Unless
+// RETRY_WEBHOOKS is set a non-successful response fails the delivery for good.
+func SendWebhook(ctx context.Context, storage Storage, task *Task, hook WebhookTaskMetadata, payload interface{}) (string, error) {
+	byteData, err := json.Marshal(payload)
+	if err != nil {
+		return "", TaskFailed("Cannot marshal webhook payload to json: " + err.Error())
+	}
+	delivery := PostWebhook(ctx, task.Id, hook, byteData)
+	delivery.Event = string(task.Action)
+	delivery.ResourceId = task.ResourceId
+	if err := storage.AddWebhookDelivery(&delivery); err != nil {
+		LoggerFrom(ctx).Errorf("Unable to record webhook delivery for task %s: %s\n", task.Id, err.Error())
+	}
+	observeWebhookDelivery(delivery)
+
+	if delivery.Error != "" && delivery.StatusCode == 0 {
+		return "", errors.New(delivery.Error)
+	}
+	if delivery.Error != "" {
+		if os.Getenv("RETRY_WEBHOOKS") != "" {
+			return "", errors.New(delivery.Error)
+		}
+		return "", TaskFailed(delivery.Error)
+	}
+	return strconv.Itoa(delivery.StatusCode) + " " + http.StatusText(delivery.StatusCode), nil
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"errors"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignatures(t *testing.T) {
+	Convey("Given a webhook signed with two secrets", t, func() {
+		body := []byte(`{"state":"succeeded"}`)
+		header := SignWebhook(map[string]string{"old": "secret1", "new": "secret2"}, "delivery-1", time.Now(), body)
+
+		Convey("It verifies with either secret", func() {
+			id, err := VerifyWebhook(header, body, map[string]string{"old": "secret1"}, time.Minute)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "delivery-1")
+			id, err = VerifyWebhook(header, body, map[string]string{"new": "secret2"}, time.Minute)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, "delivery-1")
+		})
+
+		Convey("It does not verify with an unknown or wrong secret", func() {
+			_, err := VerifyWebhook(header, body, map[string]string{"other": "secret1"}, time.Minute)
+			So(err, ShouldEqual, ErrWebhookBadSignature)
+			_, err = VerifyWebhook(header, body, map[string]string{"new": "secret1"}, time.Minute)
+			So(err, ShouldEqual, ErrWebhookBadSignature)
+		})
+
+		Convey("It does not verify a tampered body or delivery id", func() {
+			_, err := VerifyWebhook(header, []byte(`{"state":"failed"}`), map[string]string{"new": "secret2"}, time.Minute)
+			So(err, ShouldEqual, ErrWebhookBadSignature)
+			header.Set(WebhookDeliveryHeader, "delivery-2")
+			_, err = VerifyWebhook(header, body, map[string]string{"new": "secret2"}, time.Minute)
+			So(err, ShouldEqual, ErrWebhookBadSignature)
+		})
+	})
+
+	Convey("Given a webhook signed too long ago", t, func() {
+		body := []byte(`{}`)
+		header := SignWebhook(map[string]string{"default": "secret"}, "delivery-1", time.Now().Add(-time.Hour), body)
+		_, err := VerifyWebhook(header, body, map[string]string{"default": "secret"}, time.Minute*5)
+		So(err, ShouldEqual, ErrWebhookStale)
+	})
+
+	Convey("Given a request without signature headers", t, func() {
+		_, err := VerifyWebhook(nil, []byte(`{}`), map[string]string{"default": "secret"}, time.Minute)
+		So(err, ShouldEqual, ErrWebhookMissingHeaders)
+	})
+}
+
+type fakeRedeliveryStorage struct {
+	Storage
+}
+
+func (s fakeRedeliveryStorage) RedeliverWebhook(resourceId string, taskId string) (string, error) {
+	switch taskId {
+	case "t1":
+		return "t2", nil
+	case "pending":
+		return "", errors.New("Webhook is pending and cannot be redelivered")
+	}
+	return "", errors.New("Cannot find webhook")
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+	Convey("Given a webhook that was delivered", t, func() {
+		b := &BusinessLogic{storage: fakeRedeliveryStorage{}}
+
+		Convey("It is redelivered as a new event", func() {
+			redelivery, err := b.RedeliverWebhook("i1", "t1")
+			So(err, ShouldBeNil)
+			So(redelivery.EventId, ShouldEqual, "t2")
+		})
+
+		Convey("Webhooks that are unknown or not done cannot be redelivered", func() {
+			_, err := b.RedeliverWebhook("i1", "t3")
+			httpErr, ok := osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusNotFound)
+			_, err = b.RedeliverWebhook("i1", "pending")
+			httpErr, ok = osb.IsHTTPError(err)
+			So(ok, ShouldBeTrue)
+			So(httpErr.StatusCode, ShouldEqual, http.StatusConflict)
+		})
+	})
+}